@@ -1,11 +1,18 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"hzip/src/compression"
 	"hzip/src/input"
+	"hzip/src/key_table"
+	"hzip/src/lz77"
 	"hzip/src/output"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -15,51 +22,198 @@ func main() {
 		os.Exit(1)
 	}
 	if os.Args[1] == "c" || os.Args[1] == "compress" {
-		if len(os.Args) < 4 {
+		compressor := compression.CreateCompressor()
+		outputFilename := ""
+		inputs := make([]string, 0)
+		// Like tar, take the time for reproducible builds from the environment
+		if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+			compressor.ModTime = parseTime("SOURCE_DATE_EPOCH", "@"+epoch)
+		}
+		args := os.Args[2:]
+		for i := 0; i < len(args); i++ {
+			arg, value, last := parseOption(args, i, "--mtime", "--max-code-length", "--tables", "--block-size", "-j", "--jobs", "--coder")
+			i = last
+			if arg == "--mtime" {
+				compressor.ModTime = parseTime(arg, value)
+			} else if arg == "--max-code-length" {
+				maxLength, err := strconv.Atoi(value)
+				if err != nil || maxLength < 0 || maxLength > key_table.MaxCodeLength {
+					fmt.Printf("[FATAL] --max-code-length needs a number from 0 to %d, got %s\n", key_table.MaxCodeLength, value)
+					os.Exit(1)
+				}
+				compressor.MaxCodeLength = maxLength
+			} else if arg == "--tables" {
+				modes := map[string]compression.TableMode{
+					"auto":   compression.TablesAuto,
+					"shared": compression.TablesShared,
+					"entry":  compression.TablesPerEntry,
+				}
+				mode, ok := modes[value]
+				if !ok {
+					fmt.Println("[FATAL] --tables needs auto, shared or entry, got " + value)
+					os.Exit(1)
+				}
+				compressor.TableMode = mode
+			} else if arg == "-j" || arg == "--jobs" {
+				compressor.Jobs = parseJobs(arg, value)
+			} else if arg == "--block-size" {
+				compressor.BlockSize = parseSize(arg, value, compression.MaxBlockSize)
+			} else if arg == "--lz" {
+				compressor.LZWindow = compression.DefaultLZWindow
+				if value != "" {
+					compressor.LZWindow = parseSize(arg, value, lz77.MaxWindow)
+				}
+			} else if arg == "--adaptive" {
+				compressor.Adaptive = true
+			} else if arg == "--coder" {
+				coders := map[string]compression.Coder{
+					"huffman": compression.CoderHuffman,
+					"range":   compression.CoderRange,
+					"ans":     compression.CoderANS,
+				}
+				coder, ok := coders[value]
+				if !ok {
+					fmt.Println("[FATAL] --coder needs huffman, range or ans, got " + value)
+					os.Exit(1)
+				}
+				compressor.Coder = coder
+			} else if strings.HasPrefix(arg, "--") {
+				fmt.Println("[FATAL] Unknown option " + arg)
+				os.Exit(1)
+			} else if outputFilename == "" {
+				outputFilename = arg
+			} else {
+				inputs = append(inputs, arg)
+			}
+		}
+		if outputFilename == "" || len(inputs) == 0 {
 			fmt.Println("[FATAL] Arguments to compress missing")
 			os.Exit(1)
 		}
-		outputFilename := os.Args[2]
-		inputs := os.Args[3:]
-
-		compressor := compression.CreateCompressor()
+		if compressor.Adaptive && compressor.Coder == compression.CoderANS {
+			fmt.Println("[FATAL] --adaptive can't be combined with --coder=ans")
+			os.Exit(1)
+		}
+		if (compressor.Adaptive || compressor.Coder != compression.CoderHuffman) && compressor.LZWindow > 0 {
+			fmt.Println("[FATAL] --lz only works with the static Huffman coder")
+			os.Exit(1)
+		}
+		onePass := compressor.Adaptive || compressor.Coder == compression.CoderRange
+		for _, inputFilename := range inputs {
+			if inputFilename == "-" && !onePass {
+				fmt.Println("[FATAL] - as an input needs --adaptive or --coder=range, which read inputs only once")
+				os.Exit(1)
+			}
+		}
 
-		compressor.SetOutput(&output.FileOutput{
-			Filename: output.GetOutputFilename(outputFilename),
-			Mode:     0666,
-		})
-		fmt.Println("[INFO] Collecting input files")
+		if outputFilename == "-" {
+			compressor.SetOutput(&output.StreamOutput{Writer: os.Stdout})
+			// Everything else printed goes to stderr, so it can't end up in the archive
+			compressor.Messages = os.Stderr
+		} else {
+			compressor.SetOutput(&output.FileOutput{
+				Filename: output.GetOutputFilename(outputFilename),
+				Mode:     0666,
+			})
+		}
+		fmt.Fprintln(compressor.Messages, "[INFO] Collecting input files")
 		for _, inputFilename := range inputs {
-			objs, err := input.ExpandInput(inputFilename)
+			if inputFilename == "-" {
+				// Stored as a file named stdin, made now
+				now := time.Now()
+				compressor.AddInput(&input.StreamInput{
+					Name:   "stdin",
+					Reader: os.Stdin,
+					Meta: input.FileMeta{
+						Mode:       0o644,
+						Owner_ID:   -1,
+						Group_ID:   -1,
+						ModTime:    now,
+						AccessTime: now,
+					},
+				})
+				continue
+			}
+			objs, err := input.ExpandInput(inputFilename, compressor.Messages)
 			// TODO make sure all inputs are in a subdirectory of the current directory
 			// TODO if there is only one file, it can be anywhere and will expand to just the object (no dirs)
 			if err != nil {
-				fmt.Println(err)
-				fmt.Println("[FATAL] Input collection failed")
+				fmt.Fprintln(compressor.Messages, err)
+				fmt.Fprintln(compressor.Messages, "[FATAL] Input collection failed")
 				os.Exit(1)
 			}
 			for _, inputObj := range objs {
 				compressor.AddInput(inputObj)
 			}
 		}
-		// TODO Remove duplicate inputs
+		compressor.SortInputs()
 
-		fmt.Println("[INFO] Compressing")
+		fmt.Fprintln(compressor.Messages, "[INFO] Compressing")
 		err := compressor.GenerateScheme()
 		if err != nil {
-			fmt.Println(err)
-			fmt.Println("[FATAL] Compression scheme generation failed")
+			fmt.Fprintln(compressor.Messages, err)
+			fmt.Fprintln(compressor.Messages, "[FATAL] Compression scheme generation failed")
 			os.Exit(1)
 		}
 
-		fmt.Println("[INFO] Compressing to archive")
+		fmt.Fprintln(compressor.Messages, "[INFO] Compressing to archive")
 		err = compressor.CompressToOutput()
 		if err != nil {
-			fmt.Println(err)
-			fmt.Println("[FATAL] Dump failed")
+			fmt.Fprintln(compressor.Messages, err)
+			fmt.Fprintln(compressor.Messages, "[FATAL] Dump failed")
 			os.Exit(1)
 		}
 	} else if os.Args[1] == "d" || os.Args[1] == "decompress" {
+		decompressor := compression.CreateDecompressor("")
+		args := os.Args[2:]
+		for i := 0; i < len(args); i++ {
+			arg, value, last := parseOption(args, i, "-C", "--directory", "--strip-components", "-j", "--jobs")
+			i = last
+			if arg == "-C" || arg == "--directory" {
+				decompressor.DestDir = value
+			} else if arg == "--strip-components" {
+				count, err := strconv.Atoi(value)
+				if err != nil || count < 0 {
+					fmt.Println("[FATAL] --strip-components needs a non-negative number, got " + value)
+					os.Exit(1)
+				}
+				decompressor.StripComponents = count
+			} else if arg == "-j" || arg == "--jobs" {
+				decompressor.Jobs = parseJobs(arg, value)
+			} else if arg == "--same-owner" {
+				decompressor.SameOwner = true
+			} else if arg == "--no-same-owner" {
+				decompressor.SameOwner = false
+			} else if arg == "--same-permissions" {
+				decompressor.SamePermissions = true
+			} else if arg == "--no-same-permissions" {
+				decompressor.SamePermissions = false
+			} else if strings.HasPrefix(arg, "--") {
+				fmt.Println("[FATAL] Unknown option " + arg)
+				os.Exit(1)
+			} else if decompressor.InputFilename == "" {
+				decompressor.InputFilename = arg
+			} else {
+				decompressor.Patterns = append(decompressor.Patterns, arg)
+			}
+		}
+		if decompressor.InputFilename == "" {
+			fmt.Println("[FATAL] Must supply an archive as an argument")
+			os.Exit(1)
+		}
+		err := decompressor.ReadMeta()
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println("[FATAL] Failed to read metadata from archive")
+			os.Exit(1)
+		}
+		err = decompressor.Decompress()
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println("[FATAL] Failed to decompress")
+			os.Exit(1)
+		}
+	} else if os.Args[1] == "t" || os.Args[1] == "test" {
 		if len(os.Args) < 3 {
 			fmt.Println("[FATAL] Must supply an archive as an argument")
 			os.Exit(1)
@@ -72,10 +226,48 @@ func main() {
 			fmt.Println("[FATAL] Failed to read metadata from archive")
 			os.Exit(1)
 		}
-		err = decompressor.Decompress()
+		err = decompressor.Test()
 		if err != nil {
 			fmt.Println(err)
-			fmt.Println("[FATAL] Failed to decompress")
+			fmt.Println("[FATAL] Archive failed integrity checks")
+			os.Exit(1)
+		}
+		fmt.Println("[INFO] " + inputFilename + " is OK")
+	} else if os.Args[1] == "l" || os.Args[1] == "list" {
+		jsonOutput := false
+		inputFilename := ""
+		for _, arg := range os.Args[2:] {
+			if arg == "--json" {
+				jsonOutput = true
+			} else {
+				inputFilename = arg
+			}
+		}
+		if inputFilename == "" {
+			fmt.Println("[FATAL] Must supply an archive as an argument")
+			os.Exit(1)
+		}
+		decompressor := compression.CreateDecompressor(inputFilename)
+		err := decompressor.ReadMeta()
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println("[FATAL] Failed to read metadata from archive")
+			os.Exit(1)
+		}
+		entries, err := decompressor.List()
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println("[FATAL] Failed to list archive")
+			os.Exit(1)
+		}
+		if jsonOutput {
+			err = printListingJSON(entries)
+		} else {
+			printListing(entries)
+		}
+		if err != nil {
+			fmt.Println(err)
+			fmt.Println("[FATAL] Failed to print listing")
 			os.Exit(1)
 		}
 	} else {
@@ -83,3 +275,132 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// Splits args[i] into an option and its value. The options listed in
+// withValue take a value, either after = or as the next argument. Returns
+// the index of the last argument used.
+func parseOption(args []string, i int, withValue ...string) (string, string, int) {
+	arg := args[i]
+	if equals := strings.Index(arg, "="); strings.HasPrefix(arg, "--") && equals >= 0 {
+		return arg[:equals], arg[equals+1:], i
+	}
+	for _, option := range withValue {
+		if arg != option {
+			continue
+		}
+		if i+1 >= len(args) {
+			fmt.Println("[FATAL] Option " + arg + " needs a value")
+			os.Exit(1)
+		}
+		return arg, args[i+1], i + 1
+	}
+	return arg, "", i
+}
+
+// Accepts RFC 3339 times, or @ followed by seconds since the Unix epoch
+func parseTime(option string, value string) time.Time {
+	if strings.HasPrefix(value, "@") {
+		seconds, err := strconv.ParseInt(value[1:], 10, 64)
+		if err == nil {
+			return time.Unix(seconds, 0).UTC()
+		}
+	} else {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err == nil {
+			return parsed
+		}
+	}
+	fmt.Println("[FATAL] " + option + " needs an RFC 3339 time or @seconds, got " + value)
+	os.Exit(1)
+	return time.Time{}
+}
+
+// Accepts a number of goroutines to work with, 0 for one per CPU
+func parseJobs(option string, value string) int {
+	jobs, err := strconv.Atoi(value)
+	if err != nil || jobs < 0 {
+		fmt.Println("[FATAL] " + option + " needs a number of jobs, or 0 for one per CPU, got " + value)
+		os.Exit(1)
+	}
+	if jobs == 0 {
+		return runtime.NumCPU()
+	}
+	return jobs
+}
+
+// Accepts a number of bytes with an optional K or M suffix, 0 or from 1K up
+// to max
+func parseSize(option string, value string, max int) int {
+	multiplier := 1
+	number := strings.TrimRight(value, "KkMm")
+	switch strings.ToUpper(value[len(number):]) {
+	case "":
+	case "K":
+		multiplier = 1024
+	case "M":
+		multiplier = 1024 * 1024
+	default:
+		number = ""
+	}
+	size, err := strconv.Atoi(number)
+	if err != nil || size < 0 || size*multiplier > max || (size > 0 && size*multiplier < 1024) {
+		fmt.Printf("[FATAL] %s needs 0 or a size from 1K to %dM, got %s\n", option, max/(1024*1024), value)
+		os.Exit(1)
+	}
+	return size * multiplier
+}
+
+// Compressed size as a percentage of the original size
+func compressionRatio(entry compression.ArchiveEntry) float64 {
+	if entry.Size == 0 {
+		return 0
+	}
+	return 100 * float64(entry.CompressedSize()) / float64(entry.Size)
+}
+
+func printListing(entries []compression.ArchiveEntry) {
+	var totalSize, totalCompressed uint64
+	fmt.Printf("%-10s %-16s %12s %12s %7s  %s\n", "Mode", "Modified", "Original", "Compressed", "Ratio", "Name")
+	for _, entry := range entries {
+		fmt.Printf("%-10s %-16s %12d %12d %6.1f%%  %s\n", entry.Mode, entry.ModTime.Format("2006-01-02 15:04"), entry.Size, entry.CompressedSize(), compressionRatio(entry), entry.Filename)
+		totalSize += entry.Size
+		totalCompressed += entry.CompressedSize()
+	}
+	total := compression.ArchiveEntry{
+		Size:           totalSize,
+		CompressedBits: totalCompressed * 8,
+	}
+	fmt.Printf("%-10s %-16s %12d %12d %6.1f%%  %d entries\n", "", "", totalSize, totalCompressed, compressionRatio(total), len(entries))
+}
+
+type listingEntry struct {
+	Name           string  `json:"name"`
+	Mode           string  `json:"mode"`
+	OwnerID        int     `json:"uid"`
+	GroupID        int     `json:"gid"`
+	ModTime        string  `json:"mtime"`
+	Size           uint64  `json:"size"`
+	CompressedSize uint64  `json:"compressed_size"`
+	CompressedBits uint64  `json:"compressed_bits"`
+	Ratio          float64 `json:"ratio"`
+}
+
+func printListingJSON(entries []compression.ArchiveEntry) error {
+	listing := make([]listingEntry, 0, len(entries))
+	for _, entry := range entries {
+		listing = append(listing, listingEntry{
+			Name:           entry.Filename,
+			Mode:           entry.Mode.String(),
+			OwnerID:        entry.OwnerID,
+			GroupID:        entry.GroupID,
+			ModTime:        entry.ModTime.UTC().Format(time.RFC3339),
+			Size:           entry.Size,
+			CompressedSize: entry.CompressedSize(),
+			CompressedBits: entry.CompressedBits,
+			Ratio:          compressionRatio(entry),
+		})
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(listing)
+}
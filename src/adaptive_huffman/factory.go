@@ -0,0 +1,11 @@
+package adaptive_huffman
+
+// An empty tree, with only the escape leaf
+func CreateTree() *Tree {
+	tree := &Tree{escape: root}
+	tree.nodes[root] = node{parent: none, left: none, right: none, symbol: none}
+	for i := range tree.leaves {
+		tree.leaves[i] = none
+	}
+	return tree
+}
@@ -0,0 +1,249 @@
+package adaptive_huffman
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Every byte value, plus the escape leaf standing for the ones not seen yet
+const numLeaves = 257
+
+const numNodes = 2*numLeaves - 1
+
+// Number of the root, the highest of all
+const root = numNodes - 1
+
+const none = -1
+
+// Size of the chunks compressed data is read in and decoded data is written in
+const chunkSize = 32 * 1024
+
+type node struct {
+	weight uint64
+	parent int
+	left   int // none for leaves
+	right  int
+	symbol int // byte value of a leaf, none for the escape leaf
+}
+
+// Huffman tree that is updated after every symbol with the FGK algorithm, so
+// an encoder and a decoder starting from the same empty tree assign the same
+// codes without a table being stored. A byte seen for the first time is sent
+// as the code of the escape leaf followed by its 8 bits.
+//
+// Nodes are numbered so that weights never decrease with the number and
+// siblings are next to each other, which is what keeps the tree a Huffman
+// tree as weights go up.
+type Tree struct {
+	nodes  [numNodes]node
+	leaves [256]int // node of each byte value, none until it has been seen
+	escape int
+	path   []byte // bits of the code being encoded, leaf to root
+}
+
+// Writes the code of symbol through write, most significant bit first and no
+// more than 64 bits at a time, then updates the tree. Returns the number of
+// bits written.
+func (tree *Tree) Encode(symbol byte, write func(code uint64, length uint) error) (uint64, error) {
+	current := tree.leaves[symbol]
+	seen := current != none
+	if !seen {
+		current = tree.escape
+	}
+	tree.path = tree.path[:0]
+	for current != root {
+		parent := tree.nodes[current].parent
+		if tree.nodes[parent].right == current {
+			tree.path = append(tree.path, 1)
+		} else {
+			tree.path = append(tree.path, 0)
+		}
+		current = parent
+	}
+	written := uint64(0)
+	code, length := uint64(0), uint(0)
+	for i := len(tree.path) - 1; i >= 0; i-- {
+		code = code<<1 | uint64(tree.path[i])
+		length++
+		if length == 56 {
+			err := write(code, length)
+			if err != nil {
+				return written, err
+			}
+			written += uint64(length)
+			code, length = 0, 0
+		}
+	}
+	if !seen {
+		code = code<<8 | uint64(symbol)
+		length += 8
+	}
+	if length > 0 {
+		err := write(code, length)
+		if err != nil {
+			return written, err
+		}
+		written += uint64(length)
+	}
+	tree.update(symbol)
+	return written, nil
+}
+
+// Decodes count symbols from the numBits bits of reader into writer. Exactly
+// the (numBits + 7) / 8 bytes holding those bits are consumed from reader,
+// and the padding in the last byte must be zero.
+func (tree *Tree) Decode(reader io.Reader, numBits uint64, count uint64, writer io.Writer) error {
+	source := bitSource{
+		reader:    reader,
+		remaining: (numBits + 7) / 8,
+		chunk:     make([]byte, 0, chunkSize),
+	}
+	var output [chunkSize]byte
+	outputLen := 0
+	for i := uint64(0); i < count; i++ {
+		current := root
+		for tree.nodes[current].left != none {
+			bit, err := source.readBits(1)
+			if err != nil {
+				return err
+			}
+			if bit == 0 {
+				current = tree.nodes[current].left
+			} else {
+				current = tree.nodes[current].right
+			}
+		}
+		var symbol byte
+		if current == tree.escape {
+			value, err := source.readBits(8)
+			if err != nil {
+				return err
+			}
+			symbol = byte(value)
+			if tree.leaves[symbol] != none {
+				return fmt.Errorf("[ERROR] Byte %d was escaped after it already had a code", symbol)
+			}
+		} else {
+			symbol = byte(tree.nodes[current].symbol)
+		}
+		tree.update(symbol)
+		output[outputLen] = symbol
+		outputLen++
+		if outputLen == len(output) {
+			_, err := writer.Write(output[:])
+			if err != nil {
+				return errors.New("[ERROR] Failed to write decoded data")
+			}
+			outputLen = 0
+		}
+	}
+	_, err := writer.Write(output[:outputLen])
+	if err != nil {
+		return errors.New("[ERROR] Failed to write decoded data")
+	}
+	if source.remaining > 0 || source.pos < len(source.chunk) || 8*((numBits+7)/8)-uint64(source.count) != numBits {
+		return errors.New("[ERROR] Compressed data continues past the last code")
+	}
+	// Whatever is left in the last byte has to be padding
+	if source.current&(1<<source.count-1) != 0 {
+		return errors.New("[ERROR] Expected padding bits to be zero")
+	}
+	return nil
+}
+
+// Adds one to the weight of symbol, first giving it a leaf of its own if it
+// is new
+func (tree *Tree) update(symbol byte) {
+	current := tree.leaves[symbol]
+	if current == none {
+		// The escape leaf becomes the parent of a new escape leaf and the
+		// symbol, which take the two numbers below it
+		parent := tree.escape
+		tree.nodes[parent-2] = node{parent: parent, left: none, right: none, symbol: none}
+		tree.nodes[parent-1] = node{parent: parent, left: none, right: none, symbol: int(symbol)}
+		tree.nodes[parent].left, tree.nodes[parent].right = parent-2, parent-1
+		tree.escape = parent - 2
+		tree.leaves[symbol] = parent - 1
+		current = parent - 1
+	}
+	for current != none {
+		// Move to the highest number with the same weight first, so the
+		// weight can go up without getting ahead of any higher number
+		leader := current
+		for leader < root && tree.nodes[leader+1].weight == tree.nodes[current].weight {
+			leader++
+		}
+		if leader != current && leader != tree.nodes[current].parent {
+			tree.swap(current, leader)
+			current = leader
+		}
+		tree.nodes[current].weight++
+		current = tree.nodes[current].parent
+	}
+}
+
+// Exchanges the subtrees at two node numbers, each staying under the parent
+// of the number it moves to
+func (tree *Tree) swap(a int, b int) {
+	nodeA, nodeB := tree.nodes[a], tree.nodes[b]
+	nodeA.parent, nodeB.parent = nodeB.parent, nodeA.parent
+	tree.nodes[a], tree.nodes[b] = nodeB, nodeA
+	tree.relink(a)
+	tree.relink(b)
+}
+
+// Points whatever refers to the node at number back at it after it moved
+func (tree *Tree) relink(number int) {
+	current := tree.nodes[number]
+	if current.left != none {
+		tree.nodes[current.left].parent = number
+		tree.nodes[current.right].parent = number
+	} else if current.symbol == none {
+		tree.escape = number
+	} else {
+		tree.leaves[current.symbol] = number
+	}
+}
+
+// Reads a fixed number of bytes from a reader in chunks and hands out their
+// bits most significant first
+type bitSource struct {
+	reader    io.Reader
+	remaining uint64 // bytes not read from reader yet
+	chunk     []byte
+	pos       int
+	current   byte
+	count     uint // bits of current not handed out yet
+}
+
+func (source *bitSource) readBits(bits uint) (uint64, error) {
+	value := uint64(0)
+	for ; bits > 0; bits-- {
+		if source.count == 0 {
+			if source.pos == len(source.chunk) {
+				if source.remaining == 0 {
+					return 0, errors.New("[ERROR] Last code runs past the end of the compressed data")
+				}
+				size := uint64(cap(source.chunk))
+				if size > source.remaining {
+					size = source.remaining
+				}
+				source.chunk = source.chunk[:size]
+				_, err := io.ReadFull(source.reader, source.chunk)
+				if err != nil {
+					fmt.Println(err)
+					return 0, errors.New("[ERROR] Couldn't read compressed data")
+				}
+				source.remaining -= size
+				source.pos = 0
+			}
+			source.current = source.chunk[source.pos]
+			source.pos++
+			source.count = 8
+		}
+		source.count--
+		value = value<<1 | uint64(source.current>>source.count&1)
+	}
+	return value, nil
+}
@@ -0,0 +1,103 @@
+package adaptive_huffman
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// Encodes data with a fresh tree, packing the codes into bytes
+func encode(t *testing.T, data []byte) ([]byte, uint64) {
+	tree := CreateTree()
+	var packed bytes.Buffer
+	buffer, count := uint64(0), uint(0)
+	write := func(code uint64, length uint) error {
+		for i := int(length) - 1; i >= 0; i-- {
+			buffer = buffer<<1 | (code>>uint(i))&1
+			count++
+			if count == 8 {
+				packed.WriteByte(byte(buffer))
+				buffer, count = 0, 0
+			}
+		}
+		return nil
+	}
+	total := uint64(0)
+	for _, symbol := range data {
+		bits, err := tree.Encode(symbol, write)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += bits
+	}
+	if count > 0 {
+		packed.WriteByte(byte(buffer << (8 - count)))
+	}
+	return packed.Bytes(), total
+}
+
+func TestRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	noise := make([]byte, 20000)
+	random.Read(noise)
+	skewed := make([]byte, 50000)
+	for i := range skewed {
+		// Mostly zeros, with every other byte value now and then
+		if random.Intn(10) == 0 {
+			skewed[i] = byte(random.Intn(256))
+		}
+	}
+	cases := map[string][]byte{
+		"empty":   {},
+		"single":  []byte("a"),
+		"repeats": bytes.Repeat([]byte{'x'}, 10000),
+		"text":    []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 500)),
+		"noise":   noise,
+		"skewed":  skewed,
+	}
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			packed, bits := encode(t, data)
+			if uint64(len(packed)) != (bits+7)/8 {
+				t.Fatalf("packed %d bytes for %d bits", len(packed), bits)
+			}
+			// Anything after the compressed data must be left unread
+			source := bytes.NewReader(append(packed, 0xff))
+			var decoded bytes.Buffer
+			err := CreateTree().Decode(source, bits, uint64(len(data)), &decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded.Bytes(), data) {
+				t.Fatal("data didn't round trip")
+			}
+			if source.Len() != 1 {
+				t.Errorf("decoder left %d bytes instead of 1", source.Len())
+			}
+		})
+	}
+}
+
+func TestAdaptsToData(t *testing.T) {
+	data := []byte(strings.Repeat("aaaaaaab", 10000))
+	_, bits := encode(t, data)
+	// Once the tree has settled, 'a' takes one bit and 'b' two, as they would
+	// with a static Huffman code
+	if bits > uint64(len(data))*9/8+100 {
+		t.Errorf("took %d bits for %d bytes", bits, len(data))
+	}
+}
+
+func TestRejectsTruncatedData(t *testing.T) {
+	data := []byte(strings.Repeat("hello adaptive world ", 100))
+	packed, bits := encode(t, data)
+	err := CreateTree().Decode(bytes.NewReader(packed), bits-16, uint64(len(data)), &bytes.Buffer{})
+	if err == nil {
+		t.Error("decoding past the end of the data should fail")
+	}
+	err = CreateTree().Decode(bytes.NewReader(packed), bits, uint64(len(data))-10, &bytes.Buffer{})
+	if err == nil {
+		t.Error("data left over after the last symbol should fail")
+	}
+}
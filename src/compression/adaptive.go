@@ -0,0 +1,36 @@
+package compression
+
+import "fmt"
+
+/*
+	With FlagAdaptive the archive has no key table and every compressed buffer
+	is coded with a model that starts out empty for each entry and is updated
+	after every byte, by whichever coder the archive header names (see
+	coder.go):
+	----------------------------------------------
+	|--- archive header (see header.go) ---|
+
+	|--- number of inputs (8 bytes) ---|
+	for each input {
+		|--- record header (see entry.go), always with the archive's table ---|
+		|--- coded data in frames, followed by its size (see frames.go) ---|
+	}
+	----------------------------------------------
+	Everything after the records is the same as without the flag.
+*/
+
+// Whether inputs are coded in a single pass, with no table stored
+func (compressor *Compressor) adaptive() bool {
+	return compressor.Adaptive || compressor.Coder == CoderRange
+}
+
+// Coder for the entries of an archive with FlagAdaptive
+func adaptiveCoder(coder Coder) (entryCoder, error) {
+	switch coder {
+	case CoderHuffman:
+		return adaptiveHuffmanCoder{}, nil
+	case CoderRange:
+		return rangeCoder{}, nil
+	}
+	return nil, fmt.Errorf("[ERROR] Entropy coder %d can't code adaptively", coder)
+}
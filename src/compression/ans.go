@@ -0,0 +1,226 @@
+package compression
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hzip/src/frequency_table"
+	"hzip/src/key_table"
+	"hzip/src/tans"
+	"io"
+	"math/bits"
+
+	"github.com/dgryski/go-bitstream"
+)
+
+/*
+	With CoderANS the archive header is followed by the normalized byte counts
+	of every input together (see tans/table.go), padded to a byte, in place of
+	the key table. Each frame of an entry (see frames.go) is then coded as:
+	----------------------------------------------
+	|--- table (1 byte): 0 for the archive's, 1 for new counts, 2 for the same
+	     table as the frame before ---|
+	|--- normalized counts, padded to a byte (only for 1) ---|
+	|--- tANS blocks (see tans/coder.go) ---|
+	|--- 0 until edge of byte boundary ---|
+	----------------------------------------------
+	The length of the frame covers all of it. Before version 11 frames, and
+	whole entries before frames, only hold the blocks, coded with the
+	archive's table.
+*/
+
+type frameTable uint8
+
+const (
+	frameArchiveTable frameTable = iota
+	frameNewTable
+	framePreviousTable
+)
+
+// Normalizes the byte counts of every input into the table all of them are
+// coded with
+func (compressor *Compressor) buildANSTable(freqTable frequency_table.FrequencyTable) error {
+	table, err := normalizedTable(freqTable, tans.DefaultTableLog)
+	if err != nil {
+		fmt.Fprintln(compressor.Messages, err)
+		return errors.New("[ERROR] Failed to build tANS table")
+	}
+	compressor.ansTable = table
+	return nil
+}
+
+// Table with 2^tableLog states shared out by the counts in freqTable
+func normalizedTable(freqTable frequency_table.FrequencyTable, tableLog uint) (*tans.Table, error) {
+	var counts [256]uint32
+	for symbol, count := range freqTable.Normalize(1 << tableLog) {
+		counts[symbol] = uint32(count)
+	}
+	return tans.CreateTable(counts, tableLog)
+}
+
+type ansCoder struct {
+	table *tans.Table
+	// Whether frames being decoded start with the table they're coded with
+	frameTables bool
+}
+
+type ansEncoder struct {
+	archive  *tans.Table
+	previous *tans.Table
+	enc      *encoder
+	coder    *tans.Encoder
+	written  uint64 // bits of tANS blocks in the frames before
+}
+
+func (coder ansCoder) newEncoder(write func([]byte) error) entryEncoder {
+	enc := createEncoder(key_table.CreateKeyTable(), write)
+	return &ansEncoder{
+		archive: coder.table,
+		enc:     enc,
+		coder:   tans.CreateEncoder(coder.table, enc.writeBits),
+	}
+}
+
+func (coder ansCoder) newDecoder() entryDecoder {
+	return &ansDecoder{archive: coder.table, frameTables: coder.frameTables}
+}
+
+func (ans *ansEncoder) encode(data []byte) (uint64, error) {
+	var histogram [256]uint64
+	for _, currentByte := range data {
+		histogram[currentByte]++
+	}
+	kind, table, err := ans.chooseTable(&histogram)
+	if err != nil {
+		return 0, err
+	}
+	var frameHeader bytes.Buffer
+	headerWriter := bitstream.NewWriter(&frameHeader)
+	err = headerWriter.WriteByte(byte(kind))
+	if err != nil {
+		return 0, errors.New("[ERROR] Failed to write frame table kind")
+	}
+	if kind == frameNewTable {
+		err = table.Write(headerWriter)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = headerWriter.Flush(bitstream.Zero)
+	if err != nil {
+		return 0, errors.New("[ERROR] Failed to flush bitstream")
+	}
+	for _, headerByte := range frameHeader.Bytes() {
+		err := ans.enc.writeBits(uint64(headerByte), 8)
+		if err != nil {
+			return 0, err
+		}
+	}
+	ans.coder.UseTable(table)
+	ans.previous = table
+	err = ans.coder.Write(data)
+	if err != nil {
+		return 0, err
+	}
+	written, err := ans.coder.Finish()
+	if err != nil {
+		return 0, err
+	}
+	frameBits := 8*uint64(frameHeader.Len()) + written - ans.written
+	ans.written = written
+	return frameBits, ans.enc.finish()
+}
+
+// Picks whichever of the archive's table, the previous frame's and a new one
+// makes the frame smallest, counting what a new table takes to store
+func (ans *ansEncoder) chooseTable(histogram *[256]uint64) (frameTable, *tans.Table, error) {
+	kind, table, best, err := frameOwnTable(histogram)
+	if err != nil {
+		return kind, nil, err
+	}
+	if ans.previous != nil {
+		bits, ok := ans.previous.Cost(histogram)
+		if ok && bits <= best {
+			kind, table, best = framePreviousTable, ans.previous, bits
+		}
+	}
+	bits, ok := ans.archive.Cost(histogram)
+	if ok && bits <= best {
+		kind, table = frameArchiveTable, ans.archive
+	}
+	return kind, table, nil
+}
+
+// Table of the frame's own counts and the bits it and the frame take. As in
+// Zstandard, smaller frames get fewer states, which take less to store.
+func frameOwnTable(histogram *[256]uint64) (frameTable, *tans.Table, uint64, error) {
+	freqTable := frequency_table.CreateFrequencyTable()
+	total := uint64(0)
+	for symbol, count := range histogram {
+		if count > 0 {
+			freqTable.Add(byte(symbol), int(count))
+			total += count
+		}
+	}
+	tableLog := uint(tans.MinTableLog)
+	if length := uint(bits.Len64(total - 1)); length > tableLog+2 {
+		tableLog = length - 2
+	}
+	if tableLog > tans.DefaultTableLog {
+		tableLog = tans.DefaultTableLog
+	}
+	table, err := normalizedTable(freqTable, tableLog)
+	if err != nil {
+		return frameNewTable, nil, 0, err
+	}
+	frameBits, _ := table.Cost(histogram)
+	return frameNewTable, table, frameBits + (table.Bits()+7)/8*8, nil
+}
+
+type ansDecoder struct {
+	archive     *tans.Table
+	previous    *tans.Table
+	frameTables bool
+}
+
+func (ans *ansDecoder) decode(source io.Reader, numBits uint64, size uint64, writer io.Writer) error {
+	table := ans.archive
+	if ans.frameTables {
+		var kind [1]byte
+		_, err := io.ReadFull(source, kind[:])
+		if err != nil {
+			return errors.New("[ERROR] Couldn't read frame table kind")
+		}
+		used := uint64(8)
+		switch frameTable(kind[0]) {
+		case frameArchiveTable:
+		case frameNewTable:
+			reader := bitstream.NewReader(source)
+			var bitsRead int
+			table, bitsRead, err = tans.ReadTable(reader)
+			if err != nil {
+				return fmt.Errorf("[ERROR] Couldn't read frame table: %v", err)
+			}
+			if bitsRead%8 != 0 {
+				_, err := reader.ReadBits(8 - (bitsRead % 8))
+				if err != nil {
+					return errors.New("[ERROR] Failed to flush bits by reading")
+				}
+			}
+			used += uint64(bitsRead+7) / 8 * 8
+		case framePreviousTable:
+			table = ans.previous
+		default:
+			return fmt.Errorf("[ERROR] Unknown frame table kind %d", kind[0])
+		}
+		if used > numBits {
+			return errors.New("[ERROR] Frame table overruns the frame")
+		}
+		numBits -= used
+		ans.previous = table
+	}
+	if table == nil {
+		return errors.New("[ERROR] Frame refers to a tANS table that doesn't exist")
+	}
+	return tans.CreateDecoder(table, source, numBits).Decode(size, writer)
+}
@@ -0,0 +1,268 @@
+package compression
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hzip/src/decode_table"
+	"hzip/src/key_table"
+	"io"
+
+	"github.com/dgryski/go-bitstream"
+)
+
+/*
+	Entries larger than the block size can have their compressed buffer split
+	into blocks, each coded with whichever table suits that part of the data:
+	----------------------------------------------
+	for each block {
+		|--- table (1 byte): 0 for the archive's, 1 for new code lengths,
+		     2 for the same table as the block before ---|
+		|--- code lengths, padded to a byte (only for 1) ---|
+		|--- length of block data in bits (4 bytes) ---|
+		|--- block data ---|
+		|--- 0 until edge of byte boundary ---|
+	}
+	----------------------------------------------
+	Blocks are read until the compressed buffer is used up.
+*/
+
+// Default size of the blocks entries are split into
+const DefaultBlockSize = 256 * 1024
+
+// Largest block size, so that the data of a block fits in 32 bits
+const MaxBlockSize = 16 * 1024 * 1024
+
+type blockTable uint8
+
+const (
+	blockArchiveTable blockTable = iota
+	blockNewTable
+	blockPreviousTable
+)
+
+// Bytes every block takes up besides its data and code lengths
+const blockHeaderSize = 5
+
+type block struct {
+	Size      uint64 // uncompressed
+	Bits      uint64 // of the block data alone
+	Table     blockTable
+	histogram *[256]uint64           // dropped once the block is planned
+	table     []byte                 // stored code lengths, only for blockNewTable
+	lengths   *key_table.CodeLengths // only for blockNewTable
+}
+
+// Counts the bytes of data into the blocks they fall in, starting a new
+// block whenever the last one is full
+func (stats *inputStats) addToBlocks(data []byte, blockSize uint64) {
+	for len(data) > 0 {
+		if len(stats.blocks) == 0 || stats.blocks[len(stats.blocks)-1].Size == blockSize {
+			stats.blocks = append(stats.blocks, block{histogram: new([256]uint64)})
+		}
+		current := &stats.blocks[len(stats.blocks)-1]
+		n := blockSize - current.Size
+		if n > uint64(len(data)) {
+			n = uint64(len(data))
+		}
+		for _, currentByte := range data[:n] {
+			current.histogram[currentByte]++
+		}
+		current.Size += n
+		data = data[n:]
+	}
+}
+
+// Picks a table for every block of an entry in turn, whichever of the
+// archive's, the previous block's or a new one makes the block smallest
+func (compressor *Compressor) planBlocks(stats *inputStats, shared key_table.CodeLengths) error {
+	var previous *key_table.CodeLengths
+	total := uint64(0)
+	ownTables := false
+	for i := range stats.blocks {
+		current := &stats.blocks[i]
+		table, lengths, err := compressor.entryTable(current.histogram)
+		if err != nil {
+			return err
+		}
+		current.Table = blockNewTable
+		current.Bits = histogramBits(current.histogram, lengths)
+		best := uint64(len(table)) + (current.Bits+7)/8
+		if previous != nil && covers(current.histogram, *previous) {
+			bits := histogramBits(current.histogram, *previous)
+			if (bits+7)/8 <= best {
+				current.Table, current.Bits, best = blockPreviousTable, bits, (bits+7)/8
+			}
+		}
+		if compressor.TableMode != TablesPerEntry && covers(current.histogram, shared) {
+			bits := histogramBits(current.histogram, shared)
+			if (bits+7)/8 <= best {
+				current.Table, current.Bits, best = blockArchiveTable, bits, (bits+7)/8
+			}
+		}
+		switch current.Table {
+		case blockNewTable:
+			current.table, current.lengths = table, &lengths
+			previous = &lengths
+			ownTables = true
+		case blockArchiveTable:
+			previous = &shared
+		}
+		current.histogram = nil
+		total += blockHeaderSize + best
+	}
+	if !ownTables {
+		// Splitting only costs block headers when every block uses the archive's table
+		stats.blocks = nil
+		stats.setCodeLengths(shared)
+		return nil
+	}
+	stats.CompressedBits = 8 * total
+	stats.histogram = nil
+	return nil
+}
+
+// Whether every byte in the histogram has a code
+func covers(histogram *[256]uint64, lengths key_table.CodeLengths) bool {
+	for symbol, count := range histogram {
+		if count > 0 && lengths[symbol] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Encodes an input block by block as planned, returning what was read so it
+// can be checked against the frequency pass
+func (compressor *Compressor) writeBlocks(enc *encoder, reader io.Reader, stats inputStats) (inputStats, error) {
+	written := inputStats{}
+	checksum := crc32.New(crcTable)
+	source := io.TeeReader(reader, checksum)
+	var previous key_table.KeyTable
+	for _, current := range stats.blocks {
+		var blockHeader bytes.Buffer
+		blockHeader.WriteByte(byte(current.Table))
+		switch current.Table {
+		case blockArchiveTable:
+			previous = compressor.keyTable
+		case blockNewTable:
+			blockHeader.Write(current.table)
+			table, err := key_table.CreateKeyTableFromLengths(*current.lengths)
+			if err != nil {
+				fmt.Fprintln(compressor.Messages, err)
+				return written, errors.New("[ERROR] Failed to build code table for a block")
+			}
+			previous = table
+		}
+		var bits [4]byte
+		binary.BigEndian.PutUint32(bits[:], uint32(current.Bits))
+		blockHeader.Write(bits[:])
+		err := enc.write(blockHeader.Bytes())
+		if err != nil {
+			fmt.Fprintln(compressor.Messages, err)
+			return written, errors.New("[ERROR] Failed to write block header to output")
+		}
+		enc.useTable(previous)
+		encoded, err := enc.encode(io.LimitReader(source, int64(current.Size)))
+		if err != nil {
+			return written, err
+		}
+		if encoded.Size != current.Size || encoded.CompressedBits != current.Bits {
+			return written, errors.New("[ERROR] Input changed while it was being compressed")
+		}
+		// Every block ends on a byte boundary
+		err = enc.finish()
+		if err != nil {
+			fmt.Fprintln(compressor.Messages, err)
+			return written, errors.New("[ERROR] Failed to write compressed buffer to output")
+		}
+		written.Size += encoded.Size
+		written.CompressedBits += 8 * (uint64(blockHeader.Len()) + (encoded.CompressedBits+7)/8)
+	}
+	enc.useTable(compressor.keyTable)
+	// Anything past the planned blocks means the input grew
+	n, err := source.Read(make([]byte, 1))
+	if n > 0 || (err != nil && err != io.EOF) {
+		return written, errors.New("[ERROR] Input changed while it was being compressed")
+	}
+	written.Checksum = checksum.Sum32()
+	return written, nil
+}
+
+// Reads code lengths stored at the start of a compressed buffer or block,
+// along with the bits they take up, padding included. The table is nil if
+// no symbol has a code.
+func readCodeTable(source io.Reader) (*decode_table.DecodeTable, uint64, error) {
+	reader := bitstream.NewReader(source)
+	lengths, bitsRead, err := key_table.ReadCodeLengths(reader)
+	if err != nil {
+		return nil, 0, fmt.Errorf("[ERROR] Couldn't read code table: %v", err)
+	}
+	if bitsRead%8 != 0 {
+		_, err := reader.ReadBits(8 - (bitsRead % 8))
+		if err != nil {
+			return nil, 0, errors.New("[ERROR] Failed to flush bits by reading")
+		}
+	}
+	tableBits := uint64(bitsRead+7) / 8 * 8
+	if lengths == (key_table.CodeLengths{}) {
+		return nil, tableBits, nil
+	}
+	table, err := decode_table.CreateDecodeTable(lengths)
+	if err != nil {
+		return nil, 0, fmt.Errorf("[ERROR] Invalid code table: %v", err)
+	}
+	return table, tableBits, nil
+}
+
+// Decodes the blocks making up an entry's compressed buffer into writer
+func (decompressor Decompressor) decodeBlocks(source io.Reader, entry ArchiveEntry, writer io.Writer) error {
+	var previous *decode_table.DecodeTable
+	remaining := entry.CompressedSize()
+	for remaining > 0 {
+		var kind [1]byte
+		_, err := io.ReadFull(source, kind[:])
+		if err != nil {
+			return errors.New("[ERROR] Couldn't read block header")
+		}
+		used := uint64(blockHeaderSize)
+		var table *decode_table.DecodeTable
+		switch blockTable(kind[0]) {
+		case blockArchiveTable:
+			table = decompressor.decodeTable
+		case blockNewTable:
+			var tableBits uint64
+			table, tableBits, err = readCodeTable(source)
+			if err != nil {
+				return err
+			}
+			used += tableBits / 8
+		case blockPreviousTable:
+			table = previous
+		default:
+			return fmt.Errorf("[ERROR] Unknown block table kind %d", kind[0])
+		}
+		if table == nil {
+			return errors.New("[ERROR] Block refers to a code table that doesn't exist")
+		}
+		var bits [4]byte
+		_, err = io.ReadFull(source, bits[:])
+		if err != nil {
+			return errors.New("[ERROR] Couldn't read block length")
+		}
+		dataBits := uint64(binary.BigEndian.Uint32(bits[:]))
+		used += (dataBits + 7) / 8
+		if used > remaining {
+			return errors.New("[ERROR] Block overruns the compressed buffer")
+		}
+		remaining -= used
+		err = table.Decode(source, dataBits, writer)
+		if err != nil {
+			return err
+		}
+		previous = table
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package compression
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/dgryski/go-bitstream"
+)
+
+/*
+	When FlagChecksums is set, the last record is followed by a trailer:
+	----------------------------------------------
+	|--- CRC32C of every preceding byte of the archive (4 bytes) ---|
+	----------------------------------------------
+*/
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Bytes taken up by the trailer
+const trailerSize = 4
+
+func Checksum(data []byte) uint32 {
+	return crc32.Checksum(data, crcTable)
+}
+
+func verifyEntryChecksum(entry ArchiveEntry, data []byte) error {
+	return verifyDecoded(entry, uint64(len(data)), Checksum(data))
+}
+
+// Same as verifyEntryChecksum, for data that was written out as it was decoded
+func verifyDecoded(entry ArchiveEntry, size uint64, checksum uint32) error {
+	if size != entry.Size {
+		return fmt.Errorf("[ERROR] %s decoded to %d bytes, expected %d", entry.Filename, size, entry.Size)
+	}
+	if checksum != entry.Checksum {
+		return fmt.Errorf("[ERROR] Checksum mismatch for %s: got %08x, expected %08x", entry.Filename, checksum, entry.Checksum)
+	}
+	return nil
+}
+
+func writeTrailer(writer *bitstream.BitWriter, archiveChecksum uint32) error {
+	err := writer.WriteBits(uint64(archiveChecksum), 32)
+	if err != nil {
+		return errors.New("[ERROR] Failed to write archive checksum")
+	}
+	return nil
+}
+
+func verifyTrailer(reader *bitstream.BitReader, archiveChecksum uint32) error {
+	stored, err := reader.ReadBits(32)
+	if err != nil {
+		return errors.New("[ERROR] Couldn't read archive checksum")
+	}
+	if uint32(stored) != archiveChecksum {
+		return fmt.Errorf("[ERROR] Archive checksum mismatch: got %08x, expected %08x", archiveChecksum, stored)
+	}
+	return nil
+}
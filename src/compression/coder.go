@@ -0,0 +1,196 @@
+package compression
+
+import (
+	"errors"
+	"hzip/src/adaptive_huffman"
+	"hzip/src/key_table"
+	"hzip/src/range_coder"
+	"io"
+)
+
+// Entropy coder the entries of an archive are coded with, recorded in its
+// header
+type Coder uint8
+
+const (
+	// Huffman codes, from the archive's key table, tables of an entry's own
+	// or, with FlagAdaptive, a tree that adapts to the entry
+	CoderHuffman Coder = iota
+	// Range coding with a model that adapts to the entry, so always with
+	// FlagAdaptive. It isn't held to a whole number of bits per byte, which
+	// pays off on very skewed data.
+	CoderRange
+	// Table-based asymmetric numeral systems with normalized counts stored
+	// after the archive header, coming close to range coding at about the
+	// speed of Huffman decoding. Never adaptive.
+	CoderANS
+)
+
+// Codes entries on its own, starting over for each so they can be decoded
+// independently. Every coder but static Huffman is one of these. Entries are
+// coded in frames (see frames.go), with the model carried over from one
+// frame to the next.
+type entryCoder interface {
+	// Starts coding an entry, handing the output to write
+	newEncoder(write func([]byte) error) entryEncoder
+	// Starts decoding an entry
+	newDecoder() entryDecoder
+}
+
+type entryEncoder interface {
+	// Codes the next frame of the entry and pads it to a byte, returning the
+	// bits it took, padding not included
+	encode(data []byte) (uint64, error)
+}
+
+type entryDecoder interface {
+	// Decodes size bytes from the numBits bits of the next frame, consuming
+	// exactly the bytes that hold them. Archives from before frames store
+	// each entry as a single one.
+	decode(source io.Reader, numBits uint64, size uint64, writer io.Writer) error
+}
+
+// Coder the compressor codes every entry with in one go, or nil if entries
+// take the Huffman path that supports tables of their own, blocks and LZ77
+func (compressor *Compressor) entryCoder() (entryCoder, error) {
+	if compressor.adaptive() {
+		return adaptiveCoder(compressor.Coder)
+	}
+	if compressor.Coder == CoderANS {
+		return ansCoder{table: compressor.ansTable}, nil
+	}
+	return nil, nil
+}
+
+// Same as Compressor.entryCoder, for the archive being read
+func (decompressor Decompressor) entryCoder() (entryCoder, error) {
+	if decompressor.header.HasFlag(FlagAdaptive) {
+		return adaptiveCoder(decompressor.header.Coder)
+	}
+	if decompressor.header.Coder == CoderANS {
+		return ansCoder{
+			table:       decompressor.ansTable,
+			frameTables: decompressor.header.Version >= versionFrameTables,
+		}, nil
+	}
+	return nil, nil
+}
+
+// An input coded into memory by a worker, along with what the directory
+// needs to know about it
+type codedEntry struct {
+	stats inputStats
+	data  []byte
+}
+
+// Decodes an entry's compressed buffer with the coder the archive uses,
+// returning the entry with what follows the data of framed records filled in
+func (decompressor Decompressor) decodeWithCoder(coder entryCoder, source io.Reader, entry ArchiveEntry, writer io.Writer) (ArchiveEntry, error) {
+	if entry.Table != ArchiveTable {
+		return entry, errors.New("[ERROR] Entries can only have code tables of their own with Huffman coding")
+	}
+	if decompressor.header.framed() {
+		return decompressor.decodeFrames(coder, source, entry, writer)
+	}
+	return entry, coder.newDecoder().decode(source, entry.CompressedBits, entry.Size, writer)
+}
+
+type adaptiveHuffmanCoder struct{}
+
+type adaptiveHuffmanEncoder struct {
+	tree *adaptive_huffman.Tree
+	enc  *encoder
+}
+
+func (adaptiveHuffmanCoder) newEncoder(write func([]byte) error) entryEncoder {
+	return &adaptiveHuffmanEncoder{
+		tree: adaptive_huffman.CreateTree(),
+		enc:  createEncoder(key_table.CreateKeyTable(), write),
+	}
+}
+
+func (adaptiveHuffmanCoder) newDecoder() entryDecoder {
+	return adaptiveHuffmanDecoder{tree: adaptive_huffman.CreateTree()}
+}
+
+func (huffman *adaptiveHuffmanEncoder) encode(data []byte) (uint64, error) {
+	frameBits := uint64(0)
+	for _, currentByte := range data {
+		bits, err := huffman.tree.Encode(currentByte, huffman.enc.writeBits)
+		if err != nil {
+			return frameBits, err
+		}
+		frameBits += bits
+	}
+	return frameBits, huffman.enc.finish()
+}
+
+type adaptiveHuffmanDecoder struct {
+	tree *adaptive_huffman.Tree
+}
+
+func (huffman adaptiveHuffmanDecoder) decode(source io.Reader, numBits uint64, size uint64, writer io.Writer) error {
+	return huffman.tree.Decode(source, numBits, size, writer)
+}
+
+type rangeCoder struct{}
+
+// Every frame is range coded from scratch, only the model carries over
+type rangeEncoder struct {
+	model *range_coder.Model
+	write func([]byte) error
+}
+
+func (rangeCoder) newEncoder(write func([]byte) error) entryEncoder {
+	return &rangeEncoder{
+		model: range_coder.CreateModel(),
+		write: write,
+	}
+}
+
+func (rangeCoder) newDecoder() entryDecoder {
+	return rangeDecoder{model: range_coder.CreateModel()}
+}
+
+func (rangeEncoder *rangeEncoder) encode(data []byte) (uint64, error) {
+	enc := range_coder.CreateEncoder(rangeEncoder.write)
+	for _, currentByte := range data {
+		err := enc.Encode(rangeEncoder.model, currentByte)
+		if err != nil {
+			return 0, err
+		}
+	}
+	written, err := enc.Finish()
+	return 8 * written, err
+}
+
+type rangeDecoder struct {
+	model *range_coder.Model
+}
+
+func (rangeDecoder rangeDecoder) decode(source io.Reader, numBits uint64, size uint64, writer io.Writer) error {
+	if numBits%8 != 0 {
+		return errors.New("[ERROR] Range coded data has to be whole bytes")
+	}
+	dec := range_coder.CreateDecoder(source, numBits/8)
+	output := make([]byte, 0, chunkSize)
+	for i := uint64(0); i < size; i++ {
+		symbol, err := dec.Decode(rangeDecoder.model)
+		if err != nil {
+			return err
+		}
+		output = append(output, symbol)
+		if len(output) == cap(output) {
+			_, err := writer.Write(output)
+			if err != nil {
+				return errors.New("[ERROR] Failed to write decoded data")
+			}
+			output = output[:0]
+		}
+	}
+	_, err := writer.Write(output)
+	if err != nil {
+		return errors.New("[ERROR] Failed to write decoded data")
+	}
+	return dec.Finish()
+}
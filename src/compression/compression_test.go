@@ -0,0 +1,1728 @@
+package compression
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hzip/src/input"
+	"hzip/src/output"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgryski/go-bitstream"
+)
+
+// Runs the test from inside a fresh temporary directory, since archives store
+// paths relative to the working directory
+func enterTempDir(t *testing.T) {
+	dir := t.TempDir()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(cwd)
+	})
+}
+
+func writeTestFiles(t *testing.T, files map[string]string) {
+	for name, content := range files {
+		err := os.MkdirAll(filepath.Dir(name), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(name, []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func compressTestFiles(t *testing.T, archive string, inputs ...string) {
+	compressor := CreateCompressor()
+	compressor.SetOutput(&output.FileOutput{
+		Filename: archive,
+		Mode:     0666,
+	})
+	for _, inputName := range inputs {
+		objs, err := input.ExpandInput(inputName, ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, inputObj := range objs {
+			compressor.AddInput(inputObj)
+		}
+	}
+	err := compressor.GenerateScheme()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compressor.CompressToOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+var testFiles = map[string]string{
+	"src/a.txt":        "hello world, hello hzip",
+	"src/b.txt":        strings.Repeat("abcabcabd", 50),
+	"src/nested/c.txt": "the quick brown fox jumps over the lazy dog",
+}
+
+func roundTrip(t *testing.T, files map[string]string) {
+	enterTempDir(t)
+	writeTestFiles(t, files)
+	compressTestFiles(t, "test.hz", "src")
+	err := os.RemoveAll("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decompressor := CreateDecompressor("test.hz")
+	err = decompressor.ReadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = decompressor.Decompress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, []byte(content)) {
+			t.Errorf("%s: got %q, want %q", name, data, content)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	roundTrip(t, testFiles)
+}
+
+func TestRoundTripSingleSymbol(t *testing.T) {
+	roundTrip(t, map[string]string{
+		"src/a.txt":     "aaaaaaaaaa",
+		"src/empty.txt": "",
+	})
+}
+
+func TestRoundTripEmptyInputs(t *testing.T) {
+	roundTrip(t, map[string]string{
+		"src/empty.txt":        "",
+		"src/nested/empty.txt": "",
+	})
+}
+
+func TestRejectsForeignFile(t *testing.T) {
+	enterTempDir(t)
+	writeTestFiles(t, map[string]string{"not_an_archive.hz": "PK\x03\x04 definitely a zip"})
+	decompressor := CreateDecompressor("not_an_archive.hz")
+	err := decompressor.ReadMeta()
+	if err == nil {
+		t.Error("foreign file should be rejected")
+	}
+}
+
+func TestRejectsUnknownVersion(t *testing.T) {
+	enterTempDir(t)
+	writeTestFiles(t, testFiles)
+	compressTestFiles(t, "test.hz", "src")
+	data, err := os.ReadFile("test.hz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Version follows the 4 magic bytes
+	data[4], data[5] = 0xff, 0xff
+	err = os.WriteFile("test.hz", data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressor := CreateDecompressor("test.hz")
+	err = decompressor.ReadMeta()
+	if err == nil {
+		t.Error("unknown format version should be rejected")
+	}
+}
+
+// Archives in testdata written by earlier versions of hzip, each holding
+// legacyFiles. Modes and times were only stored from version 4.
+var legacyArchives = []string{
+	"v1.hz", "v2.hz", "v3.hz", "v4.hz", "v5.hz", "v6.hz", "v7.hz",
+	"v8.hz", "v8-lz.hz", "v8-adaptive.hz", "v9.hz", "v9-range.hz", "v9-ans.hz", "v10-ans.hz", "v11-ans.hz",
+}
+
+var legacyFiles = map[string]string{
+	"hello.txt":       "hello, world\nhello, world\nhello again\n",
+	"nested/data.txt": "The quick brown fox jumps over the lazy dog.\n0123456789 ~!@#$%^&*()\n",
+}
+
+func TestReadsOlderVersions(t *testing.T) {
+	for _, name := range legacyArchives {
+		archive, err := filepath.Abs(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(name, func(t *testing.T) {
+			enterTempDir(t)
+			decompressor := CreateDecompressor(archive)
+			decompressor.Messages = ioutil.Discard
+			err := decompressor.ReadMeta()
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := decompressor.ReadDirectory()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(legacyFiles) {
+				t.Fatalf("got %d entries, want %d", len(entries), len(legacyFiles))
+			}
+			for _, entry := range entries {
+				// Found through the central directory, or by scanning the
+				// records of archives without one
+				data, err := decompressor.ReadEntry(entry)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != legacyFiles[entry.Filename] {
+					t.Errorf("%s: got %q, want %q", entry.Filename, data, legacyFiles[entry.Filename])
+				}
+			}
+			decompressor.Close()
+
+			err = os.Mkdir("out", 0o755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decompressor = CreateDecompressor(archive)
+			decompressor.Messages = ioutil.Discard
+			decompressor.DestDir = "out"
+			decompressor.SameOwner = false
+			err = decompressor.ReadMeta()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer decompressor.Close()
+			err = decompressor.Decompress()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range legacyFiles {
+				data, err := os.ReadFile(filepath.Join("out", name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != content {
+					t.Errorf("%s: got %q, want %q", name, data, content)
+				}
+			}
+		})
+	}
+}
+
+func TestRejectsHugeFilenameLength(t *testing.T) {
+	var record bytes.Buffer
+	record.Write(bytes.Repeat([]byte{0xff}, 8))
+	record.WriteString("name")
+	_, err := ReadEntryHeader(bitstream.NewReader(&record), CreateArchiveHeader())
+	if err == nil {
+		t.Error("a filename length over the limit should be rejected")
+	}
+}
+
+func TestList(t *testing.T) {
+	enterTempDir(t)
+	writeTestFiles(t, testFiles)
+	compressTestFiles(t, "test.hz", "src")
+
+	decompressor := CreateDecompressor("test.hz")
+	err := decompressor.ReadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := decompressor.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// src and src/nested are stored as well
+	if len(entries) != len(testFiles)+2 {
+		t.Fatalf("got %d entries, want %d", len(entries), len(testFiles)+2)
+	}
+	for _, entry := range entries {
+		if entry.Mode.IsDir() {
+			continue
+		}
+		content, ok := testFiles[entry.Filename]
+		if !ok {
+			t.Errorf("unexpected entry %s", entry.Filename)
+			continue
+		}
+		if entry.Size != uint64(len(content)) {
+			t.Errorf("%s: got size %d, want %d", entry.Filename, entry.Size, len(content))
+		}
+		if entry.CompressedBits == 0 {
+			t.Errorf("%s: compressed length should be recorded", entry.Filename)
+		}
+	}
+}
+
+func TestListFromStream(t *testing.T) {
+	enterTempDir(t)
+	writeTestFiles(t, testFiles)
+	compressTestFiles(t, "test.hz", "src")
+	data, err := os.ReadFile("test.hz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing to seek in, so the records are read in order instead
+	decompressor := CreateDecompressor("")
+	err = decompressor.ReadMetaFrom(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := decompressor.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(testFiles)+2 {
+		t.Errorf("got %d entries, want %d", len(entries), len(testFiles)+2)
+	}
+}
+
+func TestDetectsCorruption(t *testing.T) {
+	enterTempDir(t)
+	writeTestFiles(t, testFiles)
+	compressTestFiles(t, "test.hz", "src")
+	data, err := os.ReadFile("test.hz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decompressor := CreateDecompressor("test.hz")
+	err = decompressor.ReadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = decompressor.Test()
+	if err != nil {
+		t.Fatalf("intact archive should pass: %v", err)
+	}
+
+	// Flip a bit in the last compressed buffer, just before the central directory
+	data[centralDirectoryOffset(t, data)-2] ^= 0x10
+	err = os.WriteFile("test.hz", data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressor = CreateDecompressor("test.hz")
+	err = decompressor.ReadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = decompressor.Test()
+	if err == nil {
+		t.Error("corrupted archive should fail integrity checks")
+	}
+}
+
+// Reads the offset of the central directory out of the footer
+func centralDirectoryOffset(t *testing.T, archive []byte) int {
+	footerStart := len(archive) - trailerSize - footerSize
+	if footerStart < 0 {
+		t.Fatal("archive too short")
+	}
+	return int(binary.BigEndian.Uint64(archive[footerStart:]))
+}
+
+func TestListReadsCentralDirectory(t *testing.T) {
+	enterTempDir(t)
+	writeTestFiles(t, testFiles)
+	compressTestFiles(t, "test.hz", "src")
+	data, err := os.ReadFile("test.hz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Damage the records so that only the central directory can be trusted
+	data[centralDirectoryOffset(t, data)-2] ^= 0x10
+	err = os.WriteFile("test.hz", data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decompressor := CreateDecompressor("test.hz")
+	err = decompressor.ReadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := decompressor.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(testFiles)+2 {
+		t.Fatalf("got %d entries, want %d", len(entries), len(testFiles)+2)
+	}
+	for _, entry := range entries {
+		// Each offset points at the record header, which starts with the name
+		nameStart := int(entry.Offset) + 8
+		if nameStart+len(entry.Filename) > len(data) || string(data[nameStart:nameStart+len(entry.Filename)]) != entry.Filename {
+			t.Errorf("%s: offset %d doesn't point at its record", entry.Filename, entry.Offset)
+		}
+	}
+}
+
+func TestRejectsHugeSize(t *testing.T) {
+	enterTempDir(t)
+	writeTestFiles(t, testFiles)
+	compressTestFiles(t, "test.hz", "src")
+	decompressor := CreateDecompressor("test.hz")
+	err := decompressor.ReadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := decompressor.ReadDirectory()
+	decompressor.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile("test.hz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Filename == "src/b.txt" {
+			// The size follows the name, mode, owner, group and both times
+			sizeStart := int(entry.Offset) + 8 + len(entry.Filename) + 28
+			binary.BigEndian.PutUint64(data[sizeStart:], 1<<62)
+		}
+	}
+
+	decompressor = CreateDecompressor("")
+	err = decompressor.ReadMetaFrom(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = decompressor.Test()
+	if err == nil {
+		t.Error("a record claiming an impossible size should fail")
+	}
+}
+
+func TestRestoresMetadata(t *testing.T) {
+	enterTempDir(t)
+	writeTestFiles(t, testFiles)
+	modTime := time.Date(2020, 2, 29, 12, 0, 0, 0, time.UTC)
+	modes := map[string]os.FileMode{
+		"src/a.txt":  0o600,
+		"src/b.txt":  0o751,
+		"src/nested": 0o750 | os.ModeDir,
+	}
+	for name, mode := range modes {
+		err := os.Chmod(name, mode.Perm())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(name, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	compressTestFiles(t, "test.hz", "src")
+	err := os.RemoveAll("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decompressor := CreateDecompressor("test.hz")
+	err = decompressor.ReadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = decompressor.Decompress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, mode := range modes {
+		stat, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Mode() != mode {
+			t.Errorf("%s: got mode %v, want %v", name, stat.Mode(), mode)
+		}
+		if !stat.ModTime().Equal(modTime) {
+			t.Errorf("%s: got modification time %v, want %v", name, stat.ModTime(), modTime)
+		}
+	}
+}
+
+// Input with a made up name, for archives tar would never produce
+func craftedInput(name string, data string) input.Input {
+	return input.MemoryInput{
+		Name: name,
+		Data: []byte(data),
+		Meta: input.FileMeta{Mode: 0o644, Owner_ID: -1, Group_ID: -1},
+	}
+}
+
+// Input stored under another name
+type renamedInput struct {
+	input.Input
+	name string
+}
+
+func (renamed renamedInput) GetName() string {
+	return renamed.name
+}
+
+// Compresses inputs into crafted.hz and extracts it. The compressor would
+// make names such as /x or ../x relative, so each input is compressed under
+// a placeholder of the same length that is then patched over with its real
+// name, as an archive from elsewhere could have it.
+func extractCraftedArchive(t *testing.T, inputs ...input.Input) error {
+	compressor := CreateCompressor()
+	compressor.SetOutput(&output.FileOutput{
+		Filename: "crafted.hz",
+		Mode:     0666,
+	})
+	placeholders := make(map[string]string)
+	for i, inputObj := range inputs {
+		placeholder := strings.Repeat(string(rune('a'+i)), len(inputObj.GetName()))
+		placeholders[placeholder] = inputObj.GetName()
+		compressor.AddInput(renamedInput{inputObj, placeholder})
+	}
+	err := compressor.GenerateScheme()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compressor.CompressToOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := os.ReadFile("crafted.hz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The name follows its length in both the record and the central directory
+	for placeholder, name := range placeholders {
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(len(name)))
+		archive = bytes.ReplaceAll(archive, append(length[:], placeholder...), append(length[:], name...))
+	}
+	footerStart := len(archive) - trailerSize - footerSize
+	directoryStart := centralDirectoryOffset(t, archive)
+	binary.BigEndian.PutUint32(archive[footerStart+24:], Checksum(archive[directoryStart:footerStart]))
+	binary.BigEndian.PutUint32(archive[len(archive)-trailerSize:], Checksum(archive[:len(archive)-trailerSize]))
+	err = os.WriteFile("crafted.hz", archive, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressor := CreateDecompressor("crafted.hz")
+	err = decompressor.ReadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decompressor.Decompress()
+}
+
+func TestRejectsUnsafePaths(t *testing.T) {
+	for _, name := range []string{"../evil.txt", "src/../../evil.txt", "/tmp/evil.txt", "src\\..\\..\\evil.txt"} {
+		t.Run(name, func(t *testing.T) {
+			enterTempDir(t)
+			err := os.Mkdir("work", 0o755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.Chdir("work")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = extractCraftedArchive(t, craftedInput(name, "gotcha"))
+			if err == nil {
+				t.Error("unsafe path should be rejected")
+			}
+			if _, err := os.Stat("../evil.txt"); err == nil {
+				t.Error("file was written outside the extraction directory")
+			}
+		})
+	}
+}
+
+func TestStoresRelativeNames(t *testing.T) {
+	enterTempDir(t)
+	writeTestFiles(t, map[string]string{"abs/one.txt": "given as an absolute path", "up/two.txt": "given from above"})
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir("work", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir("work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages bytes.Buffer
+	compressor := CreateCompressor()
+	compressor.Messages = &messages
+	compressor.SetOutput(&output.FileOutput{Filename: "test.hz", Mode: 0666})
+	for _, inputName := range []string{filepath.Join(dir, "abs"), filepath.Join("..", "up")} {
+		objs, err := input.ExpandInput(inputName, ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, inputObj := range objs {
+			compressor.AddInput(inputObj)
+		}
+	}
+	err = compressor.GenerateScheme()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compressor.CompressToOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prefix := range []string{`"/"`, `"../"`} {
+		if !strings.Contains(messages.String(), "Removing leading "+prefix) {
+			t.Errorf("removing %s from names should be noted, got %q", prefix, messages.String())
+		}
+	}
+
+	err = os.Mkdir("out", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressor := CreateDecompressor("test.hz")
+	decompressor.Messages = ioutil.Discard
+	decompressor.DestDir = "out"
+	decompressor.SameOwner = false
+	err = decompressor.ReadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decompressor.Close()
+	err = decompressor.Decompress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	extracted := map[string]string{
+		filepath.Join("out", strings.TrimLeft(dir, string(filepath.Separator)), "abs", "one.txt"): "given as an absolute path",
+		filepath.Join("out", "up", "two.txt"):                                                     "given from above",
+	}
+	for name, content := range extracted {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("%s: got %q, want %q", name, data, content)
+		}
+	}
+}
+
+func TestRejectsSymlinkEscape(t *testing.T) {
+	enterTempDir(t)
+	for _, dir := range []string{"outside", "work"} {
+		err := os.Mkdir(dir, 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Symlink("../outside", "work/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir("work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = extractCraftedArchive(t, craftedInput("link/evil.txt", "gotcha"))
+	if err == nil {
+		t.Error("entry behind a symlink leading outside should be rejected")
+	}
+	if _, err := os.Stat("../outside/evil.txt"); err == nil {
+		t.Error("file was written through the symlink")
+	}
+}
+
+func TestReplacesSymlinkAtEntry(t *testing.T) {
+	enterTempDir(t)
+	writeTestFiles(t, map[string]string{"outside.txt": "untouched"})
+	err := os.Symlink("outside.txt", "target.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = extractCraftedArchive(t, craftedInput("target.txt", "extracted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile("outside.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "untouched" {
+		t.Errorf("symlink target was overwritten with %q", data)
+	}
+	stat, err := os.Lstat("target.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stat.Mode().IsRegular() {
+		t.Errorf("target.txt should be a regular file, got mode %v", stat.Mode())
+	}
+}
+
+func TestSelectiveExtract(t *testing.T) {
+	enterTempDir(t)
+	writeTestFiles(t, testFiles)
+	compressTestFiles(t, "test.hz", "src")
+	err := os.RemoveAll("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decompressor := CreateDecompressor("test.hz")
+	decompressor.Patterns = []string{"src/a.txt", "src/nes*"}
+	err = decompressor.ReadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = decompressor.Decompress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"src/a.txt", "src/nested/c.txt"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != testFiles[name] {
+			t.Errorf("%s: got %q, want %q", name, data, testFiles[name])
+		}
+	}
+	if _, err := os.Stat("src/b.txt"); err == nil {
+		t.Error("src/b.txt doesn't match and shouldn't be extracted")
+	}
+}
+
+// Extracts test.hz into a fresh directory "out" and returns the names of
+// everything extracted, relative to it
+func extractInto(t *testing.T, stripComponents int) []string {
+	err := os.RemoveAll("out")
+	if err == nil {
+		err = os.Mkdir("out", 0o755)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressor := CreateDecompressor("test.hz")
+	decompressor.DestDir = "out"
+	decompressor.StripComponents = stripComponents
+	err = decompressor.ReadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decompressor.Close()
+	err = decompressor.Decompress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	err = filepath.Walk("out", func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == "out" {
+			return err
+		}
+		name, err := filepath.Rel("out", path)
+		names = append(names, filepath.ToSlash(name))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestExtractToDirectory(t *testing.T) {
+	enterTempDir(t)
+	writeTestFiles(t, testFiles)
+	compressTestFiles(t, "test.hz", "src")
+	err := os.RemoveAll("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := extractInto(t, 0)
+	want := []string{"src", "src/a.txt", "src/b.txt", "src/nested", "src/nested/c.txt"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", names, want)
+	}
+	for name, content := range testFiles {
+		data, err := os.ReadFile(filepath.Join("out", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("%s: got %q, want %q", name, data, content)
+		}
+	}
+	if _, err := os.Stat("src"); err == nil {
+		t.Error("nothing should be extracted into the working directory")
+	}
+}
+
+func TestStripComponents(t *testing.T) {
+	enterTempDir(t)
+	writeTestFiles(t, testFiles)
+	writeTestFiles(t, map[string]string{"top.txt": "only one component"})
+	compressTestFiles(t, "test.hz", "src", "top.txt")
+
+	// Entries with no more components than are stripped, such as src itself
+	// and top.txt, are skipped rather than written to the top of out
+	cases := map[int][]string{
+		1: {"a.txt", "b.txt", "nested", "nested/c.txt"},
+		2: {"c.txt"},
+		3: {},
+	}
+	for strip, want := range cases {
+		names := extractInto(t, strip)
+		if strings.Join(names, " ") != strings.Join(want, " ") {
+			t.Errorf("--strip-components %d: got %v, want %v", strip, names, want)
+		}
+	}
+	extractInto(t, 2)
+	data, err := os.ReadFile(filepath.Join("out", "c.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != testFiles["src/nested/c.txt"] {
+		t.Errorf("got %q, want the content of src/nested/c.txt", data)
+	}
+}
+
+func TestSelectiveExtractUnmatchedPattern(t *testing.T) {
+	enterTempDir(t)
+	writeTestFiles(t, testFiles)
+	compressTestFiles(t, "test.hz", "src")
+
+	decompressor := CreateDecompressor("test.hz")
+	decompressor.DestDir = t.TempDir()
+	decompressor.Patterns = []string{"src/a.txt", "logs/*.txt"}
+	err := decompressor.ReadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = decompressor.Decompress()
+	if err == nil || !strings.Contains(err.Error(), "logs/*.txt") {
+		t.Errorf("expected an error naming the unmatched pattern, got %v", err)
+	}
+}
+
+func TestDeterministicOutput(t *testing.T) {
+	enterTempDir(t)
+	writeTestFiles(t, map[string]string{
+		// Equal byte counts leave plenty of ties for the Huffman tree to break
+		"src/a.txt":        "abcdefgh",
+		"src/b.txt":        "hgfedcba",
+		"src/nested/c.txt": strings.Repeat("0123456789", 7),
+	})
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	archives := make([][]byte, 0)
+	for _, inputs := range [][]string{{"src"}, {"src/nested", "src/b.txt", "src", "src/a.txt"}} {
+		compressor := CreateCompressor()
+		compressor.ModTime = modTime
+		compressor.SetOutput(&output.FileOutput{
+			Filename: "test.hz",
+			Mode:     0666,
+		})
+		for _, inputName := range inputs {
+			objs, err := input.ExpandInput(inputName, ioutil.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, inputObj := range objs {
+				compressor.AddInput(inputObj)
+			}
+		}
+		compressor.SortInputs()
+		err := compressor.GenerateScheme()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = compressor.CompressToOutput()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile("test.hz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, data)
+	}
+	if !bytes.Equal(archives[0], archives[1]) {
+		t.Error("the same inputs should give byte-identical archives")
+	}
+}
+
+func TestDeterministicWithoutModTime(t *testing.T) {
+	enterTempDir(t)
+	writeTestFiles(t, testFiles)
+	archives := make([][]byte, 0)
+	for i := 0; i < 2; i++ {
+		compressTestFiles(t, "test.hz", "src")
+		data, err := os.ReadFile("test.hz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, data)
+		// As reading them may have done, whatever the mount options
+		for name := range testFiles {
+			info, err := os.Stat(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.Chtimes(name, time.Now().Add(time.Hour), info.ModTime())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !bytes.Equal(archives[0], archives[1]) {
+		t.Error("compressing unchanged inputs again should give a byte-identical archive")
+	}
+}
+
+func TestTableModes(t *testing.T) {
+	// Text and binary data with nothing in common, so one table suits neither
+	binary := make([]byte, 20000)
+	state := uint32(1)
+	for i := range binary {
+		state = state*1103515245 + 12345
+		binary[i] = 0x80 | byte(state>>16)
+	}
+	files := map[string]string{
+		"text.txt":   strings.Repeat("the quick brown fox jumps over the lazy dog. ", 400),
+		"binary.bin": string(binary),
+		"empty.txt":  "",
+	}
+	sizes := make(map[TableMode]int)
+	for _, mode := range []TableMode{TablesShared, TablesAuto, TablesPerEntry} {
+		enterTempDir(t)
+		compressor := CreateCompressor()
+		compressor.TableMode = mode
+		compressor.SetOutput(&output.FileOutput{
+			Filename: "test.hz",
+			Mode:     0666,
+		})
+		for name, content := range files {
+			compressor.AddInput(craftedInput(name, content))
+		}
+		compressor.SortInputs()
+		err := compressor.GenerateScheme()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = compressor.CompressToOutput()
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat("test.hz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[mode] = int(info.Size())
+
+		decompressor := CreateDecompressor("test.hz")
+		err = decompressor.ReadMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := decompressor.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ownTables := 0
+		for _, entry := range entries {
+			if entry.Table == OwnTable {
+				ownTables++
+			}
+			data, err := decompressor.ReadEntry(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != files[entry.Filename] {
+				t.Errorf("mode %d: %s didn't round trip", mode, entry.Filename)
+			}
+		}
+		// Test decodes the records in order rather than through the directory
+		err = decompressor.Test()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decompressor.Close()
+		if mode == TablesShared && ownTables != 0 {
+			t.Errorf("shared mode gave %d entries their own table", ownTables)
+		}
+		if mode == TablesAuto && ownTables == 0 {
+			t.Error("auto mode should give some entry its own table")
+		}
+		if mode == TablesPerEntry && ownTables != 2 {
+			t.Errorf("per-entry mode gave %d entries their own table, want 2", ownTables)
+		}
+	}
+	if sizes[TablesAuto] > sizes[TablesShared] {
+		t.Errorf("auto mode gave %d bytes, more than the %d of a shared table", sizes[TablesAuto], sizes[TablesShared])
+	}
+}
+
+func TestBlockTables(t *testing.T) {
+	// Text, then binary, then text again, a block of each
+	const blockSize = 16 * 1024
+	binary := make([]byte, blockSize)
+	state := uint32(1)
+	for i := range binary {
+		state = state*1103515245 + 12345
+		binary[i] = 0x80 | byte(state>>16)
+	}
+	text := strings.Repeat("the quick brown fox jumps over the lazy dog. ", 1000)[:blockSize]
+	data := text + string(binary) + text + text
+	sizes := make([]int, 0)
+	for _, size := range []int{0, blockSize} {
+		enterTempDir(t)
+		compressor := CreateCompressor()
+		compressor.BlockSize = size
+		compressor.SetOutput(&output.FileOutput{
+			Filename: "test.hz",
+			Mode:     0666,
+		})
+		compressor.AddInput(craftedInput("mixed.bin", data))
+		err := compressor.GenerateScheme()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size > 0 {
+			tables := make([]blockTable, 0)
+			for _, current := range compressor.stats[0].blocks {
+				tables = append(tables, current.Table)
+			}
+			// Every part needs a table of its own, but the last block can
+			// reuse the one before it
+			want := []blockTable{blockNewTable, blockNewTable, blockNewTable, blockPreviousTable}
+			if fmt.Sprint(tables) != fmt.Sprint(want) {
+				t.Errorf("got block tables %v, want %v", tables, want)
+			}
+		}
+		err = compressor.CompressToOutput()
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive, err := os.ReadFile("test.hz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, len(archive))
+
+		decompressor := CreateDecompressor("test.hz")
+		err = decompressor.ReadMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := decompressor.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size > 0 && entries[0].Table != BlockTables {
+			t.Errorf("got code table %d, want blocks", entries[0].Table)
+		}
+		decoded, err := decompressor.ReadEntry(entries[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decoded) != data {
+			t.Error("entry didn't round trip")
+		}
+		err = decompressor.Test()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decompressor.Close()
+	}
+	if sizes[1] >= sizes[0] {
+		t.Errorf("blocks gave %d bytes, no fewer than the %d of one table", sizes[1], sizes[0])
+	}
+}
+
+func TestLZRoundTrip(t *testing.T) {
+	var logs strings.Builder
+	for i := 0; logs.Len() < 600000; i++ {
+		fmt.Fprintf(&logs, "2020-01-01T00:%02d:%02dZ INFO request %d served in %dms\n", i/60%60, i%60, i, i*7%300)
+	}
+	files := map[string]string{
+		"logs.txt":  logs.String(),
+		"short.txt": "abc",
+		"empty.txt": "",
+		"runs.txt":  strings.Repeat("a", 100000),
+	}
+	sizes := make([]int, 0)
+	for _, window := range []int{0, 64 * 1024} {
+		enterTempDir(t)
+		compressor := CreateCompressor()
+		compressor.LZWindow = window
+		compressor.SetOutput(&output.FileOutput{
+			Filename: "test.hz",
+			Mode:     0666,
+		})
+		for name, content := range files {
+			compressor.AddInput(craftedInput(name, content))
+		}
+		compressor.SortInputs()
+		err := compressor.GenerateScheme()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = compressor.CompressToOutput()
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive, err := os.ReadFile("test.hz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, len(archive))
+
+		decompressor := CreateDecompressor("test.hz")
+		err = decompressor.ReadMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := decompressor.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if window > 0 && entry.Size > 0 && entry.Table != LZBlocks {
+				t.Errorf("%s: got code table %d, want LZ77 blocks", entry.Filename, entry.Table)
+			}
+			data, err := decompressor.ReadEntry(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != files[entry.Filename] {
+				t.Errorf("%s didn't round trip", entry.Filename)
+			}
+		}
+		err = decompressor.Test()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decompressor.Close()
+	}
+	if sizes[1]*4 > sizes[0] {
+		t.Errorf("LZ77 gave %d bytes, not much better than the %d without it", sizes[1], sizes[0])
+	}
+}
+
+func TestRejectsTruncatedLZ(t *testing.T) {
+	enterTempDir(t)
+	archive := compressCrafted(t, map[string]string{"lz.txt": strings.Repeat("repeated, so matched ", 100)}, func(compressor *Compressor) {
+		compressor.LZWindow = 64 * 1024
+	})
+	// The record comes before the central directory. After its name come the
+	// mode, owner, group, both times, size, checksum and table kind.
+	tableStart := bytes.Index(archive, []byte("lz.txt")) + len("lz.txt") + 28 + 8 + 4
+	if CodeTable(archive[tableStart]) != LZBlocks {
+		t.Fatalf("got table kind %d, want LZ77 blocks", archive[tableStart])
+	}
+	// Too short to even hold the window size
+	binary.BigEndian.PutUint64(archive[tableStart+1:], 16)
+
+	decompressor := CreateDecompressor("")
+	decompressor.Messages = ioutil.Discard
+	err := decompressor.ReadMetaFrom(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = decompressor.Test()
+	if err == nil || !strings.Contains(err.Error(), "Truncated LZ77 entry") {
+		t.Errorf("got %v, want a truncated LZ77 entry error", err)
+	}
+}
+
+func TestParallelMatchesSerial(t *testing.T) {
+	inputs := make([]input.Input, 0)
+	for i := 0; i < 40; i++ {
+		var data strings.Builder
+		for j := 0; j < i*i*20; j++ {
+			fmt.Fprintf(&data, "%d:%c ", j%(i+1), 'a'+byte(j*i%26))
+		}
+		inputs = append(inputs, craftedInput(fmt.Sprintf("input%02d.txt", i), data.String()))
+	}
+	settings := map[string]func(*Compressor){
+		"default": func(*Compressor) {},
+		"entry tables": func(compressor *Compressor) {
+			compressor.TableMode = TablesPerEntry
+		},
+		"blocks": func(compressor *Compressor) {
+			compressor.BlockSize = 4096
+		},
+		"lz": func(compressor *Compressor) {
+			compressor.LZWindow = 64 * 1024
+			compressor.BlockSize = 8192
+		},
+	}
+	for name, setting := range settings {
+		t.Run(name, func(t *testing.T) {
+			enterTempDir(t)
+			archives := make([][]byte, 0)
+			for _, jobs := range []int{1, 4} {
+				compressor := CreateCompressor()
+				compressor.Jobs = jobs
+				setting(&compressor)
+				compressor.SetOutput(&output.FileOutput{
+					Filename: "test.hz",
+					Mode:     0666,
+				})
+				for _, inputObj := range inputs {
+					compressor.AddInput(inputObj)
+				}
+				err := compressor.GenerateScheme()
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = compressor.CompressToOutput()
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := os.ReadFile("test.hz")
+				if err != nil {
+					t.Fatal(err)
+				}
+				archives = append(archives, data)
+			}
+			if !bytes.Equal(archives[0], archives[1]) {
+				t.Error("compressing in parallel should give the same archive")
+			}
+			decompressor := CreateDecompressor("test.hz")
+			err := decompressor.ReadMeta()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer decompressor.Close()
+			err = decompressor.Test()
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestParallelExtract(t *testing.T) {
+	enterTempDir(t)
+	files := make(map[string]string)
+	inputs := make([]input.Input, 0)
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("input%02d.txt", i)
+		files[name] = strings.Repeat(fmt.Sprintf("%d %s ", i, name), 50*(i+1))
+		inputs = append(inputs, craftedInput(name, files[name]))
+	}
+	compressor := CreateCompressor()
+	compressor.BlockSize = 4096
+	compressor.SetOutput(&output.FileOutput{
+		Filename: "test.hz",
+		Mode:     0666,
+	})
+	for _, inputObj := range inputs {
+		compressor.AddInput(inputObj)
+	}
+	err := compressor.GenerateScheme()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compressor.CompressToOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	extract := func(dir string) error {
+		err := os.Mkdir(dir, 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decompressor := CreateDecompressor("test.hz")
+		decompressor.DestDir = dir
+		decompressor.Jobs = 4
+		err = decompressor.ReadMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer decompressor.Close()
+		return decompressor.Decompress()
+	}
+	err = extract("out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		data, err := os.ReadFile(filepath.Join("out", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, []byte(content)) {
+			t.Errorf("%s: extracted data differs", name)
+		}
+	}
+
+	// Damage two entries, the earlier one should always be the one reported
+	decompressor := CreateDecompressor("test.hz")
+	err = decompressor.ReadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := decompressor.ReadDirectory()
+	decompressor.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile("test.hz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{12, 30} {
+		data[(entries[i].Offset+entries[i+1].Offset)/2] ^= 0xff
+	}
+	err = os.WriteFile("test.hz", data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 0; attempt < 5; attempt++ {
+		err := extract(fmt.Sprintf("damaged%d", attempt))
+		if err == nil || !strings.Contains(err.Error(), entries[12].Filename) {
+			t.Fatalf("expected an error for %s, got %v", entries[12].Filename, err)
+		}
+		if _, err := os.Stat(filepath.Join(fmt.Sprintf("damaged%d", attempt), entries[12].Filename)); err == nil {
+			t.Error("damaged entry was left behind")
+		}
+	}
+}
+
+func TestAdaptiveRoundTrip(t *testing.T) {
+	files := map[string]string{
+		"text.txt":  strings.Repeat("adaptive codes follow the data as it changes\n", 2000),
+		"skewed":    strings.Repeat("\x00", 5000) + "\x01\x02" + strings.Repeat("\x00", 5000),
+		"short.txt": "a",
+		"empty.txt": "",
+	}
+	for _, coder := range []Coder{CoderHuffman, CoderRange} {
+		t.Run(fmt.Sprint(coder), func(t *testing.T) {
+			archives := make([][]byte, 0)
+			for _, jobs := range []int{1, 3} {
+				enterTempDir(t)
+				archive := compressCrafted(t, files, func(compressor *Compressor) {
+					compressor.Adaptive = true
+					compressor.Coder = coder
+					compressor.Jobs = jobs
+				})
+				archives = append(archives, archive)
+
+				decompressor := CreateDecompressor("test.hz")
+				err := decompressor.ReadMeta()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !decompressor.header.HasFlag(FlagAdaptive) || decompressor.header.Coder != coder {
+					t.Errorf("archive header has flags %x and coder %d", decompressor.header.Flags, decompressor.header.Coder)
+				}
+				err = decompressor.Test()
+				if err != nil {
+					t.Fatal(err)
+				}
+				decompressor.Close()
+				decompressor = CreateDecompressor("test.hz")
+				err = decompressor.ReadMeta()
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = decompressor.Decompress()
+				decompressor.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for name, content := range files {
+					data, err := os.ReadFile(name)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if string(data) != content {
+						t.Errorf("%s didn't round trip", name)
+					}
+				}
+			}
+			if !bytes.Equal(archives[0], archives[1]) {
+				t.Error("coding adaptively in parallel should give the same archive")
+			}
+		})
+	}
+}
+
+func TestANSFrameTables(t *testing.T) {
+	// Two inputs whose bytes have nothing in common, where one table for both
+	// would cost each about a bit a byte more than a table of its own
+	random := rand.New(rand.NewSource(1))
+	text := make([]byte, 150000)
+	binary := make([]byte, 150000)
+	for i := range text {
+		text[i] = 'a' + byte(random.ExpFloat64()*3)%26
+		binary[i] = 0x80 + byte(random.ExpFloat64()*6)%0x80
+	}
+	files := map[string]string{"text.txt": string(text), "data.bin": string(binary)}
+	enterTempDir(t)
+	compressCrafted(t, files, func(compressor *Compressor) {
+		compressor.Coder = CoderANS
+	})
+	decompressor := CreateDecompressor("test.hz")
+	err := decompressor.ReadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decompressor.Close()
+	entries, err := decompressor.ReadDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		content := []byte(files[entry.Filename])
+		var counts [256]float64
+		for _, currentByte := range content {
+			counts[currentByte]++
+		}
+		entropy := 0.0
+		for _, count := range counts {
+			if count > 0 {
+				entropy -= count * math.Log2(count/float64(len(content)))
+			}
+		}
+		if float64(entry.CompressedBits) > entropy*1.02 {
+			t.Errorf("%s took %d bits, %.0f more than its entropy", entry.Filename, entry.CompressedBits, float64(entry.CompressedBits)-entropy)
+		}
+		data, err := decompressor.ReadEntry(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, content) {
+			t.Errorf("%s didn't round trip", entry.Filename)
+		}
+	}
+}
+
+func TestFramedRecordsInOrder(t *testing.T) {
+	// Several frames long, from a stream that can only be read once
+	streamed := strings.Repeat("written as it is read, sized afterwards\n", 5000)
+	compressor := CreateCompressor()
+	compressor.Messages = ioutil.Discard
+	compressor.Coder = CoderRange
+	var archive bytes.Buffer
+	compressor.SetOutput(&output.StreamOutput{Writer: &archive})
+	compressor.AddInput(&input.StreamInput{
+		Name:   "stdin",
+		Reader: strings.NewReader(streamed),
+		Meta:   input.FileMeta{Mode: 0o644, Owner_ID: -1, Group_ID: -1},
+	})
+	compressor.AddInput(craftedInput("tail.txt", "after the stream"))
+	err := compressor.GenerateScheme()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compressor.CompressToOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decompressor := CreateDecompressor("")
+	decompressor.Messages = ioutil.Discard
+	err = decompressor.ReadMetaFrom(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := decompressor.NextHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Filename != "stdin" || entry.Size != 0 {
+		t.Errorf("got %s of %d bytes, the size should only follow the data", entry.Filename, entry.Size)
+	}
+	// Skipped over frame by frame
+	entry, err = decompressor.NextHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := decompressor.ReadData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Filename != "tail.txt" || string(data) != "after the stream" {
+		t.Errorf("got %s with %q", entry.Filename, data)
+	}
+	// The central directory has to agree with the sizes after the data
+	_, err = decompressor.NextHeader()
+	if err != io.EOF {
+		t.Fatalf("expected the end of the archive, got %v", err)
+	}
+
+	decompressor = CreateDecompressor("")
+	decompressor.Messages = ioutil.Discard
+	err = decompressor.ReadMetaFrom(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := decompressor.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Size != uint64(len(streamed)) || entries[0].Checksum != Checksum([]byte(streamed)) {
+		t.Errorf("listing in order should give the sizes after the data, got %+v", entries)
+	}
+}
+
+func TestEntriesAddedOneAtATime(t *testing.T) {
+	enterTempDir(t)
+	compressor := CreateCompressor()
+	compressor.Messages = ioutil.Discard
+	compressor.SetOutput(&output.FileOutput{Filename: "test.hz"})
+	err := compressor.StartArchive()
+	if err == nil {
+		t.Error("entries of a static Huffman archive can't be added one at a time")
+	}
+	compressor.Coder = CoderRange
+	err = compressor.StartArchive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"first.txt":  strings.Repeat("added without knowing how many follow\n", 3000),
+		"second.txt": "",
+		"third.txt":  "last",
+	}
+	meta := input.FileMeta{Mode: 0o644, Owner_ID: -1, Group_ID: -1}
+	for _, name := range []string{"first.txt", "second.txt", "third.txt"} {
+		entry, err := compressor.CreateEntry(name, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = compressor.CreateEntry("other.txt", meta)
+		if err == nil {
+			t.Error("an entry can't be created while another is open")
+		}
+		_, err = io.WriteString(entry, files[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = entry.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = compressor.FinishArchive()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// In order up to the filename length of 0 after the records
+	archive, err := os.ReadFile("test.hz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressor := CreateDecompressor("")
+	decompressor.Messages = ioutil.Discard
+	err = decompressor.ReadMetaFrom(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := decompressor.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(files) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(files))
+	}
+	for _, entry := range entries {
+		if entry.Size != uint64(len(files[entry.Filename])) {
+			t.Errorf("%s: got size %d, want %d", entry.Filename, entry.Size, len(files[entry.Filename]))
+		}
+	}
+
+	// Through the central directory
+	err = os.Mkdir("out", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressor = CreateDecompressor("test.hz")
+	decompressor.Messages = ioutil.Discard
+	decompressor.DestDir = "out"
+	decompressor.SameOwner = false
+	err = decompressor.ReadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decompressor.Close()
+	err = decompressor.Decompress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		data, err := os.ReadFile(filepath.Join("out", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("%s: got %d bytes, want %d", name, len(data), len(content))
+		}
+	}
+}
+
+// Compresses files given by name and content into test.hz in the current
+// directory, returning the archive
+func compressCrafted(t *testing.T, files map[string]string, setting func(*Compressor)) []byte {
+	compressor := CreateCompressor()
+	setting(&compressor)
+	compressor.SetOutput(&output.FileOutput{
+		Filename: "test.hz",
+		Mode:     0666,
+	})
+	for name, content := range files {
+		compressor.AddInput(craftedInput(name, content))
+	}
+	compressor.SortInputs()
+	err := compressor.GenerateScheme()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compressor.CompressToOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := os.ReadFile("test.hz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func TestRangeCoderOnSkewedData(t *testing.T) {
+	// Readings that hardly ever change, where Huffman can't go below a bit each
+	var readings strings.Builder
+	for i := 0; i < 200000; i++ {
+		if i%97 == 0 {
+			readings.WriteByte(byte('1' + i%5))
+		} else {
+			readings.WriteByte('0')
+		}
+	}
+	files := map[string]string{"sensor.log": readings.String()}
+	enterTempDir(t)
+	huffman := compressCrafted(t, files, func(*Compressor) {})
+	ranged := compressCrafted(t, files, func(compressor *Compressor) {
+		compressor.Coder = CoderRange
+	})
+	if len(ranged)*3 > len(huffman) {
+		t.Errorf("range coding gave %d bytes against %d with Huffman", len(ranged), len(huffman))
+	}
+	decompressor := CreateDecompressor("test.hz")
+	err := decompressor.ReadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decompressor.Close()
+	entries, err := decompressor.ReadDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := decompressor.ReadEntry(entries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != files["sensor.log"] {
+		t.Error("range coded entry didn't round trip")
+	}
+}
+
+func TestANSCoder(t *testing.T) {
+	var readings strings.Builder
+	for i := 0; i < 200000; i++ {
+		if i%13 == 0 {
+			readings.WriteByte(byte('1' + i%5))
+		} else {
+			readings.WriteByte('0')
+		}
+	}
+	files := map[string]string{
+		"sensor.log": readings.String(),
+		"text.txt":   strings.Repeat("states stand in for codes\n", 20),
+		"empty.txt":  "",
+	}
+	enterTempDir(t)
+	huffman := compressCrafted(t, files, func(*Compressor) {})
+	archives := make([][]byte, 0)
+	for _, jobs := range []int{1, 4} {
+		archives = append(archives, compressCrafted(t, files, func(compressor *Compressor) {
+			compressor.Coder = CoderANS
+			compressor.Jobs = jobs
+		}))
+	}
+	if !bytes.Equal(archives[0], archives[1]) {
+		t.Error("coding with tANS in parallel should give the same archive")
+	}
+	// Huffman needs over a bit for each reading, tANS a little over half that
+	if len(archives[0])*3 > len(huffman)*2 {
+		t.Errorf("tANS gave %d bytes against %d with Huffman", len(archives[0]), len(huffman))
+	}
+	decompressor := CreateDecompressor("test.hz")
+	err := decompressor.ReadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decompressor.header.Coder != CoderANS {
+		t.Errorf("archive header names coder %d", decompressor.header.Coder)
+	}
+	err = decompressor.Test()
+	decompressor.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressor = CreateDecompressor("test.hz")
+	decompressor.Jobs = 2
+	err = decompressor.ReadMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decompressor.Close()
+	for name := range files {
+		os.Remove(name)
+	}
+	err = decompressor.Decompress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("%s didn't round trip", name)
+		}
+	}
+}
@@ -4,55 +4,160 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"hzip/src/frequency_table"
 	"hzip/src/huffman_tree"
 	"hzip/src/input"
 	"hzip/src/key_table"
+	"hzip/src/lz77"
 	"hzip/src/output"
 	"hzip/src/priority_queue"
-	"os"
+	"hzip/src/tans"
+	"io"
+	"sort"
+	"time"
 
 	"github.com/dgryski/go-bitstream"
 	"github.com/schollz/progressbar/v3"
 )
 
 type Compressor struct {
-	Output   output.Output
-	Inputs   []input.Input
+	Output output.Output
+	Inputs []input.Input
+	// If set, used as the modification and access time of every entry, so
+	// archives of the same content come out byte for byte the same
+	ModTime time.Time
+	// Longest code to assign, 0 for the longest the decoder supports
+	MaxCodeLength int
+	TableMode     TableMode
+	// Entries larger than this are split into blocks that can each have
+	// their own table, 0 to never split them
+	BlockSize int
+	// Furthest back an LZ77 match can reach, 0 to code single bytes only.
+	// Every entry is then split into blocks with tables of their own.
+	LZWindow int
+	// Inputs compressed at the same time, 1 or less for one after another.
+	// The archive comes out the same either way.
+	Jobs int
+	// Code every input in a single pass with a Huffman tree that adapts as it
+	// goes, instead of counting bytes first. No table is stored, and the
+	// options above about tables, blocks and LZ77 don't apply.
+	Adaptive bool
+	// Entropy coder for every entry. CoderRange always codes adaptively, and
+	// only the Huffman coder supports the options about tables, blocks and
+	// LZ77.
+	Coder Coder
+	// Where progress bars and messages go, kept apart from Output so the
+	// archive can be written to stdout
+	Messages io.Writer
 	keyTable key_table.KeyTable
+	ansTable *tans.Table
+	stats    []inputStats // from GenerateScheme, in the same order as Inputs
+	header   ArchiveHeader
+	checksum hash.Hash32 // running CRC32C of everything written so far
+	written  uint64      // bytes written so far
+	// Entries of the records written so far, for the central directory
+	directory []ArchiveEntry
+	openEnded bool         // the records are ended by a filename length of 0
+	coder     entryCoder   // for entries added with CreateEntry
+	entry     *EntryWriter // entry added with CreateEntry that isn't closed yet
+	// Prefixes already noted as removed from names, see noteStoredName
+	strippedPrefixes map[string]bool
 }
 
 func (compressor *Compressor) GenerateScheme() error {
-	fmt.Println("[INFO] Creating frequency table")
+	if compressor.adaptive() {
+		// Inputs are only read once, while they are compressed
+		compressor.keyTable = key_table.CreateKeyTable()
+		compressor.stats = make([]inputStats, len(compressor.Inputs))
+		return nil
+	}
+	fmt.Fprintln(compressor.Messages, "[INFO] Creating frequency table")
 	freqTable := frequency_table.CreateFrequencyTable()
 	bar := progressbar.NewOptions(
 		len(compressor.Inputs),
 		progressbar.OptionClearOnFinish(),
 		progressbar.OptionSetPredictTime(true),
+		progressbar.OptionSetWriter(compressor.Messages),
 	)
-	for _, inputObj := range compressor.Inputs {
+	compressor.stats = make([]inputStats, 0, len(compressor.Inputs))
+	blockSize := uint64(compressor.BlockSize)
+	if compressor.TableMode == TablesShared || compressor.Coder != CoderHuffman {
+		blockSize = 0
+	}
+	// Each worker counts into a table of its own, merged once all are done
+	workerTables := make([]frequency_table.FrequencyTable, 0)
+	startWorker := func() func(int) (interface{}, error) {
+		workerTable := frequency_table.CreateFrequencyTable()
+		workerTables = append(workerTables, workerTable)
+		matcher := compressor.createMatcher()
+		return func(i int) (interface{}, error) {
+			reader, err := compressor.Inputs[i].Open()
+			if err != nil {
+				fmt.Fprintln(compressor.Messages, err)
+				return nil, errors.New("[ERROR] Failed to open input")
+			}
+			var stats inputStats
+			if matcher != nil {
+				stats, err = compressor.scanLZ(matcher, reader)
+			} else {
+				stats, err = scanInput(reader, blockSize)
+			}
+			reader.Close()
+			if err != nil {
+				fmt.Fprintln(compressor.Messages, err)
+				return nil, errors.New("[ERROR] Failed to read data from input")
+			}
+			if stats.histogram != nil {
+				for symbol, count := range stats.histogram {
+					workerTable.Add(byte(symbol), int(count))
+				}
+			}
+			return stats, nil
+		}
+	}
+	err := compressor.runParallel(startWorker, func(i int, result interface{}) error {
 		err := bar.Add(1)
 		if err != nil {
 			return errors.New("[ERROR] Failed to update progress bar")
 		}
-		data, err := inputObj.GetData()
-		if err != nil {
-			fmt.Println(err)
-			return errors.New("[ERROR] Failed to read data from input")
-		}
-		for _, currentByte := range data {
-			freqTable.Increment(currentByte)
-		}
+		compressor.stats = append(compressor.stats, result.(inputStats))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, workerTable := range workerTables {
+		freqTable.Merge(workerTable)
 	}
-	err := bar.Finish()
+	err = bar.Finish()
 	if err != nil {
 		return errors.New("[ERROR] Failed to finish progress bar")
 	}
-	fmt.Println("[INFO] Constructing Huffman Tree")
+	if compressor.Coder == CoderANS {
+		compressor.keyTable = key_table.CreateKeyTable()
+		return compressor.buildANSTable(freqTable)
+	}
+	if compressor.LZWindow > 0 {
+		// Nothing uses the archive's table
+		compressor.keyTable = key_table.CreateKeyTable()
+		return nil
+	}
+	return compressor.assignTables(freqTable)
+}
+
+// Assigns codes from a plain Huffman tree, only limiting their length if the
+// tree is deeper than the decoder supports
+func (compressor *Compressor) buildHuffmanTree(freqTable frequency_table.FrequencyTable) error {
+	fmt.Fprintln(compressor.Messages, "[INFO] Constructing Huffman Tree")
 	pq := priority_queue.NewPriorityQueue()
-	for data, frequency := range freqTable.GetFrequencies() {
+	frequencies := freqTable.GetFrequencies()
+	for _, data := range freqTable.Symbols() {
+		frequency := frequencies[data]
 		pq.Push(huffman_tree.HtreeQueueItem{
 			Priority: frequency,
+			Order:    int(data),
 			Tree: &huffman_tree.HuffmanTree{
 				Head: huffman_tree.LeafNode{
 					Freq:     frequency,
@@ -62,18 +167,39 @@ func (compressor *Compressor) GenerateScheme() error {
 			},
 		})
 	}
+	if pq.Len() == 0 {
+		// Every input is empty, so there is nothing to assign codes to
+		return nil
+	}
+	// Combined trees are ordered after every leaf, and after each other in the
+	// order they were made
+	nextOrder := 256
 	for pq.Len() > 1 {
 		newTree := huffman_tree.CombineTrees(pq.Pop().(huffman_tree.HtreeQueueItem).Tree, pq.Pop().(huffman_tree.HtreeQueueItem).Tree)
 		pq.Push(huffman_tree.HtreeQueueItem{
 			Priority: newTree.Frequency,
+			Order:    nextOrder,
 			Tree:     newTree,
 		})
+		nextOrder++
 	}
 	finalTree := pq.Pop().(huffman_tree.HtreeQueueItem).Tree
-	compressor.keyTable = key_table.CreateKeyTable()
-	err = compressor.keyTable.ReadTree(finalTree)
+	lengths := key_table.TreeCodeLengths(finalTree)
+	for _, length := range lengths {
+		if length > key_table.MaxCodeLength {
+			// Deeper than the decoder can follow, so limit the codes after all
+			var err error
+			lengths, err = key_table.LimitedCodeLengths(freqTable.GetFrequencies(), key_table.MaxCodeLength)
+			if err != nil {
+				fmt.Fprintln(compressor.Messages, err)
+				return errors.New("[ERROR] Failed to assign code lengths")
+			}
+			break
+		}
+	}
+	err := compressor.keyTable.SetCodeLengths(lengths)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(compressor.Messages, err)
 		return errors.New("[ERROR] Failed to generate keys from Huffman tree")
 	}
 	return nil
@@ -83,168 +209,446 @@ func (compressor *Compressor) CompressToOutput() error {
 	/*
 		Output looks like this:
 		----------------------------------------------
-		|--- Number of key table entries (64 bits) ---|
-		for each key table entry {
-			|--- key (1 byte) ---|
-			|--- length (8 bytes) ---|
-			|--- value ($length bits) ---|
-		}
+		|--- archive header (see header.go) ---|
+
+		(with FlagAdaptive, the records are coded differently, see adaptive.go)
+
+		|--- code length of every byte value (see key_table/canonical.go) ---|
+		(or, with CoderANS, the tANS table, see ans.go)
 
 		|--- 0 until edge of byte boundary ---|
 
-		|--- number of inputs (8 bytes) ---|
+		|--- number of inputs (8 bytes, all ones if not known up front, see incremental.go) ---|
 		for each input {
-			|--- length of filename (8 bytes) ---|
-			|--- filename ($length bytes) ---|
-			|--- length of compressed buffer (8 bytes)---|
+			|--- record header (see entry.go) ---|
 			|--- compressed buffer ($length bits) ---|
+				|--- own code lengths, padded to a byte (only if the record has its own table) ---|
+				|--- compressed data ---|
+				or, for records split into blocks,
+				|--- blocks (see blocks.go) ---|
+				or, for records coded with LZ77,
+				|--- LZ77 blocks (see lz.go) ---|
 			|--- 0 until edge of byte boundary ---|
 		}
+		|--- 0 (8 bytes, only if the number of inputs wasn't known) ---|
+
+		|--- central directory and its footer (see directory.go) ---|
+
+		|--- trailer (see checksum.go, only with FlagChecksums) ---|
 		----------------------------------------------
 	*/
+	err := compressor.openOutput()
+	if err != nil {
+		return err
+	}
+	for _, inputObj := range compressor.Inputs {
+		compressor.noteStoredName(inputObj)
+	}
+	err = compressor.writeArchive()
+	if err != nil {
+		// Don't leave a partial archive behind
+		compressor.Output.Abort()
+		return err
+	}
+	err = compressor.Output.Close()
+	if err != nil {
+		fmt.Fprintln(compressor.Messages, err)
+		return errors.New("[ERROR] Failed to close output")
+	}
+	return nil
+}
+
+// Sets up the archive header for the options given and opens the output
+func (compressor *Compressor) openOutput() error {
+	compressor.header = CreateArchiveHeader()
+	compressor.header.Coder = compressor.Coder
+	if compressor.adaptive() {
+		compressor.header.Flags |= FlagAdaptive
+	}
+	compressor.checksum = crc32.New(crcTable)
+	compressor.written = 0
+	compressor.directory = make([]ArchiveEntry, 0)
 	err := compressor.Output.Open()
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(compressor.Messages, err)
 		return errors.New("[ERROR] Couldn't open output")
 	}
-	defer func(Output output.Output) {
-		err := Output.Close()
-		if err != nil {
-			fmt.Println("[FATAL] Failed to close output")
-			os.Exit(1)
-		}
-	}(compressor.Output)
+	return nil
+}
+
+func (compressor *Compressor) writeArchive() error {
 	bar := progressbar.NewOptions(
 		len(compressor.Inputs),
 		progressbar.OptionClearOnFinish(),
 		progressbar.OptionSetPredictTime(true),
+		progressbar.OptionSetWriter(compressor.Messages),
 	)
-	// Dump key table to output
-	var keyTableBuffer bytes.Buffer
-	keyTableWriter := bitstream.NewWriter(&keyTableBuffer)
-	err = keyTableWriter.WriteBits(uint64(len(compressor.keyTable.Table)), 64)
+	err := compressor.writeStart(uint64(len(compressor.Inputs)))
 	if err != nil {
-		return errors.New("[ERROR] Failed to write bits to stream")
+		return err
 	}
-	for key, value := range compressor.keyTable.Table {
-		err := keyTableWriter.WriteByte(key)
+	writeRecord := func(i int, writeData func() error) error {
+		err := bar.Add(1)
 		if err != nil {
-			return errors.New("[ERROR] Failed to write byte to key table")
+			return errors.New("[ERROR] Failed to update progress bar")
 		}
-		err = keyTableWriter.WriteBits(uint64(value.Length), 64)
+		return compressor.writeRecord(i, writeData)
+	}
+	writeBuffer := func(data []byte) error {
+		err := compressor.write(data)
 		if err != nil {
-			return errors.New("[ERROR] Failed to write bits to key table")
+			fmt.Fprintln(compressor.Messages, err)
+			return errors.New("[ERROR] Failed to write compressed buffer to output")
 		}
-		reader := bitstream.NewReader(&value.Data)
-		for i := 0; i < value.Length; i++ {
-			bit, err := reader.ReadBit()
+		return nil
+	}
+	coder, err := compressor.entryCoder()
+	if err != nil {
+		return err
+	}
+	if coder != nil && compressor.Jobs <= 1 {
+		// Straight to the output, holding no more than a frame in memory
+		for i := range compressor.Inputs {
+			err := writeRecord(i, func() error {
+				stats, err := compressor.encodeFrames(coder, i, compressor.write)
+				compressor.stats[i] = stats
+				return err
+			})
 			if err != nil {
-				return errors.New("[ERROR] Failed to read bit from key table entry")
+				return err
+			}
+		}
+	} else if coder != nil {
+		startWorker := func() func(int) (interface{}, error) {
+			return func(i int) (interface{}, error) {
+				var buffer bytes.Buffer
+				stats, err := compressor.encodeFrames(coder, i, func(data []byte) error {
+					_, err := buffer.Write(data)
+					return err
+				})
+				return codedEntry{stats: stats, data: buffer.Bytes()}, err
 			}
-			err = keyTableWriter.WriteBit(bit)
+		}
+		err = compressor.runParallel(startWorker, func(i int, result interface{}) error {
+			encoded := result.(codedEntry)
+			compressor.stats[i] = encoded.stats
+			return writeRecord(i, func() error {
+				return writeBuffer(encoded.data)
+			})
+		})
+		if err != nil {
+			return err
+		}
+	} else if compressor.Jobs <= 1 {
+		// Straight to the output, without holding any compressed data in memory
+		enc := createEncoder(compressor.keyTable, compressor.write)
+		matcher := compressor.createMatcher()
+		for i := range compressor.Inputs {
+			err := writeRecord(i, func() error {
+				return compressor.encodeEntry(enc, matcher, i)
+			})
 			if err != nil {
-				return errors.New("[ERROR] Failed to write bit to key table")
+				return err
 			}
 		}
+	} else {
+		startWorker := func() func(int) (interface{}, error) {
+			var buffer *bytes.Buffer
+			enc := createEncoder(compressor.keyTable, func(data []byte) error {
+				_, err := buffer.Write(data)
+				return err
+			})
+			matcher := compressor.createMatcher()
+			return func(i int) (interface{}, error) {
+				buffer = &bytes.Buffer{}
+				err := compressor.encodeEntry(enc, matcher, i)
+				return buffer.Bytes(), err
+			}
+		}
+		err = compressor.runParallel(startWorker, func(i int, result interface{}) error {
+			return writeRecord(i, func() error {
+				return writeBuffer(result.([]byte))
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err = compressor.writeEnd()
+	if err != nil {
+		return err
+	}
+	err = bar.Finish()
+	if err != nil {
+		return errors.New("[ERROR] Failed to finish progress bar")
+	}
+	return nil
+}
+
+// Writes the archive header and key table, then the number of inputs that
+// will follow
+func (compressor *Compressor) writeStart(numInputs uint64) error {
+	// Dump archive header and key table to output
+	var keyTableBuffer bytes.Buffer
+	keyTableWriter := bitstream.NewWriter(&keyTableBuffer)
+	err := compressor.header.Write(keyTableWriter)
+	if err != nil {
+		fmt.Fprintln(compressor.Messages, err)
+		return errors.New("[ERROR] Failed to write archive header")
+	}
+	if compressor.Coder == CoderANS {
+		err = compressor.ansTable.Write(keyTableWriter)
+		if err != nil {
+			fmt.Fprintln(compressor.Messages, err)
+			return errors.New("[ERROR] Failed to write tANS table")
+		}
+	} else if !compressor.header.HasFlag(FlagAdaptive) {
+		err = compressor.keyTable.CodeLengths().Write(keyTableWriter)
+		if err != nil {
+			fmt.Fprintln(compressor.Messages, err)
+			return errors.New("[ERROR] Failed to write key table")
+		}
 	}
 	err = keyTableWriter.Flush(bitstream.Zero)
 	if err != nil {
 		return errors.New("[ERROR] Failed to flush bitstream")
 	}
-	err = compressor.Output.Write(keyTableBuffer.Bytes())
+	err = compressor.write(keyTableBuffer.Bytes())
 	if err != nil {
 		return errors.New("[ERROR] Failed to write to output buffer")
 	}
 	var numInputsBuffer bytes.Buffer
 	numInputsWriter := bitstream.NewWriter(&numInputsBuffer)
 	// TODO This doesn't need to be a 64 bit int
-	err = numInputsWriter.WriteBits(uint64(len(compressor.Inputs)), 64)
+	err = numInputsWriter.WriteBits(numInputs, 64)
 	if err != nil {
 		return errors.New("[ERROR] Failed to write bits to number input writer")
 	}
-	err = compressor.Output.Write(numInputsBuffer.Bytes())
+	err = compressor.write(numInputsBuffer.Bytes())
 	if err != nil {
 		return errors.New("[ERROR] Failed to write bytes to compressor output")
 	}
-	for _, inputObj := range compressor.Inputs {
-		err := bar.Add(1)
-		if err != nil {
-			return errors.New("[ERROR] Failed to update progress bar")
-		}
-		inputData, err := inputObj.GetData()
-		if err != nil {
-			fmt.Println(err)
-			return errors.New("[ERROR] Failed to get data from input")
-		}
-		contentBuffer, compressedBufferLen, err := compressor.compress_buffer(inputData)
+	compressor.openEnded = numInputs == numInputsUnknown
+	return nil
+}
+
+// Writes the record header of input i, then its compressed buffer with writeData
+func (compressor *Compressor) writeRecord(i int, writeData func() error) error {
+	entry, err := compressor.startRecord(i)
+	if err != nil {
+		return err
+	}
+	err = writeData()
+	if err != nil {
+		return err
+	}
+	compressor.finishRecord(i, entry)
+	return nil
+}
+
+// Writes the record header of input i, returning the entry the central
+// directory will have for it
+func (compressor *Compressor) startRecord(i int) (ArchiveEntry, error) {
+	entry := compressor.archiveEntry(i)
+	var metaBuffer bytes.Buffer
+	metaWriter := bitstream.NewWriter(&metaBuffer)
+	err := compressor.header.recordHeader(entry).WriteHeader(metaWriter, compressor.header)
+	if err != nil {
+		fmt.Fprintln(compressor.Messages, err)
+		return entry, errors.New("[ERROR] Failed to write metadata to buffer")
+	}
+	err = compressor.write(metaBuffer.Bytes())
+	if err != nil {
+		fmt.Fprintln(compressor.Messages, err)
+		return entry, errors.New("[ERROR] Failed to write metadata to output")
+	}
+	return entry, nil
+}
+
+// Adds input i to the central directory once its data has been written
+func (compressor *Compressor) finishRecord(i int, entry ArchiveEntry) {
+	if compressor.header.framed() {
+		// Only known once the data has been written
+		stats := compressor.stats[i]
+		entry.Size, entry.Checksum, entry.CompressedBits = stats.Size, stats.Checksum, stats.CompressedBits
+	}
+	compressor.directory = append(compressor.directory, entry)
+}
+
+// Writes what follows the records: the end of an open-ended list of them,
+// the central directory and the trailer
+func (compressor *Compressor) writeEnd() error {
+	if compressor.openEnded {
+		err := compressor.write(make([]byte, 8))
 		if err != nil {
-			fmt.Println(err)
-			return errors.New("[ERROR] Failed to compress buffer")
+			fmt.Fprintln(compressor.Messages, err)
+			return errors.New("[ERROR] Failed to write end of records to output")
 		}
-		var metaBuffer bytes.Buffer
-		// TODO Compress filenames too
-		metaWriter := bitstream.NewWriter(&metaBuffer)
-		err = metaWriter.WriteBits(uint64(len(inputObj.(input.FileInput).Filename)), 64)
+	}
+	err := compressor.writeCentralDirectory(compressor.directory)
+	if err != nil {
+		return err
+	}
+	if compressor.header.HasFlag(FlagChecksums) {
+		var trailerBuffer bytes.Buffer
+		err = writeTrailer(bitstream.NewWriter(&trailerBuffer), compressor.checksum.Sum32())
 		if err != nil {
-			return errors.New("[ERROR] Failed to write metadata bits to buffer")
-		}
-		for _, character := range inputObj.(input.FileInput).Filename {
-			err := metaWriter.WriteByte(byte(character))
-			if err != nil {
-				return errors.New("[ERROR] Failed to write metadata bytes")
-			}
+			fmt.Fprintln(compressor.Messages, err)
+			return errors.New("[ERROR] Failed to write trailer to buffer")
 		}
-		err = metaWriter.WriteBits(uint64(compressedBufferLen), 64)
+		err = compressor.write(trailerBuffer.Bytes())
 		if err != nil {
-			return errors.New("[ERROR] Failed to write bits to metadata buffer")
+			fmt.Fprintln(compressor.Messages, err)
+			return errors.New("[ERROR] Failed to write trailer to output")
 		}
-		err = compressor.Output.Write(metaBuffer.Bytes())
+	}
+	return nil
+}
+
+// Record header of input i, with the offset it will be written at if it is
+// written next
+func (compressor *Compressor) archiveEntry(i int) ArchiveEntry {
+	stats := compressor.stats[i]
+	meta := compressor.Inputs[i].GetMeta()
+	entry := ArchiveEntry{
+		Filename:       archiveName(compressor.Inputs[i]),
+		Mode:           meta.GetMode(),
+		OwnerID:        meta.GetOwnerID(),
+		GroupID:        meta.GetGroupID(),
+		ModTime:        meta.GetModTime(),
+		AccessTime:     meta.GetAccessTime(),
+		Size:           stats.Size,
+		Checksum:       stats.Checksum,
+		CompressedBits: stats.CompressedBits + 8*uint64(len(stats.table)),
+		Table:          stats.codeTable(),
+		Offset:         compressor.written,
+	}
+	if !compressor.ModTime.IsZero() {
+		entry.ModTime, entry.AccessTime = compressor.ModTime, compressor.ModTime
+	}
+	return entry
+}
+
+// Writes the compressed buffer of input i through enc, checking that the
+// input is still what the frequency pass read
+func (compressor *Compressor) encodeEntry(enc *encoder, matcher *lz77.Matcher, i int) error {
+	stats := compressor.stats[i]
+	name := archiveName(compressor.Inputs[i])
+	table := stats.codeTable()
+	if table == OwnTable {
+		err := enc.write(stats.table)
 		if err != nil {
-			fmt.Println(err)
-			return errors.New("[ERROR] Failed to write metadata to output")
+			fmt.Fprintln(compressor.Messages, err)
+			return errors.New("[ERROR] Failed to write code table to output")
 		}
-		err = compressor.Output.Write(contentBuffer.Bytes())
+		ownTable, err := key_table.CreateKeyTableFromLengths(*stats.lengths)
 		if err != nil {
-			fmt.Println(err)
-			return errors.New("[ERROR] Failed to write compressed buffer to output")
+			fmt.Fprintln(compressor.Messages, err)
+			return errors.New("[ERROR] Failed to build code table for " + name)
 		}
+		enc.useTable(ownTable)
 	}
-	err = bar.Finish()
+	reader, err := compressor.Inputs[i].Open()
 	if err != nil {
-		return errors.New("[ERROR] Failed to finish progress bar")
+		fmt.Fprintln(compressor.Messages, err)
+		return errors.New("[ERROR] Failed to open input")
+	}
+	var encoded inputStats
+	if table == BlockTables {
+		encoded, err = compressor.writeBlocks(enc, reader, stats)
+	} else if table == LZBlocks {
+		encoded, err = compressor.writeLZ(enc, matcher, reader)
+	} else {
+		encoded, err = enc.encode(reader)
+	}
+	reader.Close()
+	if table == OwnTable {
+		enc.useTable(compressor.keyTable)
+	}
+	if err != nil {
+		fmt.Fprintln(compressor.Messages, err)
+		return errors.New("[ERROR] Failed to compress " + name)
+	}
+	if encoded.Size != stats.Size || encoded.Checksum != stats.Checksum || encoded.CompressedBits != stats.CompressedBits {
+		return errors.New("[ERROR] " + name + " changed while it was being compressed")
+	}
+	// Every record ends on a byte boundary
+	err = enc.finish()
+	if err != nil {
+		fmt.Fprintln(compressor.Messages, err)
+		return errors.New("[ERROR] Failed to write compressed buffer to output")
 	}
 	return nil
 }
 
-func (compressor *Compressor) compress_buffer(input_buffer []byte) (*bytes.Buffer, int, error) {
-	var outputBuffer bytes.Buffer
-	totalBits := 0
-	outputWriter := bitstream.NewWriter(&outputBuffer)
-	for _, currentByte := range input_buffer {
-		data, err := compressor.keyTable.Get(currentByte)
-		if err != nil {
-			return nil, 0, err
-		}
-		reader := bitstream.NewReader(&data.Data)
-		for i := 0; i < data.Length; i++ {
-			nextBit, err := reader.ReadBit()
-			if err != nil {
-				fmt.Println(err)
-				return nil, 0, errors.New("[ERROR] Couldn't read data from reader bitstream")
-			}
-			err = outputWriter.WriteBit(nextBit)
-			totalBits++
-			if err != nil {
-				fmt.Println(err)
-				return nil, 0, errors.New("[ERROR] Couldn't write data to writer bitstream")
-			}
-		}
+func (compressor *Compressor) writeCentralDirectory(directory []ArchiveEntry) error {
+	var directoryBuffer bytes.Buffer
+	directoryWriter := bitstream.NewWriter(&directoryBuffer)
+	err := writeCentralDirectory(directoryWriter, directory, compressor.header)
+	if err != nil {
+		return err
+	}
+	footer := directoryFooter{
+		Offset:     compressor.written,
+		Length:     uint64(directoryBuffer.Len()),
+		NumEntries: uint64(len(directory)),
+		Checksum:   Checksum(directoryBuffer.Bytes()),
+	}
+	err = footer.Write(directoryWriter)
+	if err != nil {
+		fmt.Fprintln(compressor.Messages, err)
+		return errors.New("[ERROR] Failed to write central directory footer")
 	}
-	err := outputWriter.Flush(bitstream.Zero)
+	err = compressor.write(directoryBuffer.Bytes())
 	if err != nil {
-		return nil, 0, errors.New("[ERROR] Failed to flush bitstream")
+		fmt.Fprintln(compressor.Messages, err)
+		return errors.New("[ERROR] Failed to write central directory to output")
+	}
+	return nil
+}
+
+// Writes data to the output, keeping the archive checksum and offset up to date
+func (compressor *Compressor) write(data []byte) error {
+	compressor.checksum.Write(data)
+	compressor.written += uint64(len(data))
+	return compressor.Output.Write(data)
+}
+
+// Name an input is stored under, with forward slashes whatever the platform
+// like tar and zip, made relative the same way as tar (see storedName)
+func archiveName(inputObj input.Input) string {
+	name, _ := storedName(inputObj.GetName())
+	return name
+}
+
+// Says once for each prefix that it's being removed from names, as tar does
+func (compressor *Compressor) noteStoredName(inputObj input.Input) {
+	_, prefix := storedName(inputObj.GetName())
+	if prefix == "" || compressor.strippedPrefixes[prefix] {
+		return
+	}
+	if compressor.strippedPrefixes == nil {
+		compressor.strippedPrefixes = make(map[string]bool)
+	}
+	compressor.strippedPrefixes[prefix] = true
+	fmt.Fprintf(compressor.Messages, "[INFO] Removing leading %q from entry names\n", prefix)
+}
+
+// Puts the inputs in order of the names they're stored under and drops
+// repeats of a name, so the archive doesn't depend on the order inputs were
+// found in. Parents still come before their children.
+func (compressor *Compressor) SortInputs() {
+	sort.SliceStable(compressor.Inputs, func(i, j int) bool {
+		return archiveName(compressor.Inputs[i]) < archiveName(compressor.Inputs[j])
+	})
+	unique := compressor.Inputs[:0]
+	for _, inputObj := range compressor.Inputs {
+		if len(unique) > 0 && archiveName(unique[len(unique)-1]) == archiveName(inputObj) {
+			continue
+		}
+		unique = append(unique, inputObj)
 	}
-	return &outputBuffer, totalBits, nil
+	compressor.Inputs = unique
 }
 
 func (compressor *Compressor) AddInput(inputObj input.Input) {
@@ -1,217 +1,826 @@
 package compression
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
-	"hzip/src/huffman_tree"
+	"hash"
+	"hash/crc32"
+	"hzip/src/decode_table"
 	"hzip/src/key_table"
+	"hzip/src/tans"
+	"io"
+	"io/fs"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/dgryski/go-bitstream"
 	"github.com/schollz/progressbar/v3"
 )
 
+// Most memory set aside ahead of decoding an entry into memory, however large
+// its record says it is
+const maxPreallocation = 16 * 1024 * 1024
+
 type Decompressor struct {
 	InputFilename string
-	keyTable      key_table.KeyTable
-	reader        *bitstream.BitReader
-	tree          *huffman_tree.HuffmanTree
+	// Directory to extract entries under
+	DestDir string
+	// Leading path components removed from entry names before extracting,
+	// entries with no more than this many are skipped
+	StripComponents int
+	// Names or glob patterns of the entries to extract, everything if empty
+	Patterns []string
+	// Restore the owner and group of extracted entries
+	SameOwner bool
+	// Restore modes exactly, rather than letting the umask apply
+	SamePermissions bool
+	// Entries extracted at the same time when the archive is a file, 1 or
+	// less for one after another
+	Jobs int
+	// Where progress bars and messages go
+	Messages    io.Writer
+	header      ArchiveHeader
+	reader      *bitstream.BitReader
+	source      io.Reader // what reader reads from, used directly on byte boundaries
+	file        *os.File  // for seeking straight to entries through the central directory
+	size        int64
+	decodeTable *decode_table.DecodeTable
+	ansTable    *tans.Table
+	checksum    hash.Hash32 // running CRC32C of everything read so far
+	tablesEnd   uint64      // offset of the number of entries that follows the key table
+	// Progress through the records when reading them in order
+	started   bool
+	remaining uint64         // numInputsUnknown until the end of open-ended records
+	openEnded bool           // the records are ended by a filename length of 0
+	records   []ArchiveEntry // headers read so far, checked against the central directory
+	pending   *ArchiveEntry  // entry whose data hasn't been read or skipped yet
 }
 
+// Opens InputFilename and reads the archive header and key table. A filename
+// of "-" reads the archive from stdin instead.
 func (decompressor *Decompressor) ReadMeta() error {
+	if decompressor.InputFilename == "-" {
+		return decompressor.ReadMetaFrom(os.Stdin)
+	}
 	file, err := os.Open(decompressor.InputFilename)
 	if err != nil {
 		return errors.New("Couldn't open archive: " + decompressor.InputFilename)
 	}
-	bitsRead := 0
-	decompressor.reader = bitstream.NewReader(file)
-	numTableEntries, err := decompressor.reader.ReadBits(64)
-	bitsRead += 64
+	stat, err := file.Stat()
 	if err != nil {
-		fmt.Println("[ERROR] Couldn't read table size")
+		fmt.Fprintln(decompressor.Messages, err)
+		return errors.New("[ERROR] Couldn't stat archive: " + decompressor.InputFilename)
 	}
-	for i := 0; i < int(numTableEntries); i++ {
-		key, err := decompressor.reader.ReadByte()
-		bitsRead += 8
-		if err != nil {
-			return errors.New("[ERROR] Couldn't read key")
-		}
-		valLength, err := decompressor.reader.ReadBits(64)
-		bitsRead += 64
+	decompressor.file = file
+	decompressor.size = stat.Size()
+	err = decompressor.ReadMetaFrom(file)
+	if err != nil {
+		fmt.Fprintln(decompressor.Messages, err)
+		return errors.New("[ERROR] Invalid archive: " + decompressor.InputFilename)
+	}
+	return nil
+}
+
+// Like ReadMeta, but for an archive that can only be read in order, such as
+// a network stream. Entries can then only be reached through NextHeader.
+func (decompressor *Decompressor) ReadMetaFrom(archive io.Reader) error {
+	// Every byte read goes through the checksum so the trailer can be verified,
+	// and is counted so the records of archives without a central directory
+	// can be found again
+	decompressor.checksum = crc32.New(crcTable)
+	read := &countingWriter{writer: decompressor.checksum}
+	decompressor.source = io.TeeReader(bufio.NewReader(archive), read)
+	decompressor.reader = bitstream.NewReader(decompressor.source)
+	header, err := ReadArchiveHeader(decompressor.reader)
+	if err != nil {
+		return err
+	}
+	decompressor.header = header
+	err = decompressor.readTables()
+	decompressor.tablesEnd = read.count
+	return err
+}
+
+// Reads whatever table the archive has between its header and its records
+func (decompressor *Decompressor) readTables() error {
+	header := decompressor.header
+	if header.HasFlag(FlagAdaptive) {
+		// Codes are built up while decoding, there is no key table
+		return nil
+	}
+	if header.Coder == CoderANS {
+		table, bitsRead, err := tans.ReadTable(decompressor.reader)
 		if err != nil {
-			return errors.New("[ERROR] Couldn't read length")
+			fmt.Fprintln(decompressor.Messages, err)
+			return errors.New("[ERROR] Couldn't read tANS table")
 		}
-		var valBuffer bytes.Buffer
-		valBufferWriter := bitstream.NewWriter(&valBuffer)
-		for j := 0; j < int(valLength); j++ {
-			currentBit, err := decompressor.reader.ReadBit()
-			bitsRead++
-			if err != nil {
-				return errors.New("[ERROR] Couldn't read value")
-			}
-			err = valBufferWriter.WriteBit(currentBit)
+		if bitsRead%8 != 0 {
+			_, err := decompressor.reader.ReadBits(8 - (bitsRead % 8))
 			if err != nil {
-				return errors.New("[ERROR] Failed to write bit to stream")
+				return errors.New("[ERROR] Failed to flush bits by reading")
 			}
 		}
-		err = valBufferWriter.Flush(bitstream.Zero)
+		decompressor.ansTable = table
+		return nil
+	}
+	if header.Version < versionCodeLengths {
+		return decompressor.readCodes()
+	}
+	lengths, bitsRead, err := key_table.ReadCodeLengths(decompressor.reader)
+	if err != nil {
+		fmt.Fprintln(decompressor.Messages, err)
+		return errors.New("[ERROR] Couldn't read key table")
+	}
+	// Flush out the padding bits
+	if bitsRead%8 != 0 {
+		_, err := decompressor.reader.ReadBits(8 - (bitsRead % 8))
 		if err != nil {
-			return errors.New("[ERROR] Failed to flush bitstream")
+			return errors.New("[ERROR] Failed to flush bits by reading")
 		}
-		decompressor.keyTable.Add(key, valBuffer, int(valLength))
 	}
-	// Flush out the padding bits
+	if lengths == (key_table.CodeLengths{}) {
+		// Only empty inputs were archived, nothing will need decoding
+		return nil
+	}
+	decompressor.decodeTable, err = decode_table.CreateDecodeTable(lengths)
+	if err != nil {
+		fmt.Fprintln(decompressor.Messages, err)
+		return errors.New("[ERROR] Invalid key table")
+	}
+	return nil
+}
+
+// Reads the key table of archives from before code lengths were stored
+func (decompressor *Decompressor) readCodes() error {
+	keyTable, bitsRead, err := key_table.ReadCodes(decompressor.reader)
+	if err != nil {
+		fmt.Fprintln(decompressor.Messages, err)
+		return errors.New("[ERROR] Couldn't read key table")
+	}
 	if bitsRead%8 != 0 {
 		_, err := decompressor.reader.ReadBits(8 - (bitsRead % 8))
 		if err != nil {
 			return errors.New("[ERROR] Failed to flush bits by reading")
 		}
 	}
-	// Now we have the key table, we can convert it to a huffman tree for fast decompression lookups
-	decompressor.tree, err = decompressor.keyTable.WriteTree()
+	if len(keyTable.Table) == 0 {
+		return nil
+	}
+	if len(keyTable.Table) == 1 {
+		// A lone byte value was given an empty code, so none of its
+		// occurrences were stored. Entries of it decode to nothing, as they
+		// always did, or fail the size check if the size was stored.
+		for _, data := range keyTable.Table {
+			if data.Length == 0 {
+				return nil
+			}
+		}
+	}
+	decompressor.decodeTable, err = decode_table.CreateDecodeTableFromCodes(keyTable)
 	if err != nil {
-		fmt.Println(err)
-		return errors.New("[ERROR] Failed to generate huffman tree from key table")
+		fmt.Fprintln(decompressor.Messages, err)
+		return errors.New("[ERROR] Invalid key table")
 	}
 	return nil
 }
 
 func (decompressor Decompressor) Decompress() error {
-	// TODO possibly should collect directory structure in ReadMeta
-	reader := decompressor.reader
-	numFiles, err := reader.ReadBits(64)
+	matcher, err := createEntryMatcher(decompressor.Patterns)
+	if err != nil {
+		return err
+	}
+	directories := make([]ArchiveEntry, 0)
+	extract := func(entry ArchiveEntry, decode func(io.Writer) error) error {
+		path, ok, err := decompressor.extractPath(entry)
+		if err != nil || !ok {
+			return err
+		}
+		entry.Filename = path
+		if entry.Mode.IsDir() {
+			err := createDirectory(entry)
+			if err != nil {
+				return err
+			}
+			directories = append(directories, entry)
+			return nil
+		}
+		return decompressor.writeEntry(entry, decode)
+	}
+	if decompressor.Jobs > 1 && decompressor.file != nil {
+		err = decompressor.extractParallel(matcher.match, &directories)
+	} else if len(decompressor.Patterns) > 0 && decompressor.file != nil {
+		// Only some entries are wanted, so go straight to them
+		err = decompressor.decodeListed(matcher.match, extract)
+	} else {
+		err = decompressor.decodeEntries(matcher.match, extract)
+	}
+	if err != nil {
+		return err
+	}
+	unmatched := matcher.unmatched()
+	if len(unmatched) > 0 {
+		return errors.New("[ERROR] Not found in archive: " + strings.Join(unmatched, ", "))
+	}
+	// Parents come before their children in the archive, so going backwards
+	// finishes each directory only after nothing else will be written into it
+	for i := len(directories) - 1; i >= 0; i-- {
+		err := decompressor.restoreMeta(directories[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Where an entry is extracted to under DestDir, or false if stripping
+// components leaves nothing of its name
+func (decompressor Decompressor) extractPath(entry ArchiveEntry) (string, bool, error) {
+	name, err := cleanEntryName(entry.Filename)
+	if err != nil {
+		return "", false, err
+	}
+	name, ok := stripComponents(name, decompressor.StripComponents)
+	if !ok {
+		return "", false, nil
+	}
+	path, err := prepareExtractPath(decompressor.DestDir, name)
+	return path, err == nil, err
+}
+
+func createDirectory(entry ArchiveEntry) error {
+	// Owner write access is needed until everything inside is extracted
+	err := os.MkdirAll(entry.Filename, entry.Mode.Perm()|0o700)
 	if err != nil {
-		return errors.New("[ERROR] Couldn't get number of files")
+		return errors.New("[ERROR] Couldn't create directory " + entry.Filename)
+	}
+	return nil
+}
+
+// Decodes every entry and verifies its checksums without writing any files
+func (decompressor Decompressor) Test() error {
+	return decompressor.decodeEntries(nil, func(entry ArchiveEntry, decode func(io.Writer) error) error {
+		return decode(ioutil.Discard)
+	})
+}
+
+// Hands entries one at a time to handleEntry, along with a function that
+// decodes the entry's data into a writer and verifies it. Entries wanted
+// rejects, or whose data handleEntry doesn't decode, are skipped over; nil
+// wants everything.
+func (decompressor Decompressor) decodeEntries(wanted func(name string) bool, handleEntry func(ArchiveEntry, func(io.Writer) error) error) error {
+	numFiles, err := decompressor.start()
+	if err != nil {
+		return err
+	}
+	total := int(numFiles)
+	if decompressor.openEnded {
+		// A spinner, for lack of a total
+		total = -1
 	}
 	bar := progressbar.NewOptions(
-		int(numFiles),
+		total,
 		progressbar.OptionClearOnFinish(),
 		progressbar.OptionSetPredictTime(true),
+		progressbar.OptionSetWriter(decompressor.Messages),
 	)
-	for i := 0; i < int(numFiles); i++ {
-		err := bar.Add(1)
+	for {
+		entry, err := decompressor.NextHeader()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		err = bar.Add(1)
 		if err != nil {
 			return errors.New("[ERROR] Failed to modify progress bar status")
 		}
-		bitsRead := 0
-		filenameLen, err := reader.ReadBits(64)
-		bitsRead += 64
+		if wanted != nil && !wanted(entry.Filename) {
+			// NextHeader skips over the data
+			continue
+		}
+		err = handleEntry(entry, decompressor.ReadDataTo)
 		if err != nil {
-			return errors.New("[ERROR] Couldn't read filename length")
+			return err
 		}
-		var filenameBuffer bytes.Buffer
-		filenameWriter := bitstream.NewWriter(&filenameBuffer)
-		for j := 0; j < int(filenameLen); j++ {
-			byteObj, err := reader.ReadByte()
-			bitsRead += 8
-			if err != nil {
-				return errors.New("[ERROR] Couldn't read filename")
-			}
-			err = filenameWriter.WriteByte(byteObj)
-			if err != nil {
-				return errors.New("[ERROR] Couldn't write filename to buffer")
-			}
+	}
+	err = bar.Finish()
+	if err != nil {
+		return errors.New("[ERROR] Failed to cleanly finish progress bar")
+	}
+	return nil
+}
+
+// Like decodeEntries, but finds the wanted entries through the central
+// directory and seeks straight to them
+func (decompressor Decompressor) decodeListed(wanted func(name string) bool, handleEntry func(ArchiveEntry, func(io.Writer) error) error) error {
+	entries, err := decompressor.ReadDirectory()
+	if err != nil {
+		return err
+	}
+	for _, listed := range entries {
+		if !wanted(listed.Filename) {
+			continue
+		}
+		err = handleEntry(listed, func(writer io.Writer) error {
+			return decompressor.readEntryTo(listed, writer)
+		})
+		if err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+// Decodes the record an entry from the central directory points at. Safe to
+// call from several goroutines at once.
+func (decompressor Decompressor) ReadEntry(listed ArchiveEntry) ([]byte, error) {
+	if decompressor.file == nil {
+		return nil, errors.New("[ERROR] Entries can only be read out of order from an archive file")
+	}
+	source, entry, err := decompressor.openRecord(listed)
+	if err != nil {
+		return nil, err
+	}
+	data, _, err := decompressor.decodeEntry(source, entry)
+	return data, err
+}
 
-		// Read past the file contents, so we can cleanly get the next filename
-		bufferLen, err := reader.ReadBits(64)
-		bitsRead += 64
+// Like ReadEntry, but decodes into writer as it goes instead of into memory
+func (decompressor Decompressor) readEntryTo(listed ArchiveEntry, writer io.Writer) error {
+	if decompressor.file == nil {
+		return errors.New("[ERROR] Entries can only be read out of order from an archive file")
+	}
+	source, entry, err := decompressor.openRecord(listed)
+	if err != nil {
+		return err
+	}
+	_, err = decompressor.decodeEntryTo(source, entry, writer)
+	return err
+}
+
+// Reads the header of the record an entry from the central directory points
+// at, returning a reader positioned at its compressed buffer
+func (decompressor Decompressor) openRecord(listed ArchiveEntry) (io.Reader, ArchiveEntry, error) {
+	if listed.Offset >= uint64(decompressor.size) {
+		return nil, listed, errors.New("[ERROR] Central directory points past the end of the archive for " + listed.Filename)
+	}
+	section := io.NewSectionReader(decompressor.file, int64(listed.Offset), decompressor.size-int64(listed.Offset))
+	source := bufio.NewReader(section)
+	entry, err := ReadEntryHeader(bitstream.NewReader(source), decompressor.header)
+	if err != nil {
+		fmt.Fprintln(decompressor.Messages, err)
+		return nil, listed, errors.New("[ERROR] Couldn't read entry header of " + listed.Filename)
+	}
+	if !sameEntry(entry, decompressor.header.recordHeader(listed)) {
+		return nil, listed, errors.New("[ERROR] Record of " + listed.Filename + " doesn't match the central directory")
+	}
+	// Framed records only say what follows their data once it's read, the
+	// central directory knows already
+	return source, listed, nil
+}
+
+// Closes the archive file opened by ReadMeta
+func (decompressor Decompressor) Close() error {
+	if decompressor.file == nil {
+		return nil
+	}
+	return decompressor.file.Close()
+}
+
+// Decodes the compressed buffer of entry from source into memory and
+// verifies it, for callers that need all of the data at once. Also returns
+// the entry with what follows the data of framed records filled in.
+func (decompressor Decompressor) decodeEntry(source io.Reader, entry ArchiveEntry) ([]byte, ArchiveEntry, error) {
+	var decompressedBuffer bytes.Buffer
+	// The size comes from the archive, so it is only trusted so far
+	preallocate := entry.Size
+	if preallocate > maxPreallocation {
+		preallocate = maxPreallocation
+	}
+	decompressedBuffer.Grow(int(preallocate))
+	entry, err := decompressor.decodeEntryTo(source, entry, &decompressedBuffer)
+	if err != nil {
+		return nil, entry, err
+	}
+	return decompressedBuffer.Bytes(), entry, nil
+}
+
+// Decodes the compressed buffer of entry from source into writer, checking
+// its size and checksum as it goes instead of holding it in memory. Also
+// returns the entry with what follows the data of framed records filled in.
+func (decompressor Decompressor) decodeEntryTo(source io.Reader, entry ArchiveEntry, writer io.Writer) (ArchiveEntry, error) {
+	err := checkRecordSizes(entry)
+	if err != nil {
+		return entry, err
+	}
+	if entry.CompressedBits == 0 && !decompressor.header.framed() {
+		return entry, nil
+	}
+	checksum := crc32.New(crcTable)
+	written := &countingWriter{writer: io.MultiWriter(writer, checksum)}
+	entry, err = decompressor.decodeData(source, entry, written)
+	if err != nil {
+		fmt.Fprintln(decompressor.Messages, err)
+		return entry, errors.New("[ERROR] Failed to decode " + entry.Filename)
+	}
+	if decompressor.header.HasFlag(FlagChecksums) {
+		err = verifyDecoded(entry, written.count, checksum.Sum32())
 		if err != nil {
-			return errors.New("[ERROR] Couldn't read file length")
+			return entry, err
 		}
-		// initialize current_chunk
-		var currentChunk bytes.Buffer = *bytes.NewBuffer(make([]byte, 0))
-		currentChunkWriter := bitstream.NewWriter(&currentChunk)
-		currentChunkLen := 0
-		var decompressedBuffer bytes.Buffer = *bytes.NewBuffer(make([]byte, 0))
-		decompressedBufferWriter := bitstream.NewWriter(&decompressedBuffer)
-		for j := 0; j < int(bufferLen); j++ {
-			// Get a bit from the compressed buffer
-			bit, err := reader.ReadBit()
-			bitsRead++
-			if err != nil {
-				return errors.New("[ERROR] Couldn't seek past file buffer")
-			}
-			// Write bit to current chunk
-			err = currentChunkWriter.WriteBit(bit)
-			if err != nil {
-				return errors.New("[ERROR] Failed to write bit to stream")
-			}
-			// Increment length
-			currentChunkLen++
-			// Fill the rest with 0s
-			err = currentChunkWriter.Flush(bitstream.Zero)
-			if err != nil {
-				return errors.New("[ERROR] Failed to flush bitstream")
-			}
-			// Perform htree lookup
-			data, foundLeaf, err := decompressor.tree.Lookup(currentChunk, currentChunkLen)
-			if err != nil {
-				fmt.Println(err)
-				return errors.New("[ERROR] Overflow occurred")
-			}
-			if foundLeaf {
-				err := decompressedBufferWriter.WriteByte(data)
-				if err != nil {
-					return errors.New("[ERROR] Failed to write byte to decompressed buffer")
-				}
-				currentChunk = *bytes.NewBuffer(make([]byte, 0))
-				currentChunkWriter = bitstream.NewWriter(&currentChunk)
-			} else {
-				// Create a new buffer
-				var newBuffer bytes.Buffer = *bytes.NewBuffer(make([]byte, 0))
-				newWriter := bitstream.NewWriter(&newBuffer)
-				currentChunkReader := bitstream.NewReader(&currentChunk)
-				// Copy current_chunk to new_buffer with no padding
-				for k := 0; k < currentChunkLen; k++ {
-					bit, err = currentChunkReader.ReadBit()
-					if err != nil {
-						return errors.New("[ERROR] Couldn't transfer data")
-					}
-					err := newWriter.WriteBit(bit)
-					if err != nil {
-						return errors.New("[ERROR] Failed to write bit to stream")
-					}
-				}
-				currentChunk = newBuffer
-				currentChunkWriter = bitstream.NewWriter(&currentChunk)
-			}
+	}
+	return entry, nil
+}
+
+// Catches records whose lengths contradict each other before decoding them
+func checkRecordSizes(entry ArchiveEntry) error {
+	if entry.CompressedBits == 0 && entry.Size > 0 {
+		return fmt.Errorf("[ERROR] Record of %s claims %d bytes but has no compressed data", entry.Filename, entry.Size)
+	}
+	// LZ77 entries start with their window size (see lz.go)
+	if entry.Table == LZBlocks && entry.CompressedBits > 0 && entry.CompressedSize() < 4 {
+		return errors.New("[ERROR] Truncated LZ77 entry " + entry.Filename)
+	}
+	return nil
+}
+
+// Records, blocks and the data after a code table all start on a byte
+// boundary, so the bit reader has nothing buffered when decoding starts.
+// Returns the entry with what follows the data of framed records filled in.
+func (decompressor Decompressor) decodeData(source io.Reader, entry ArchiveEntry, writer io.Writer) (ArchiveEntry, error) {
+	coder, err := decompressor.entryCoder()
+	if err != nil {
+		return entry, err
+	}
+	if coder != nil {
+		return decompressor.decodeWithCoder(coder, source, entry, writer)
+	}
+	return entry, decompressor.decodeHuffman(source, entry, writer)
+}
+
+func (decompressor Decompressor) decodeHuffman(source io.Reader, entry ArchiveEntry, writer io.Writer) error {
+	decodeTable := decompressor.decodeTable
+	dataBits := entry.CompressedBits
+	switch entry.Table {
+	case BlockTables:
+		return decompressor.decodeBlocks(source, entry, writer)
+	case LZBlocks:
+		return decompressor.decodeLZ(source, entry, writer)
+	case OwnTable:
+		var tableBits uint64
+		var err error
+		decodeTable, tableBits, err = readCodeTable(source)
+		if err != nil {
+			return err
+		}
+		if tableBits > dataBits {
+			return errors.New("[ERROR] Code table overruns the compressed buffer")
 		}
-		// Create and write file
-		dirPath := filepath.Dir(filenameBuffer.String()) // split here
-		err = os.MkdirAll(dirPath, 0o755)                // TODO track modes in archive
+		dataBits -= tableBits
+	}
+	if decodeTable == nil {
+		return errors.New("[ERROR] Entry has data but the archive has no key table")
+	}
+	return decodeTable.Decode(source, dataBits, writer)
+}
+
+// Moves past an entry's compressed buffer without decoding it, returning the
+// entry with what follows the data of framed records filled in
+func (decompressor Decompressor) skipEntry(entry ArchiveEntry) (ArchiveEntry, error) {
+	// Records start on a byte boundary, so the bit reader has nothing buffered
+	if decompressor.header.framed() {
+		return decompressor.skipFrames(decompressor.source, entry)
+	}
+	_, err := io.CopyN(ioutil.Discard, decompressor.source, int64(entry.CompressedSize()))
+	if err != nil {
+		return entry, errors.New("[ERROR] Couldn't skip past compressed buffer of " + entry.Filename)
+	}
+	return entry, nil
+}
+
+// Creates the file an entry is extracted to and fills it with decode,
+// removing it again if that fails
+func (decompressor Decompressor) writeEntry(entry ArchiveEntry, decode func(io.Writer) error) error {
+	file, err := createEntryFile(entry)
+	if err != nil {
+		return err
+	}
+	output := bufio.NewWriter(file)
+	err = decode(output)
+	if err == nil {
+		err = output.Flush()
 		if err != nil {
-			return errors.New("[ERROR] Couldn't create directory " + dirPath)
+			err = errors.New("[ERROR] Failed to write to file")
 		}
-		file, err := os.Create(filenameBuffer.String())
+	}
+	closeErr := file.Close()
+	if err == nil && closeErr != nil {
+		err = errors.New("[ERROR] Failed to close file")
+	}
+	if err != nil {
+		// Don't leave a partly extracted file behind
+		os.Remove(entry.Filename)
+		return err
+	}
+	return decompressor.restoreMeta(entry)
+}
+
+// Decodes the record of an entry from the central directory straight into
+// the file at path, without holding its data in memory
+func (decompressor Decompressor) extractEntry(listed ArchiveEntry, path string) error {
+	entry := listed
+	entry.Filename = path
+	return decompressor.writeEntry(entry, func(writer io.Writer) error {
+		return decompressor.readEntryTo(listed, writer)
+	})
+}
+
+// Passes writes through, counting the bytes written
+type countingWriter struct {
+	writer io.Writer
+	count  uint64
+}
+
+func (counter *countingWriter) Write(data []byte) (int, error) {
+	n, err := counter.writer.Write(data)
+	counter.count += uint64(n)
+	return n, err
+}
+
+// Creates the file an entry is extracted to, along with its parent directories
+func createEntryFile(entry ArchiveEntry) (*os.File, error) {
+	dirPath := filepath.Dir(entry.Filename)
+	err := os.MkdirAll(dirPath, 0o755) // Modes of archived directories are restored later
+	if err != nil {
+		return nil, errors.New("[ERROR] Couldn't create directory " + dirPath)
+	}
+	file, err := os.OpenFile(entry.Filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, entry.Mode.Perm())
+	if err != nil {
+		return nil, errors.New("[ERROR] Couldn't open file " + entry.Filename)
+	}
+	return file, nil
+}
+
+func (decompressor Decompressor) restoreMeta(entry ArchiveEntry) error {
+	// Changing the owner can clear the setuid and setgid bits, so it goes first
+	if decompressor.SameOwner {
+		err := os.Lchown(entry.Filename, entry.OwnerID, entry.GroupID)
 		if err != nil {
-			return errors.New("[ERROR] Couldn't open file " + filenameBuffer.String())
+			fmt.Fprintln(decompressor.Messages, err)
+			return errors.New("[ERROR] Couldn't set owner of " + entry.Filename)
 		}
-		_, err = file.Write(decompressedBuffer.Bytes())
+	}
+	if decompressor.SamePermissions {
+		err := os.Chmod(entry.Filename, entry.Mode&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky))
 		if err != nil {
-			return errors.New("[ERROR] Failed to write to file")
+			fmt.Fprintln(decompressor.Messages, err)
+			return errors.New("[ERROR] Couldn't set mode of " + entry.Filename)
 		}
-		err = file.Close()
+	}
+	if entry.ModTime.IsZero() {
+		// The archive predates storing times
+		return nil
+	}
+	err := os.Chtimes(entry.Filename, entry.AccessTime, entry.ModTime)
+	if err != nil {
+		fmt.Fprintln(decompressor.Messages, err)
+		return errors.New("[ERROR] Couldn't set times of " + entry.Filename)
+	}
+	return nil
+}
+
+// Checks the archive checksum once every record has been read
+func (decompressor Decompressor) verifyTrailer() error {
+	if !decompressor.header.HasFlag(FlagChecksums) {
+		return nil
+	}
+	return verifyTrailer(decompressor.reader, decompressor.checksum.Sum32())
+}
+
+// Reads the number of entries before the first record, once. Open-ended
+// archives return numInputsUnknown.
+func (decompressor *Decompressor) start() (uint64, error) {
+	if !decompressor.started {
+		numFiles, err := decompressor.reader.ReadBits(64)
 		if err != nil {
-			return errors.New("[ERROR] Failed to close file")
+			return 0, errors.New("[ERROR] Couldn't get number of files")
 		}
+		decompressor.started = true
+		decompressor.remaining = numFiles
+		decompressor.openEnded = numFiles == numInputsUnknown && decompressor.header.Version >= versionOpenEnded
+		decompressor.records = make([]ArchiveEntry, 0)
+	}
+	return decompressor.remaining, nil
+}
 
-		// Reset byte boundary
-		if bitsRead%8 != 0 {
-			bits, err := reader.ReadBits(8 - (bitsRead % 8))
-			if bits > 0 {
-				return errors.New("[ERROR] Expected bits to be zero")
+// Reads the header of the next record, skipping the data of the previous one
+// if ReadData wasn't called for it. After the last record it checks the
+// central directory and trailer and returns io.EOF.
+//
+// Framed records (see frames.go) only give their size and checksum after
+// the data, so those are 0 in the entries returned here.
+func (decompressor *Decompressor) NextHeader() (ArchiveEntry, error) {
+	_, err := decompressor.skipPending()
+	if err != nil {
+		return ArchiveEntry{}, err
+	}
+	_, err = decompressor.start()
+	if err != nil {
+		return ArchiveEntry{}, err
+	}
+	filenameLen := uint64(0)
+	if decompressor.openEnded && decompressor.remaining != 0 {
+		filenameLen, err = decompressor.reader.ReadBits(64)
+		if err != nil {
+			return ArchiveEntry{}, errors.New("[ERROR] Couldn't read filename length")
+		}
+		if filenameLen == 0 {
+			// The end of the records
+			decompressor.remaining = 0
+		}
+	}
+	if decompressor.remaining == 0 {
+		if decompressor.records != nil {
+			if decompressor.header.Version >= versionDirectory {
+				err := decompressor.checkCentralDirectory(decompressor.records)
+				if err != nil {
+					return ArchiveEntry{}, err
+				}
 			}
+			err := decompressor.verifyTrailer()
 			if err != nil {
-				return errors.New("[ERROR] Couldn't zero out buffer")
+				return ArchiveEntry{}, err
 			}
+			decompressor.records = nil
 		}
+		return ArchiveEntry{}, io.EOF
+	}
+	var entry ArchiveEntry
+	if decompressor.openEnded {
+		entry, err = readEntryHeader(decompressor.reader, filenameLen, decompressor.header)
+	} else {
+		entry, err = ReadEntryHeader(decompressor.reader, decompressor.header)
+		decompressor.remaining--
 	}
-	err = bar.Finish()
 	if err != nil {
-		return errors.New("[ERROR] Failed to cleanly finish progress bar")
+		fmt.Fprintln(decompressor.Messages, err)
+		return ArchiveEntry{}, errors.New("[ERROR] Couldn't read entry header")
+	}
+	decompressor.records = append(decompressor.records, entry)
+	decompressor.pending = &entry
+	return entry, nil
+}
+
+// Decodes and verifies the data of the entry NextHeader last returned
+func (decompressor *Decompressor) ReadData() ([]byte, error) {
+	var data bytes.Buffer
+	err := decompressor.ReadDataTo(&data)
+	if err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+// Like ReadData, but decodes into writer as it goes, so however large the
+// entry is its data is never all held in memory. Nothing written is verified
+// until this returns.
+func (decompressor *Decompressor) ReadDataTo(writer io.Writer) error {
+	if decompressor.pending == nil {
+		return errors.New("[ERROR] No entry to read data of, call NextHeader first")
+	}
+	entry := *decompressor.pending
+	decompressor.pending = nil
+	entry, err := decompressor.decodeEntryTo(decompressor.source, entry, writer)
+	decompressor.records[len(decompressor.records)-1] = entry
+	return err
+}
+
+// Moves past the data of the entry NextHeader last returned if it hasn't
+// been read, and returns the entry as completed by what follows its data
+func (decompressor *Decompressor) skipPending() (ArchiveEntry, error) {
+	if decompressor.pending == nil {
+		if len(decompressor.records) == 0 {
+			return ArchiveEntry{}, nil
+		}
+		return decompressor.records[len(decompressor.records)-1], nil
+	}
+	entry, err := decompressor.skipEntry(*decompressor.pending)
+	decompressor.pending = nil
+	decompressor.records[len(decompressor.records)-1] = entry
+	return entry, err
+}
+
+// Reads the entries of the archive from its central directory, or from the
+// record headers if the archive can only be read in order
+func (decompressor Decompressor) List() ([]ArchiveEntry, error) {
+	if decompressor.file != nil {
+		return decompressor.ReadDirectory()
+	}
+	entries := make([]ArchiveEntry, 0)
+	for {
+		_, err := decompressor.NextHeader()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Going past the data gives framed records their sizes
+		entry, err := decompressor.skipPending()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// Finds the central directory from the end of the archive and reads it
+// without going through any of the records
+func (decompressor Decompressor) ReadDirectory() ([]ArchiveEntry, error) {
+	if decompressor.file == nil {
+		return nil, errors.New("[ERROR] The central directory can only be read from an archive file")
+	}
+	if decompressor.header.Version < versionDirectory {
+		return decompressor.scanRecords()
+	}
+	footerStart := decompressor.size - footerSize
+	if decompressor.header.HasFlag(FlagChecksums) {
+		footerStart -= trailerSize
+	}
+	if footerStart < 0 {
+		return nil, errors.New("[ERROR] Archive is too short to have a central directory")
+	}
+	footer, err := readFooter(bitstream.NewReader(io.NewSectionReader(decompressor.file, footerStart, footerSize)))
+	if err != nil {
+		return nil, err
+	}
+	if footer.Offset > uint64(footerStart) || footer.Length != uint64(footerStart)-footer.Offset {
+		return nil, errors.New("[ERROR] Central directory footer doesn't line up with the archive")
+	}
+	checksum := crc32.New(crcTable)
+	section := io.NewSectionReader(decompressor.file, int64(footer.Offset), int64(footer.Length))
+	entries, err := readCentralDirectory(io.TeeReader(bufio.NewReader(section), checksum), footer.NumEntries, decompressor.header)
+	if err != nil {
+		return nil, err
+	}
+	if checksum.Sum32() != footer.Checksum {
+		return nil, errors.New("[ERROR] Central directory checksum mismatch")
+	}
+	return entries, nil
+}
+
+// Archives from before the central directory only list their entries in the
+// record headers, so those are read one after another, skipping the data
+func (decompressor Decompressor) scanRecords() ([]ArchiveEntry, error) {
+	section := io.NewSectionReader(decompressor.file, int64(decompressor.tablesEnd), decompressor.size-int64(decompressor.tablesEnd))
+	read := &countingWriter{writer: ioutil.Discard}
+	source := io.TeeReader(bufio.NewReader(section), read)
+	reader := bitstream.NewReader(source)
+	numEntries, err := reader.ReadBits(64)
+	if err != nil {
+		return nil, errors.New("[ERROR] Couldn't get number of files")
+	}
+	entries := make([]ArchiveEntry, 0)
+	for i := uint64(0); i < numEntries; i++ {
+		offset := decompressor.tablesEnd + read.count
+		entry, err := ReadEntryHeader(reader, decompressor.header)
+		if err != nil {
+			return nil, fmt.Errorf("[ERROR] Couldn't read entry header: %v", err)
+		}
+		_, err = io.CopyN(ioutil.Discard, source, int64(entry.CompressedSize()))
+		if err != nil {
+			return nil, errors.New("[ERROR] Couldn't skip past compressed buffer of " + entry.Filename)
+		}
+		entry.Offset = offset
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Reads the central directory that follows the records when going through
+// the archive in order, and checks that it agrees with them
+func (decompressor Decompressor) checkCentralDirectory(records []ArchiveEntry) error {
+	checksum := crc32.New(crcTable)
+	listed, err := readCentralDirectory(io.TeeReader(decompressor.source, checksum), uint64(len(records)), decompressor.header)
+	if err != nil {
+		return err
+	}
+	footer, err := readFooter(decompressor.reader)
+	if err != nil {
+		return err
+	}
+	if footer.NumEntries != uint64(len(records)) || footer.Checksum != checksum.Sum32() {
+		return errors.New("[ERROR] Central directory is damaged")
+	}
+	for i, record := range records {
+		if !sameEntry(record, listed[i]) {
+			return errors.New("[ERROR] Central directory doesn't match the record of " + record.Filename)
+		}
 	}
 	return nil
 }
@@ -0,0 +1,127 @@
+package compression
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dgryski/go-bitstream"
+)
+
+/*
+	After the last record comes a central directory, so that entries can be
+	found without reading every record before them:
+	----------------------------------------------
+	for each input {
+		|--- record header (see entry.go) ---|
+		|--- byte offset of the record from the start of the archive (8 bytes) ---|
+	}
+	----------------------------------------------
+	It is followed by a fixed-size footer pointing back at it:
+	----------------------------------------------
+	|--- byte offset of the central directory (8 bytes) ---|
+	|--- length of the central directory in bytes (8 bytes) ---|
+	|--- number of entries (8 bytes) ---|
+	|--- CRC32C of the central directory (4 bytes) ---|
+	|--- magic "HZCD" (4 bytes) ---|
+	----------------------------------------------
+	Only the trailer comes after the footer, so readers that can seek find it
+	at a known distance from the end of the archive.
+*/
+
+var directoryMagic = [4]byte{'H', 'Z', 'C', 'D'}
+
+// Bytes taken up by the footer
+const footerSize = 32
+
+type directoryFooter struct {
+	Offset     uint64
+	Length     uint64
+	NumEntries uint64
+	Checksum   uint32
+}
+
+// Writes the central directory itself, entries must have their Offset set
+func writeCentralDirectory(writer *bitstream.BitWriter, entries []ArchiveEntry, archiveHeader ArchiveHeader) error {
+	for _, entry := range entries {
+		err := entry.WriteHeader(writer, archiveHeader)
+		if err != nil {
+			return fmt.Errorf("[ERROR] Failed to write central directory entry for %s: %v", entry.Filename, err)
+		}
+		err = writer.WriteBits(entry.Offset, 64)
+		if err != nil {
+			return errors.New("[ERROR] Failed to write record offset")
+		}
+	}
+	return nil
+}
+
+func readCentralDirectory(reader io.Reader, numEntries uint64, archiveHeader ArchiveHeader) ([]ArchiveEntry, error) {
+	bitReader := bitstream.NewReader(reader)
+	entries := make([]ArchiveEntry, 0)
+	for i := uint64(0); i < numEntries; i++ {
+		entry, err := ReadEntryHeader(bitReader, archiveHeader)
+		if err != nil {
+			return nil, fmt.Errorf("[ERROR] Couldn't read central directory entry: %v", err)
+		}
+		entry.Offset, err = bitReader.ReadBits(64)
+		if err != nil {
+			return nil, errors.New("[ERROR] Couldn't read record offset")
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (footer directoryFooter) Write(writer *bitstream.BitWriter) error {
+	for _, value := range []uint64{footer.Offset, footer.Length, footer.NumEntries} {
+		err := writer.WriteBits(value, 64)
+		if err != nil {
+			return errors.New("[ERROR] Failed to write central directory footer")
+		}
+	}
+	err := writer.WriteBits(uint64(footer.Checksum), 32)
+	if err != nil {
+		return errors.New("[ERROR] Failed to write central directory checksum")
+	}
+	for _, magicByte := range directoryMagic {
+		err := writer.WriteByte(magicByte)
+		if err != nil {
+			return errors.New("[ERROR] Failed to write central directory magic")
+		}
+	}
+	return nil
+}
+
+func readFooter(reader *bitstream.BitReader) (directoryFooter, error) {
+	footer := directoryFooter{}
+	for _, value := range []*uint64{&footer.Offset, &footer.Length, &footer.NumEntries} {
+		read, err := reader.ReadBits(64)
+		if err != nil {
+			return footer, errors.New("[ERROR] Couldn't read central directory footer")
+		}
+		*value = read
+	}
+	checksum, err := reader.ReadBits(32)
+	if err != nil {
+		return footer, errors.New("[ERROR] Couldn't read central directory checksum")
+	}
+	footer.Checksum = uint32(checksum)
+	for _, magicByte := range directoryMagic {
+		currentByte, err := reader.ReadByte()
+		if err != nil || currentByte != magicByte {
+			return footer, errors.New("[ERROR] Central directory footer is missing or damaged")
+		}
+	}
+	return footer, nil
+}
+
+// Checks that a directory entry describes the record it points at
+func sameEntry(record ArchiveEntry, listed ArchiveEntry) bool {
+	return record.Filename == listed.Filename &&
+		record.Mode == listed.Mode &&
+		record.Size == listed.Size &&
+		record.Checksum == listed.Checksum &&
+		record.CompressedBits == listed.CompressedBits &&
+		record.Table == listed.Table
+}
@@ -0,0 +1,168 @@
+package compression
+
+import (
+	"fmt"
+	"hash/crc32"
+	"hzip/src/key_table"
+	"io"
+)
+
+// Size of the chunks inputs are read in and compressed data is written in
+const chunkSize = 64 * 1024
+
+// What the frequency pass learns about an input, so its record header can be
+// written before the compressed data is produced
+type inputStats struct {
+	Size           uint64
+	Checksum       uint32
+	CompressedBits uint64                 // of the data alone, without table
+	histogram      *[256]uint64           // dropped once CompressedBits is known
+	table          []byte                 // code lengths of the entry's own table, nil to use the archive's
+	lengths        *key_table.CodeLengths // of the entry's own table
+	blocks         []block                // nil unless the entry is split into blocks
+	lz             bool                   // coded as LZ77 blocks
+}
+
+// Reads an input in chunks, counting how often each byte occurs overall and,
+// if blockSize isn't 0, in each block
+func scanInput(reader io.Reader, blockSize uint64) (inputStats, error) {
+	stats := inputStats{
+		histogram: new([256]uint64),
+	}
+	checksum := crc32.New(crcTable)
+	chunk := make([]byte, chunkSize)
+	for {
+		n, err := reader.Read(chunk)
+		if blockSize > 0 {
+			stats.addToBlocks(chunk[:n], blockSize)
+		} else {
+			for _, currentByte := range chunk[:n] {
+				stats.histogram[currentByte]++
+			}
+		}
+		checksum.Write(chunk[:n])
+		stats.Size += uint64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("[ERROR] Failed to read input: %v", err)
+		}
+	}
+	stats.Checksum = checksum.Sum32()
+	for _, current := range stats.blocks {
+		for symbol, count := range current.histogram {
+			stats.histogram[symbol] += count
+		}
+	}
+	if len(stats.blocks) < 2 {
+		stats.blocks = nil
+	}
+	return stats, nil
+}
+
+func (stats *inputStats) setCodeLengths(lengths key_table.CodeLengths) {
+	stats.CompressedBits = histogramBits(stats.histogram, lengths)
+	stats.histogram = nil
+}
+
+// Packs codes most significant bit first and hands the packed bytes to write
+// a chunk at a time
+type encoder struct {
+	codes   [256]uint64
+	lengths [256]uint
+	buffer  uint64 // right aligned
+	count   uint   // valid bits in buffer, always under 8 between codes
+	chunk   []byte
+	write   func([]byte) error
+}
+
+func createEncoder(table key_table.KeyTable, write func([]byte) error) *encoder {
+	enc := &encoder{
+		chunk: make([]byte, 0, chunkSize),
+		write: write,
+	}
+	enc.useTable(table)
+	return enc
+}
+
+// Switches to another table, only between entries
+func (enc *encoder) useTable(table key_table.KeyTable) {
+	enc.codes = [256]uint64{}
+	enc.lengths = [256]uint{}
+	for symbol, data := range table.Table {
+		enc.codes[symbol] = data.Code
+		enc.lengths[symbol] = uint(data.Length)
+	}
+}
+
+func (enc *encoder) writeBits(code uint64, length uint) error {
+	if length > 56 {
+		// Keep the buffer from overflowing by writing the top bits on their own
+		err := enc.writeBits(code>>32, length-32)
+		if err != nil {
+			return err
+		}
+		code, length = code&0xffffffff, 32
+	}
+	enc.buffer = enc.buffer<<length | code
+	enc.count += length
+	for enc.count >= 8 {
+		enc.count -= 8
+		enc.chunk = append(enc.chunk, byte(enc.buffer>>enc.count))
+	}
+	if len(enc.chunk) >= chunkSize-8 {
+		err := enc.write(enc.chunk)
+		if err != nil {
+			return err
+		}
+		enc.chunk = enc.chunk[:0]
+	}
+	return nil
+}
+
+// Reads an input in chunks and encodes every byte of it, returning what was
+// read so it can be checked against the frequency pass
+func (enc *encoder) encode(reader io.Reader) (inputStats, error) {
+	stats := inputStats{}
+	checksum := crc32.New(crcTable)
+	chunk := make([]byte, chunkSize)
+	for {
+		n, err := reader.Read(chunk)
+		for _, currentByte := range chunk[:n] {
+			length := enc.lengths[currentByte]
+			if length == 0 {
+				return stats, fmt.Errorf("[ERROR] Byte %d has no code in the key table", currentByte)
+			}
+			writeErr := enc.writeBits(enc.codes[currentByte], length)
+			if writeErr != nil {
+				return stats, fmt.Errorf("[ERROR] Failed to write compressed data: %v", writeErr)
+			}
+			stats.CompressedBits += uint64(length)
+		}
+		checksum.Write(chunk[:n])
+		stats.Size += uint64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("[ERROR] Failed to read input: %v", err)
+		}
+	}
+	stats.Checksum = checksum.Sum32()
+	return stats, nil
+}
+
+// Pads the last byte with zeros and writes out everything still buffered
+func (enc *encoder) finish() error {
+	if enc.count > 0 {
+		enc.chunk = append(enc.chunk, byte(enc.buffer<<(8-enc.count)))
+		enc.buffer, enc.count = 0, 0
+	}
+	if len(enc.chunk) == 0 {
+		return nil
+	}
+	err := enc.write(enc.chunk)
+	enc.chunk = enc.chunk[:0]
+	return err
+}
@@ -0,0 +1,114 @@
+package compression
+
+import (
+	"bytes"
+	"hzip/src/key_table"
+	"math/rand"
+	"testing"
+
+	"github.com/dgryski/go-bitstream"
+)
+
+// Encoder that collects whatever it writes, along with the size of each write
+func collectingEncoder() (*encoder, *bytes.Buffer, *[]int) {
+	var written bytes.Buffer
+	writes := make([]int, 0)
+	enc := createEncoder(key_table.CreateKeyTable(), func(data []byte) error {
+		written.Write(data)
+		writes = append(writes, len(data))
+		return nil
+	})
+	return enc, &written, &writes
+}
+
+type testCode struct {
+	code   uint64
+	length uint
+}
+
+// The same codes written through go-bitstream, one at a time
+func referenceBits(t *testing.T, codes []testCode) []byte {
+	var buf bytes.Buffer
+	writer := bitstream.NewWriter(&buf)
+	for _, current := range codes {
+		err := writer.WriteBits(current.code, int(current.length))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := writer.Flush(bitstream.Zero)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func writeCodes(t *testing.T, enc *encoder, codes []testCode) {
+	for _, current := range codes {
+		err := enc.writeBits(current.code, current.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := enc.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncoderCodesAcrossChunks(t *testing.T) {
+	// 13 bit codes don't line up with bytes, so some of them straddle the
+	// point where a chunk is handed on
+	random := rand.New(rand.NewSource(1))
+	codes := make([]testCode, 0)
+	for bits := 0; bits < 3*8*chunkSize; bits += 13 {
+		codes = append(codes, testCode{code: uint64(random.Intn(1 << 13)), length: 13})
+	}
+	enc, written, writes := collectingEncoder()
+	writeCodes(t, enc, codes)
+	if len(*writes) < 3 {
+		t.Errorf("got %d writes, want the output split into chunks", len(*writes))
+	}
+	for _, size := range *writes {
+		if size > chunkSize {
+			t.Errorf("write of %d bytes is larger than a chunk", size)
+		}
+	}
+	if !bytes.Equal(written.Bytes(), referenceBits(t, codes)) {
+		t.Error("chunked output doesn't match the codes written")
+	}
+}
+
+func TestEncoderLongCodes(t *testing.T) {
+	// Anything over 56 bits is written in two parts, whatever is already
+	// buffered
+	codes := []testCode{
+		{0x5, 3},
+		{0xfedcba9876543210, 64},
+		{0x1, 1},
+		{0x123456789abcdef, 57},
+		{0x3, 7},
+		{0xaaaaaaaaaaaaaaa, 60},
+	}
+	enc, written, _ := collectingEncoder()
+	writeCodes(t, enc, codes)
+	if !bytes.Equal(written.Bytes(), referenceBits(t, codes)) {
+		t.Errorf("got %x, want %x", written.Bytes(), referenceBits(t, codes))
+	}
+}
+
+func TestEncoderPadsLastByte(t *testing.T) {
+	enc, written, writes := collectingEncoder()
+	writeCodes(t, enc, []testCode{{0x5, 3}, {0x1, 2}})
+	if !bytes.Equal(written.Bytes(), []byte{0b10101000}) {
+		t.Errorf("got %08b, want the 5 bits padded with zeros", written.Bytes())
+	}
+	// Finishing again has nothing left to write
+	err := enc.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*writes) != 1 {
+		t.Errorf("got %d writes, want 1", len(*writes))
+	}
+}
@@ -0,0 +1,241 @@
+package compression
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/dgryski/go-bitstream"
+)
+
+/*
+	Every input is stored as a record header followed by its compressed buffer:
+	----------------------------------------------
+	|--- length of filename (8 bytes) ---|
+	|--- filename ($length bytes) ---|
+	|--- mode, as a Go fs.FileMode (4 bytes) ---|
+	|--- owner uid (4 bytes, all ones if unknown) ---|
+	|--- owner gid (4 bytes, all ones if unknown) ---|
+	|--- modification time, ns since the Unix epoch (8 bytes) ---|
+	|--- access time, ns since the Unix epoch (8 bytes) ---|
+	|--- uncompressed size (8 bytes) ---|
+	|--- CRC32C of uncompressed data (4 bytes, only with FlagChecksums) ---|
+	|--- code table (1 byte): 0 for the archive's, 1 if the compressed buffer
+	     starts with the entry's own code lengths, 2 if it is split into
+	     blocks (see blocks.go), 3 for LZ77 blocks (see lz.go) ---|
+	|--- length of compressed buffer (8 bytes) ---|
+	----------------------------------------------
+	Directories are stored with no data, so that their metadata can be
+	restored. The header is a whole number of bytes, so a record always starts and ends on
+	a byte boundary.
+
+	Records coded in frames (see frames.go) have 0 for the uncompressed size,
+	checksum and length of the compressed buffer here, and give the first two
+	after their data instead.
+
+	Older archives leave fields out (see header.go): the metadata before
+	version 4, the code table kind before version 6, and everything between
+	the filename and the length of the compressed buffer in version 1.
+*/
+
+// Where the codes of an entry's compressed buffer come from
+type CodeTable uint8
+
+const (
+	ArchiveTable CodeTable = iota // the table at the start of the archive
+	OwnTable                      // code lengths at the start of the compressed buffer
+	BlockTables                   // chosen block by block
+	LZBlocks                      // LZ77 blocks with tables of their own
+)
+
+// Longest filename a record can have, so that a damaged archive can't make
+// the reader allocate any amount of memory for one
+const MaxFilenameLength = 4096
+
+// Mode of entries from archives that don't store one, which were always
+// extracted as files created with the default permissions
+const legacyMode fs.FileMode = 0o644
+
+type ArchiveEntry struct {
+	Filename       string
+	Mode           fs.FileMode
+	OwnerID        int // -1 if unknown
+	GroupID        int // -1 if unknown
+	ModTime        time.Time
+	AccessTime     time.Time
+	Size           uint64 // bytes, 0 if the archive doesn't store it or its record header leaves it out
+	Checksum       uint32
+	CompressedBits uint64 // own code table and block headers included
+	Table          CodeTable
+	Offset         uint64 // of the record in the archive, only known from the central directory
+}
+
+// Number of bytes the compressed buffer takes up in the archive, padding included
+func (entry ArchiveEntry) CompressedSize() uint64 {
+	return (entry.CompressedBits + 7) / 8
+}
+
+func (entry ArchiveEntry) WriteHeader(writer *bitstream.BitWriter, archiveHeader ArchiveHeader) error {
+	// TODO Compress filenames too
+	if len(entry.Filename) > MaxFilenameLength {
+		return fmt.Errorf("[ERROR] Filename of %d bytes is longer than the limit of %d", len(entry.Filename), MaxFilenameLength)
+	}
+	err := writer.WriteBits(uint64(len(entry.Filename)), 64)
+	if err != nil {
+		return errors.New("[ERROR] Failed to write filename length")
+	}
+	for _, character := range []byte(entry.Filename) {
+		err := writer.WriteByte(character)
+		if err != nil {
+			return errors.New("[ERROR] Failed to write filename")
+		}
+	}
+	err = writer.WriteBits(uint64(entry.Mode), 32)
+	if err != nil {
+		return errors.New("[ERROR] Failed to write mode")
+	}
+	err = writer.WriteBits(uint64(idToBits(entry.OwnerID)), 32)
+	if err != nil {
+		return errors.New("[ERROR] Failed to write owner")
+	}
+	err = writer.WriteBits(uint64(idToBits(entry.GroupID)), 32)
+	if err != nil {
+		return errors.New("[ERROR] Failed to write group")
+	}
+	err = writer.WriteBits(uint64(entry.ModTime.UnixNano()), 64)
+	if err != nil {
+		return errors.New("[ERROR] Failed to write modification time")
+	}
+	err = writer.WriteBits(uint64(entry.AccessTime.UnixNano()), 64)
+	if err != nil {
+		return errors.New("[ERROR] Failed to write access time")
+	}
+	err = writer.WriteBits(entry.Size, 64)
+	if err != nil {
+		return errors.New("[ERROR] Failed to write uncompressed size")
+	}
+	if archiveHeader.HasFlag(FlagChecksums) {
+		err = writer.WriteBits(uint64(entry.Checksum), 32)
+		if err != nil {
+			return errors.New("[ERROR] Failed to write checksum")
+		}
+	}
+	err = writer.WriteByte(byte(entry.Table))
+	if err != nil {
+		return errors.New("[ERROR] Failed to write code table kind")
+	}
+	err = writer.WriteBits(entry.CompressedBits, 64)
+	if err != nil {
+		return errors.New("[ERROR] Failed to write compressed buffer length")
+	}
+	return nil
+}
+
+func ReadEntryHeader(reader *bitstream.BitReader, archiveHeader ArchiveHeader) (ArchiveEntry, error) {
+	filenameLen, err := reader.ReadBits(64)
+	if err != nil {
+		return ArchiveEntry{}, errors.New("[ERROR] Couldn't read filename length")
+	}
+	return readEntryHeader(reader, filenameLen, archiveHeader)
+}
+
+// Reads the rest of a record header after its filename length
+func readEntryHeader(reader *bitstream.BitReader, filenameLen uint64, archiveHeader ArchiveHeader) (ArchiveEntry, error) {
+	entry := ArchiveEntry{}
+	var err error
+	if filenameLen > MaxFilenameLength {
+		return entry, fmt.Errorf("[ERROR] Filename length %d is longer than the limit of %d", filenameLen, MaxFilenameLength)
+	}
+	filename := make([]byte, filenameLen)
+	for i := range filename {
+		filename[i], err = reader.ReadByte()
+		if err != nil {
+			return entry, errors.New("[ERROR] Couldn't read filename")
+		}
+	}
+	entry.Filename = string(filename)
+	if archiveHeader.Version >= versionMetadata {
+		err = readEntryMeta(reader, &entry)
+		if err != nil {
+			return entry, err
+		}
+	} else {
+		entry.Mode = legacyMode
+		entry.OwnerID, entry.GroupID = -1, -1
+	}
+	if archiveHeader.Version >= versionRecordSizes {
+		entry.Size, err = reader.ReadBits(64)
+		if err != nil {
+			return entry, errors.New("[ERROR] Couldn't read uncompressed size")
+		}
+	}
+	if archiveHeader.HasFlag(FlagChecksums) {
+		checksum, err := reader.ReadBits(32)
+		if err != nil {
+			return entry, errors.New("[ERROR] Couldn't read checksum")
+		}
+		entry.Checksum = uint32(checksum)
+	}
+	if archiveHeader.Version >= versionCodeTables {
+		table, err := reader.ReadByte()
+		if err != nil {
+			return entry, errors.New("[ERROR] Couldn't read code table kind")
+		}
+		entry.Table = CodeTable(table)
+		if entry.Table > archiveHeader.lastCodeTable() {
+			return entry, fmt.Errorf("[ERROR] Unknown code table kind %d", table)
+		}
+	}
+	entry.CompressedBits, err = reader.ReadBits(64)
+	if err != nil {
+		return entry, errors.New("[ERROR] Couldn't read compressed buffer length")
+	}
+	return entry, nil
+}
+
+// Reads the mode, ownership and times that records have had since version 4
+func readEntryMeta(reader *bitstream.BitReader, entry *ArchiveEntry) error {
+	mode, err := reader.ReadBits(32)
+	if err != nil {
+		return errors.New("[ERROR] Couldn't read mode")
+	}
+	entry.Mode = fs.FileMode(mode)
+	ownerID, err := reader.ReadBits(32)
+	if err != nil {
+		return errors.New("[ERROR] Couldn't read owner")
+	}
+	entry.OwnerID = idFromBits(uint32(ownerID))
+	groupID, err := reader.ReadBits(32)
+	if err != nil {
+		return errors.New("[ERROR] Couldn't read group")
+	}
+	entry.GroupID = idFromBits(uint32(groupID))
+	modTime, err := reader.ReadBits(64)
+	if err != nil {
+		return errors.New("[ERROR] Couldn't read modification time")
+	}
+	entry.ModTime = time.Unix(0, int64(modTime))
+	accessTime, err := reader.ReadBits(64)
+	if err != nil {
+		return errors.New("[ERROR] Couldn't read access time")
+	}
+	entry.AccessTime = time.Unix(0, int64(accessTime))
+	return nil
+}
+
+const unknownID = 0xffffffff
+
+func idToBits(id int) uint32 {
+	if id < 0 {
+		return unknownID
+	}
+	return uint32(id)
+}
+
+func idFromBits(bits uint32) int {
+	if bits == unknownID {
+		return -1
+	}
+	return int(bits)
+}
@@ -3,19 +3,27 @@ package compression
 import (
 	"hzip/src/input"
 	"hzip/src/key_table"
+	"os"
 )
 
 func CreateCompressor() Compressor {
 	return Compressor{
-		Inputs: make([]input.Input, 0),
-		Output: nil,
+		Inputs:        make([]input.Input, 0),
+		Output:        nil,
+		MaxCodeLength: key_table.DefaultMaxCodeLength,
+		BlockSize:     DefaultBlockSize,
+		Messages:      os.Stdout,
 	}
 }
 
 func CreateDecompressor(filename string) Decompressor {
 	return Decompressor{
 		InputFilename: filename,
-		keyTable:      key_table.CreateKeyTable(),
-		reader:        nil,
+		DestDir:       ".",
+		// Like tar, only try to restore ownership when running as root
+		SameOwner:       os.Geteuid() == 0,
+		SamePermissions: true,
+		Messages:        os.Stdout,
+		reader:          nil,
 	}
 }
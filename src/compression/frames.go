@@ -0,0 +1,261 @@
+package compression
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+/*
+	Entries coded by an entry coder (see coder.go) are split into frames, so
+	that they can be written as they are read without knowing how long they
+	are. The compressed buffer of such a record is:
+	----------------------------------------------
+	for each frame {
+		|--- bytes of input in the frame, 1 to 64K (4 bytes) ---|
+		|--- length of coded frame in bits (4 bytes) ---|
+		|--- coded frame ---|
+		|--- 0 until edge of byte boundary ---|
+	}
+	|--- 0 (4 bytes) ---|
+	|--- uncompressed size (8 bytes) ---|
+	|--- CRC32C of uncompressed data (4 bytes, only with FlagChecksums) ---|
+	----------------------------------------------
+	The record header has 0 for the uncompressed size, checksum and length of
+	the compressed buffer. The central directory has the real ones, the
+	length covering everything above.
+*/
+
+// Most input bytes a frame can hold
+const maxFrameSize = 64 * 1024
+
+// Codes input i frame by frame, handing the frames and what follows them to
+// write as soon as each is done
+func (compressor *Compressor) encodeFrames(coder entryCoder, i int, write func([]byte) error) (inputStats, error) {
+	reader, err := compressor.Inputs[i].Open()
+	if err != nil {
+		fmt.Fprintln(compressor.Messages, err)
+		return inputStats{}, errors.New("[ERROR] Failed to open input")
+	}
+	defer reader.Close()
+	frames := compressor.createFrameWriter(coder, write)
+	chunk := make([]byte, maxFrameSize)
+	for {
+		n, readErr := io.ReadFull(reader, chunk)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			fmt.Fprintln(compressor.Messages, readErr)
+			return inputStats{}, errors.New("[ERROR] Failed to read data from input")
+		}
+		_, err := frames.Write(chunk[:n])
+		if err != nil {
+			return inputStats{}, err
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	stats, err := frames.finish()
+	if err != nil {
+		return stats, err
+	}
+	if !compressor.adaptive() {
+		scanned := compressor.stats[i]
+		if stats.Size != scanned.Size || stats.Checksum != scanned.Checksum {
+			return stats, errors.New("[ERROR] " + archiveName(compressor.Inputs[i]) + " changed while it was being compressed")
+		}
+	}
+	return stats, nil
+}
+
+// Splits the data written to it into frames and codes each one as soon as
+// it's full, so an entry can be coded without knowing how long it is
+type frameWriter struct {
+	compressor *Compressor
+	enc        entryEncoder
+	write      func([]byte) error
+	frame      bytes.Buffer // coded frame waiting for its header
+	chunk      []byte       // input of the frame being filled
+	checksum   hash.Hash32
+	stats      inputStats
+	written    uint64 // bytes of frames written so far
+}
+
+func (compressor *Compressor) createFrameWriter(coder entryCoder, write func([]byte) error) *frameWriter {
+	frames := &frameWriter{
+		compressor: compressor,
+		write:      write,
+		chunk:      make([]byte, 0, maxFrameSize),
+		checksum:   crc32.New(crcTable),
+	}
+	frames.enc = coder.newEncoder(func(data []byte) error {
+		_, err := frames.frame.Write(data)
+		return err
+	})
+	return frames
+}
+
+func (frames *frameWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		if len(frames.chunk) == 0 && len(data) >= maxFrameSize {
+			// A whole frame, no need to copy it
+			err := frames.encodeFrame(data[:maxFrameSize])
+			if err != nil {
+				return written, err
+			}
+			data = data[maxFrameSize:]
+			written += maxFrameSize
+			continue
+		}
+		n := maxFrameSize - len(frames.chunk)
+		if n > len(data) {
+			n = len(data)
+		}
+		frames.chunk = append(frames.chunk, data[:n]...)
+		data = data[n:]
+		written += n
+		if len(frames.chunk) == maxFrameSize {
+			err := frames.encodeFrame(frames.chunk)
+			if err != nil {
+				return written, err
+			}
+			frames.chunk = frames.chunk[:0]
+		}
+	}
+	return written, nil
+}
+
+// Codes one frame and writes it with its header
+func (frames *frameWriter) encodeFrame(data []byte) error {
+	frames.frame.Reset()
+	bits, err := frames.enc.encode(data)
+	if err == nil && bits > math.MaxUint32 {
+		err = fmt.Errorf("[ERROR] Frame took %d bits, more than its header can hold", bits)
+	}
+	var frameHeader [8]byte
+	binary.BigEndian.PutUint32(frameHeader[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(frameHeader[4:], uint32(bits))
+	if err == nil {
+		err = frames.write(frameHeader[:])
+	}
+	if err == nil {
+		err = frames.write(frames.frame.Bytes())
+	}
+	if err != nil {
+		fmt.Fprintln(frames.compressor.Messages, err)
+		return errors.New("[ERROR] Failed to write compressed data")
+	}
+	frames.written += uint64(len(frameHeader) + frames.frame.Len())
+	frames.checksum.Write(data)
+	frames.stats.Size += uint64(len(data))
+	return nil
+}
+
+// Codes what's left of the input as the last frame and writes what follows
+// the frames, returning the size, checksum and length of the whole
+func (frames *frameWriter) finish() (inputStats, error) {
+	if len(frames.chunk) > 0 {
+		err := frames.encodeFrame(frames.chunk)
+		if err != nil {
+			return frames.stats, err
+		}
+		frames.chunk = frames.chunk[:0]
+	}
+	frames.stats.Checksum = frames.checksum.Sum32()
+	// The frame size of 0 that ends the frames, then the size and checksum
+	trailer := make([]byte, 16)
+	binary.BigEndian.PutUint64(trailer[4:], frames.stats.Size)
+	binary.BigEndian.PutUint32(trailer[12:], frames.stats.Checksum)
+	if !frames.compressor.header.HasFlag(FlagChecksums) {
+		trailer = trailer[:12]
+	}
+	err := frames.write(trailer)
+	if err != nil {
+		fmt.Fprintln(frames.compressor.Messages, err)
+		return frames.stats, errors.New("[ERROR] Failed to write compressed data")
+	}
+	frames.stats.CompressedBits = 8 * (frames.written + uint64(len(trailer)))
+	return frames.stats, nil
+}
+
+// Decodes the frames of an entry, returning it with the size and checksum
+// that follow them
+func (decompressor Decompressor) decodeFrames(coder entryCoder, source io.Reader, entry ArchiveEntry, writer io.Writer) (ArchiveEntry, error) {
+	dec := coder.newDecoder()
+	return readFrames(source, entry, decompressor.header, func(size uint64, numBits uint64) error {
+		return dec.decode(source, numBits, size, writer)
+	})
+}
+
+// Moves past the frames of an entry without decoding them, returning it with
+// the size and checksum that follow them
+func (decompressor Decompressor) skipFrames(source io.Reader, entry ArchiveEntry) (ArchiveEntry, error) {
+	return readFrames(source, entry, decompressor.header, func(size uint64, numBits uint64) error {
+		_, err := io.CopyN(ioutil.Discard, source, int64((numBits+7)/8))
+		if err != nil {
+			return errors.New("[ERROR] Couldn't skip past frame of " + entry.Filename)
+		}
+		return nil
+	})
+}
+
+// Reads the frame headers of a record, handing each frame to handleFrame to
+// consume, then what follows the frames. An entry from the central directory
+// already has the sizes and checksum, which have to match.
+func readFrames(source io.Reader, entry ArchiveEntry, archiveHeader ArchiveHeader, handleFrame func(size uint64, numBits uint64) error) (ArchiveEntry, error) {
+	read := uint64(0)
+	size := uint64(0)
+	for {
+		var field [4]byte
+		_, err := io.ReadFull(source, field[:])
+		if err != nil {
+			return entry, errors.New("[ERROR] Couldn't read frame header")
+		}
+		frameSize := uint64(binary.BigEndian.Uint32(field[:]))
+		read += 4
+		if frameSize == 0 {
+			break
+		}
+		if frameSize > maxFrameSize {
+			return entry, fmt.Errorf("[ERROR] Frame of %d bytes is larger than the limit of %d", frameSize, maxFrameSize)
+		}
+		_, err = io.ReadFull(source, field[:])
+		if err != nil {
+			return entry, errors.New("[ERROR] Couldn't read frame length")
+		}
+		frameBits := uint64(binary.BigEndian.Uint32(field[:]))
+		err = handleFrame(frameSize, frameBits)
+		if err != nil {
+			return entry, err
+		}
+		read += 4 + (frameBits+7)/8
+		size += frameSize
+	}
+	trailer := make([]byte, 8, 12)
+	if archiveHeader.HasFlag(FlagChecksums) {
+		trailer = trailer[:12]
+	}
+	_, err := io.ReadFull(source, trailer)
+	if err != nil {
+		return entry, errors.New("[ERROR] Couldn't read size after the frames of " + entry.Filename)
+	}
+	completed := entry
+	completed.Size = binary.BigEndian.Uint64(trailer)
+	if archiveHeader.HasFlag(FlagChecksums) {
+		completed.Checksum = binary.BigEndian.Uint32(trailer[8:])
+	}
+	completed.CompressedBits = 8 * (read + uint64(len(trailer)))
+	if completed.Size != size {
+		return entry, fmt.Errorf("[ERROR] Frames of %s add up to %d bytes, not the %d after them", entry.Filename, size, completed.Size)
+	}
+	if entry.CompressedBits != 0 && !sameEntry(completed, entry) {
+		return entry, errors.New("[ERROR] Record of " + entry.Filename + " doesn't match the central directory")
+	}
+	return completed, nil
+}
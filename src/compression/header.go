@@ -0,0 +1,193 @@
+package compression
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dgryski/go-bitstream"
+)
+
+/*
+	Every archive starts with a fixed-size header:
+	----------------------------------------------
+	|--- magic "HZIP" (4 bytes) ---|
+	|--- format version (2 bytes) ---|
+	|--- feature flags (4 bytes) ---|
+	|--- entropy coder (1 byte, see coder.go) ---|
+	----------------------------------------------
+	The version is bumped whenever the layout after the header changes in a way
+	older readers can't follow. Flags mark optional features; a reader refuses
+	any flag it doesn't know about.
+
+	Archives of every earlier version can still be read. What each one changed:
+	1  codes stored bit by bit in the key table, records with only a name and
+	   the length of the compressed buffer, no entropy coder byte
+	2  uncompressed size in records, FlagChecksums
+	3  key table stored as canonical code lengths
+	4  mode, owner and times in records
+	5  central directory
+	6  code table kind in records
+	7  block tables
+	8  LZ77 blocks, FlagAdaptive
+	9  entropy coder byte
+	10 records of entropy coders other than static Huffman split into frames,
+	   with the size and checksum after the data (see frames.go)
+	11 tANS frames say which table they're coded with (see ans.go)
+	12 records ended by a filename length of 0 when the number of inputs is
+	   all ones (see incremental.go)
+*/
+
+var MagicBytes = [4]byte{'H', 'Z', 'I', 'P'}
+
+const FormatVersion uint16 = 12
+
+// First version with each change to the layout, as listed above
+const (
+	versionRecordSizes uint16 = 2
+	versionCodeLengths uint16 = 3
+	versionMetadata    uint16 = 4
+	versionDirectory   uint16 = 5
+	versionCodeTables  uint16 = 6
+	versionBlocks      uint16 = 7
+	versionLZ          uint16 = 8
+	versionCoder       uint16 = 9
+	versionFrames      uint16 = 10
+	versionFrameTables uint16 = 11
+	versionOpenEnded   uint16 = 12
+)
+
+const (
+	// Records carry a CRC32C of their uncompressed data and the archive ends
+	// with a CRC32C of everything before it
+	FlagChecksums uint32 = 1 << iota
+	// There is no key table and records are coded with adaptive Huffman
+	// codes instead (see adaptive.go)
+	FlagAdaptive
+)
+
+// Mask of every feature flag this build understands
+const SupportedFlags uint32 = FlagChecksums | FlagAdaptive
+
+type ArchiveHeader struct {
+	Version uint16
+	Flags   uint32
+	Coder   Coder
+}
+
+func CreateArchiveHeader() ArchiveHeader {
+	return ArchiveHeader{
+		Version: FormatVersion,
+		Flags:   FlagChecksums,
+	}
+}
+
+func (header ArchiveHeader) HasFlag(flag uint32) bool {
+	return header.Flags&flag == flag
+}
+
+// Mask of the feature flags archives of a version can have
+func supportedFlags(version uint16) uint32 {
+	switch {
+	case version >= versionLZ:
+		return SupportedFlags
+	case version >= versionRecordSizes:
+		return FlagChecksums
+	}
+	return 0
+}
+
+// Last code table kind records of the archive can have
+func (header ArchiveHeader) lastCodeTable() CodeTable {
+	switch {
+	case header.Version >= versionLZ:
+		return LZBlocks
+	case header.Version >= versionBlocks:
+		return BlockTables
+	case header.Version >= versionCodeTables:
+		return OwnTable
+	}
+	return ArchiveTable
+}
+
+// Whether records are split into frames with their size and checksum after
+// the data, so they could be written without knowing either up front
+func (header ArchiveHeader) framed() bool {
+	return header.Version >= versionFrames && (header.HasFlag(FlagAdaptive) || header.Coder == CoderANS)
+}
+
+// What the record header of an entry holds. Framed records leave out
+// everything that only follows their data.
+func (header ArchiveHeader) recordHeader(entry ArchiveEntry) ArchiveEntry {
+	if header.framed() {
+		entry.Size, entry.Checksum, entry.CompressedBits = 0, 0, 0
+	}
+	return entry
+}
+
+func (header ArchiveHeader) Write(writer *bitstream.BitWriter) error {
+	for _, magicByte := range MagicBytes {
+		err := writer.WriteByte(magicByte)
+		if err != nil {
+			return errors.New("[ERROR] Failed to write magic bytes")
+		}
+	}
+	err := writer.WriteBits(uint64(header.Version), 16)
+	if err != nil {
+		return errors.New("[ERROR] Failed to write format version")
+	}
+	err = writer.WriteBits(uint64(header.Flags), 32)
+	if err != nil {
+		return errors.New("[ERROR] Failed to write feature flags")
+	}
+	err = writer.WriteByte(byte(header.Coder))
+	if err != nil {
+		return errors.New("[ERROR] Failed to write entropy coder")
+	}
+	return nil
+}
+
+func ReadArchiveHeader(reader *bitstream.BitReader) (ArchiveHeader, error) {
+	header := ArchiveHeader{}
+	for _, magicByte := range MagicBytes {
+		currentByte, err := reader.ReadByte()
+		if err != nil || currentByte != magicByte {
+			return header, errors.New("[ERROR] Not an hzip archive")
+		}
+	}
+	version, err := reader.ReadBits(16)
+	if err != nil {
+		return header, errors.New("[ERROR] Couldn't read format version")
+	}
+	header.Version = uint16(version)
+	if header.Version == 0 || header.Version > FormatVersion {
+		return header, fmt.Errorf("[ERROR] Unsupported archive format version %d (this build reads versions 1 to %d)", header.Version, FormatVersion)
+	}
+	flags, err := reader.ReadBits(32)
+	if err != nil {
+		return header, errors.New("[ERROR] Couldn't read feature flags")
+	}
+	header.Flags = uint32(flags)
+	unsupported := header.Flags &^ supportedFlags(header.Version)
+	if unsupported != 0 {
+		return header, fmt.Errorf("[ERROR] Archive uses unsupported feature flags 0x%08x", unsupported)
+	}
+	if header.Version < versionCoder {
+		// Only the Huffman coder existed, adaptive or not
+		return header, nil
+	}
+	coder, err := reader.ReadByte()
+	if err != nil {
+		return header, errors.New("[ERROR] Couldn't read entropy coder")
+	}
+	header.Coder = Coder(coder)
+	if header.Coder > CoderANS {
+		return header, fmt.Errorf("[ERROR] Archive uses unsupported entropy coder %d", header.Coder)
+	}
+	if header.Coder == CoderRange && !header.HasFlag(FlagAdaptive) {
+		return header, errors.New("[ERROR] Range coded archive isn't flagged adaptive")
+	}
+	if header.Coder == CoderANS && header.HasFlag(FlagAdaptive) {
+		return header, errors.New("[ERROR] tANS coded archive can't be adaptive")
+	}
+	return header, nil
+}
@@ -0,0 +1,139 @@
+package compression
+
+import (
+	"errors"
+	"fmt"
+	"hzip/src/input"
+	"math"
+)
+
+/*
+	Entries can also be added to an archive one at a time, each written out
+	as soon as its data has been, instead of all being read from Inputs. The
+	number of entries isn't known when the archive is started, so it's written
+	as all ones and the records run until a filename length of 0:
+	----------------------------------------------
+	|--- archive header and key table, as usual ---|
+	|--- all ones (8 bytes) ---|
+	for each entry {
+		|--- record (see compressor.go) ---|
+	}
+	|--- 0 (8 bytes) ---|
+	|--- central directory and trailer, as usual ---|
+	----------------------------------------------
+	Entry names are never empty, so a record can't start with a filename
+	length of 0. Only coders that need nothing from an entry before coding it,
+	those of adaptive archives, can add entries this way.
+*/
+
+// Number of inputs written when entries are added one at a time
+const numInputsUnknown uint64 = math.MaxUint64
+
+// Starts an archive that entries are added to with CreateEntry instead of
+// coming from Inputs, for which GenerateScheme isn't needed. Only adaptive
+// archives (Adaptive or CoderRange) can be written this way.
+func (compressor *Compressor) StartArchive() error {
+	if !compressor.adaptive() {
+		return errors.New("[ERROR] Entries can only be added one at a time to adaptive archives")
+	}
+	compressor.Inputs = make([]input.Input, 0)
+	compressor.stats = make([]inputStats, 0)
+	coder, err := compressor.entryCoder()
+	if err != nil {
+		return err
+	}
+	compressor.coder = coder
+	err = compressor.openOutput()
+	if err != nil {
+		return err
+	}
+	err = compressor.writeStart(numInputsUnknown)
+	if err != nil {
+		compressor.Output.Abort()
+		return err
+	}
+	return nil
+}
+
+// Writes the record header of a new entry, whose data is then written to the
+// returned EntryWriter. It has to be closed before the next entry is created.
+func (compressor *Compressor) CreateEntry(name string, meta input.Meta) (*EntryWriter, error) {
+	if !compressor.openEnded {
+		return nil, errors.New("[ERROR] Entries can only be created after StartArchive")
+	}
+	if compressor.entry != nil {
+		return nil, errors.New("[ERROR] Previous entry has to be closed before creating another")
+	}
+	if name == "" {
+		return nil, errors.New("[ERROR] Entry must have a name")
+	}
+	inputObj := input.MemoryInput{Name: name, Meta: meta}
+	compressor.noteStoredName(inputObj)
+	compressor.Inputs = append(compressor.Inputs, inputObj)
+	compressor.stats = append(compressor.stats, inputStats{})
+	i := len(compressor.Inputs) - 1
+	entry, err := compressor.startRecord(i)
+	if err != nil {
+		return nil, err
+	}
+	compressor.entry = &EntryWriter{
+		compressor: compressor,
+		i:          i,
+		entry:      entry,
+		frames:     compressor.createFrameWriter(compressor.coder, compressor.write),
+	}
+	return compressor.entry, nil
+}
+
+// Writes the end of the records, the central directory and the trailer after
+// the entries added with CreateEntry, and closes the output
+func (compressor *Compressor) FinishArchive() error {
+	if !compressor.openEnded {
+		return errors.New("[ERROR] Archive wasn't started with StartArchive")
+	}
+	if compressor.entry != nil {
+		return errors.New("[ERROR] Last entry has to be closed before finishing the archive")
+	}
+	err := compressor.writeEnd()
+	if err != nil {
+		compressor.Output.Abort()
+		return err
+	}
+	compressor.openEnded = false
+	err = compressor.Output.Close()
+	if err != nil {
+		fmt.Fprintln(compressor.Messages, err)
+		return errors.New("[ERROR] Failed to close output")
+	}
+	return nil
+}
+
+// Codes the data of an entry from CreateEntry frame by frame as it's written
+type EntryWriter struct {
+	compressor *Compressor
+	i          int
+	entry      ArchiveEntry
+	frames     *frameWriter
+}
+
+func (writer *EntryWriter) Write(data []byte) (int, error) {
+	if writer.compressor.entry != writer {
+		return 0, errors.New("[ERROR] Write to an entry that was already closed")
+	}
+	return writer.frames.Write(data)
+}
+
+// Codes what's left of the entry and finishes its record
+func (writer *EntryWriter) Close() error {
+	if writer.compressor.entry != writer {
+		return nil
+	}
+	writer.compressor.entry = nil
+	stats, err := writer.frames.finish()
+	if err != nil {
+		return err
+	}
+	writer.compressor.stats[writer.i] = stats
+	writer.compressor.finishRecord(writer.i, writer.entry)
+	return nil
+}
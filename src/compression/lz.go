@@ -0,0 +1,412 @@
+package compression
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hzip/src/key_table"
+	"hzip/src/lz77"
+	"io"
+
+	"github.com/dgryski/go-bitstream"
+)
+
+/*
+	With an LZ77 window set, the compressed buffer of an entry holds its data
+	as literals and matches, split into blocks that each have their own tables:
+	----------------------------------------------
+	|--- window size in bytes (4 bytes) ---|
+	for each block {
+		|--- uncompressed size (4 bytes) ---|
+		|--- number of matches (4 bytes) ---|
+		for the literals, literal runs, match lengths and distances {
+			|--- code lengths, padded to a byte ---|
+			|--- length of the coded stream in bits (4 bytes) ---|
+			|--- coded stream ---|
+			|--- 0 until edge of byte boundary ---|
+		}
+		|--- length of the extra bits in bits (4 bytes) ---|
+		|--- extra bits ---|
+		|--- 0 until edge of byte boundary ---|
+	}
+	----------------------------------------------
+	Each match is coded as the number of literals before it, its length less
+	lz77.MinMatch and its distance less one. All three go through
+	lz77.EncodeValue, with the extra bits of a match stored together in the
+	order run, length, distance. The literals after the last match of a block
+	are whatever is left over.
+*/
+
+// Default window for --lz without a size
+const DefaultLZWindow = 256 * 1024
+
+// The streams of a block, each coded with its own table
+const (
+	lzLiterals = iota
+	lzRuns
+	lzLengths
+	lzDistances
+	lzStreams
+)
+
+type lzExtra struct {
+	value uint32
+	bits  uint
+}
+
+// A block turned into literals and matches, ready to be coded
+type lzBlock struct {
+	Size      int
+	Matches   int
+	streams   [lzStreams][]byte
+	extra     []lzExtra
+	extraBits uint64
+}
+
+type lzTable struct {
+	stored  []byte // code lengths as written before the stream
+	lengths key_table.CodeLengths
+	bits    uint64 // of the coded stream
+}
+
+func createLZBlock(data []byte, matches []lz77.Match) lzBlock {
+	block := lzBlock{
+		Size:  len(data),
+		extra: make([]lzExtra, 0, 3*len(matches)),
+	}
+	pos := 0
+	for _, match := range matches {
+		block.streams[lzLiterals] = append(block.streams[lzLiterals], data[pos:pos+match.Literals]...)
+		pos += match.Literals
+		if match.Length == 0 {
+			continue
+		}
+		block.Matches++
+		block.addValue(lzRuns, uint32(match.Literals))
+		block.addValue(lzLengths, uint32(match.Length-lz77.MinMatch))
+		block.addValue(lzDistances, uint32(match.Distance-1))
+		pos += match.Length
+	}
+	return block
+}
+
+func (block *lzBlock) addValue(stream int, value uint32) {
+	symbol, extra, extraBits := lz77.EncodeValue(value)
+	block.streams[stream] = append(block.streams[stream], symbol)
+	if extraBits > 0 {
+		block.extra = append(block.extra, lzExtra{value: extra, bits: extraBits})
+		block.extraBits += uint64(extraBits)
+	}
+}
+
+// Bytes a block takes up once coded with the given tables
+func (block lzBlock) codedSize(tables [lzStreams]lzTable) uint64 {
+	size := uint64(8)
+	for _, table := range tables {
+		size += uint64(len(table.stored)) + 4 + (table.bits+7)/8
+	}
+	return size + 4 + (block.extraBits+7)/8
+}
+
+func (compressor *Compressor) lzTables(block lzBlock) ([lzStreams]lzTable, error) {
+	var tables [lzStreams]lzTable
+	for i, stream := range block.streams {
+		histogram := new([256]uint64)
+		for _, symbol := range stream {
+			histogram[symbol]++
+		}
+		stored, lengths, err := compressor.entryTable(histogram)
+		if err != nil {
+			return tables, err
+		}
+		tables[i] = lzTable{
+			stored:  stored,
+			lengths: lengths,
+			bits:    histogramBits(histogram, lengths),
+		}
+	}
+	return tables, nil
+}
+
+// Nil unless there is an LZ77 window. Every goroutine needs its own.
+func (compressor *Compressor) createMatcher() *lz77.Matcher {
+	if compressor.LZWindow == 0 {
+		return nil
+	}
+	return lz77.CreateMatcher(compressor.LZWindow)
+}
+
+func (compressor *Compressor) lzBlockSize() int {
+	if compressor.BlockSize > 0 {
+		return compressor.BlockSize
+	}
+	return DefaultBlockSize
+}
+
+// Reads an input a block at a time and hands each block to handle once it is
+// matched and has its tables. Returns what was read.
+func (compressor *Compressor) readLZBlocks(matcher *lz77.Matcher, reader io.Reader, handle func(lzBlock, [lzStreams]lzTable) error) (inputStats, error) {
+	stats := inputStats{}
+	checksum := crc32.New(crcTable)
+	matcher.Reset()
+	data := make([]byte, compressor.lzBlockSize())
+	for {
+		n, err := io.ReadFull(reader, data)
+		if n > 0 {
+			checksum.Write(data[:n])
+			stats.Size += uint64(n)
+			block := createLZBlock(data[:n], matcher.FindMatches(data[:n]))
+			tables, err := compressor.lzTables(block)
+			if err != nil {
+				return stats, err
+			}
+			err = handle(block, tables)
+			if err != nil {
+				return stats, err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintln(compressor.Messages, err)
+			return stats, errors.New("[ERROR] Failed to read input")
+		}
+	}
+	stats.Checksum = checksum.Sum32()
+	return stats, nil
+}
+
+// The frequency pass for LZ77, which works out the size of every block
+func (compressor *Compressor) scanLZ(matcher *lz77.Matcher, reader io.Reader) (inputStats, error) {
+	size := uint64(4)
+	stats, err := compressor.readLZBlocks(matcher, reader, func(block lzBlock, tables [lzStreams]lzTable) error {
+		size += block.codedSize(tables)
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	stats.lz = true
+	if stats.Size > 0 {
+		stats.CompressedBits = 8 * size
+	}
+	return stats, nil
+}
+
+// Matches and codes an input again, this time writing it out
+func (compressor *Compressor) writeLZ(enc *encoder, matcher *lz77.Matcher, reader io.Reader) (inputStats, error) {
+	var window [4]byte
+	binary.BigEndian.PutUint32(window[:], uint32(compressor.LZWindow))
+	err := enc.write(window[:])
+	if err != nil {
+		fmt.Fprintln(compressor.Messages, err)
+		return inputStats{}, errors.New("[ERROR] Failed to write LZ77 window size to output")
+	}
+	size := uint64(len(window))
+	written, err := compressor.readLZBlocks(matcher, reader, func(block lzBlock, tables [lzStreams]lzTable) error {
+		var blockHeader bytes.Buffer
+		binary.Write(&blockHeader, binary.BigEndian, [2]uint32{uint32(block.Size), uint32(block.Matches)})
+		err := enc.write(blockHeader.Bytes())
+		if err != nil {
+			fmt.Fprintln(compressor.Messages, err)
+			return errors.New("[ERROR] Failed to write block header to output")
+		}
+		for i, table := range tables {
+			var streamHeader bytes.Buffer
+			streamHeader.Write(table.stored)
+			binary.Write(&streamHeader, binary.BigEndian, uint32(table.bits))
+			err := enc.write(streamHeader.Bytes())
+			if err != nil {
+				fmt.Fprintln(compressor.Messages, err)
+				return errors.New("[ERROR] Failed to write code table to output")
+			}
+			if table.bits == 0 {
+				continue
+			}
+			keyTable, err := key_table.CreateKeyTableFromLengths(table.lengths)
+			if err != nil {
+				fmt.Fprintln(compressor.Messages, err)
+				return errors.New("[ERROR] Failed to build code table for a block")
+			}
+			enc.useTable(keyTable)
+			encoded, err := enc.encode(bytes.NewReader(block.streams[i]))
+			if err != nil {
+				return err
+			}
+			if encoded.CompressedBits != table.bits {
+				return errors.New("[ERROR] Coded stream doesn't match its table")
+			}
+			err = enc.finish()
+			if err != nil {
+				fmt.Fprintln(compressor.Messages, err)
+				return errors.New("[ERROR] Failed to write compressed buffer to output")
+			}
+		}
+		var extraHeader [4]byte
+		binary.BigEndian.PutUint32(extraHeader[:], uint32(block.extraBits))
+		err = enc.write(extraHeader[:])
+		if err != nil {
+			fmt.Fprintln(compressor.Messages, err)
+			return errors.New("[ERROR] Failed to write block header to output")
+		}
+		for _, extra := range block.extra {
+			err = enc.writeBits(uint64(extra.value), extra.bits)
+			if err != nil {
+				fmt.Fprintln(compressor.Messages, err)
+				return errors.New("[ERROR] Failed to write extra bits to output")
+			}
+		}
+		err = enc.finish()
+		if err != nil {
+			fmt.Fprintln(compressor.Messages, err)
+			return errors.New("[ERROR] Failed to write compressed buffer to output")
+		}
+		size += block.codedSize(tables)
+		return nil
+	})
+	enc.useTable(compressor.keyTable)
+	if written.Size > 0 {
+		written.CompressedBits = 8 * size
+	}
+	return written, err
+}
+
+// Reads a 32 bit length from a block header
+func readLength(source io.Reader) (uint64, error) {
+	var length [4]byte
+	_, err := io.ReadFull(source, length[:])
+	if err != nil {
+		return 0, errors.New("[ERROR] Couldn't read block header")
+	}
+	return uint64(binary.BigEndian.Uint32(length[:])), nil
+}
+
+// Decodes the LZ77 blocks making up an entry's compressed buffer into writer
+func (decompressor Decompressor) decodeLZ(source io.Reader, entry ArchiveEntry, writer io.Writer) error {
+	windowSize, err := readLength(source)
+	if err != nil {
+		return err
+	}
+	if windowSize < 1 || windowSize > lz77.MaxWindow {
+		return fmt.Errorf("[ERROR] Unsupported LZ77 window of %d bytes", windowSize)
+	}
+	window := lz77.CreateWindow(int(windowSize), writer)
+	remaining := entry.CompressedSize() - 4
+	for remaining > 0 {
+		used, err := decompressor.decodeLZBlock(source, remaining, window)
+		if err != nil {
+			return err
+		}
+		remaining -= used
+	}
+	return window.Flush()
+}
+
+// Decodes one block into window, returning the bytes of compressed buffer it took up
+func (decompressor Decompressor) decodeLZBlock(source io.Reader, remaining uint64, window *lz77.Window) (uint64, error) {
+	used := uint64(8)
+	size, err := readLength(source)
+	if err != nil {
+		return 0, err
+	}
+	matches, err := readLength(source)
+	if err != nil {
+		return 0, err
+	}
+	var streams [lzStreams][]byte
+	for i := range streams {
+		table, tableBits, err := readCodeTable(source)
+		if err != nil {
+			return 0, err
+		}
+		bits, err := readLength(source)
+		if err != nil {
+			return 0, err
+		}
+		used += tableBits/8 + 4 + (bits+7)/8
+		if used > remaining {
+			return 0, errors.New("[ERROR] Block overruns the compressed buffer")
+		}
+		if bits == 0 {
+			continue
+		}
+		if table == nil {
+			return 0, errors.New("[ERROR] Block has coded data but no codes")
+		}
+		var stream bytes.Buffer
+		err = table.Decode(source, bits, &stream)
+		if err != nil {
+			return 0, err
+		}
+		streams[i] = stream.Bytes()
+	}
+	extraBits, err := readLength(source)
+	if err != nil {
+		return 0, err
+	}
+	used += 4 + (extraBits+7)/8
+	if used > remaining {
+		return 0, errors.New("[ERROR] Block overruns the compressed buffer")
+	}
+	extra := make([]byte, (extraBits+7)/8)
+	_, err = io.ReadFull(source, extra)
+	if err != nil {
+		return 0, errors.New("[ERROR] Couldn't read extra bits")
+	}
+	extraReader := bitstream.NewReader(bytes.NewReader(extra))
+	for _, stream := range streams[lzRuns:] {
+		if uint64(len(stream)) != matches {
+			return 0, errors.New("[ERROR] Block has a different number of matches than its header says")
+		}
+	}
+	literals := streams[lzLiterals]
+	produced := uint64(0)
+	for i := uint64(0); i < matches; i++ {
+		var values [3]uint64
+		for j, stream := range streams[lzRuns:] {
+			values[j], err = readValue(stream[i], extraReader)
+			if err != nil {
+				return 0, err
+			}
+		}
+		run, length, distance := values[0], values[1]+lz77.MinMatch, values[2]+1
+		produced += run + length
+		if run > uint64(len(literals)) || produced > size {
+			return 0, errors.New("[ERROR] Block decodes to more data than its header says")
+		}
+		err = window.WriteLiterals(literals[:run])
+		if err == nil {
+			err = window.Copy(int(distance), int(length))
+		}
+		if err != nil {
+			return 0, err
+		}
+		literals = literals[run:]
+	}
+	if produced+uint64(len(literals)) != size {
+		return 0, errors.New("[ERROR] Block decodes to a different size than its header says")
+	}
+	err = window.WriteLiterals(literals)
+	if err != nil {
+		return 0, err
+	}
+	return used, nil
+}
+
+func readValue(symbol byte, extraReader *bitstream.BitReader) (uint64, error) {
+	base, extraBits, ok := lz77.DecodeValue(symbol)
+	if !ok {
+		return 0, fmt.Errorf("[ERROR] Invalid length or distance symbol %d", symbol)
+	}
+	if extraBits == 0 {
+		return uint64(base), nil
+	}
+	extra, err := extraReader.ReadBits(int(extraBits))
+	if err != nil {
+		return 0, errors.New("[ERROR] Ran out of extra bits")
+	}
+	return uint64(base) + extra, nil
+}
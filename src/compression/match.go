@@ -0,0 +1,65 @@
+package compression
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Picks entries out of an archive by name or glob pattern, keeping track of
+// which patterns have matched something
+type entryMatcher struct {
+	patterns []string
+	matched  []bool
+}
+
+func createEntryMatcher(patterns []string) (*entryMatcher, error) {
+	matcher := &entryMatcher{
+		patterns: make([]string, 0, len(patterns)),
+		matched:  make([]bool, len(patterns)),
+	}
+	for _, pattern := range patterns {
+		// Patterns are written like the names stored in the archive
+		cleaned := path.Clean(strings.ReplaceAll(pattern, "\\", "/"))
+		_, err := path.Match(cleaned, "")
+		if err != nil {
+			return nil, fmt.Errorf("[ERROR] Invalid pattern %q", pattern)
+		}
+		matcher.patterns = append(matcher.patterns, cleaned)
+	}
+	return matcher, nil
+}
+
+// Reports whether an entry is selected. A pattern naming a directory selects
+// everything inside it too. Everything is selected if there are no patterns.
+func (matcher *entryMatcher) match(name string) bool {
+	if len(matcher.patterns) == 0 {
+		return true
+	}
+	name = path.Clean(name)
+	found := false
+	for i, pattern := range matcher.patterns {
+		for current := name; ; current = path.Dir(current) {
+			ok, _ := path.Match(pattern, current)
+			if ok {
+				matcher.matched[i] = true
+				found = true
+				break
+			}
+			if current == "." || current == "/" || !strings.Contains(current, "/") {
+				break
+			}
+		}
+	}
+	return found
+}
+
+func (matcher *entryMatcher) unmatched() []string {
+	patterns := make([]string, 0)
+	for i, pattern := range matcher.patterns {
+		if !matcher.matched[i] {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
@@ -0,0 +1,153 @@
+package compression
+
+// What a worker made of one input
+type jobResult struct {
+	result interface{}
+	err    error
+}
+
+// Runs the work for every input on up to Jobs goroutines, each with the work
+// function startWorker gives it, and hands the results to handle in input
+// order. Only a few results more than there are workers wait to be handled at
+// a time. The first error in input order is returned, so it doesn't depend on
+// how the work was scheduled.
+func (compressor *Compressor) runParallel(startWorker func() func(int) (interface{}, error), handle func(int, interface{}) error) error {
+	jobs := compressor.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	results := make([]chan jobResult, len(compressor.Inputs))
+	for i := range results {
+		results[i] = make(chan jobResult, 1)
+	}
+	// Taken before an input is handed out and given back once it is handled
+	slots := make(chan struct{}, 2*jobs)
+	indices := make(chan int)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(indices)
+		for i := range compressor.Inputs {
+			select {
+			case slots <- struct{}{}:
+			case <-stop:
+				return
+			}
+			select {
+			case indices <- i:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	for worker := 0; worker < jobs; worker++ {
+		work := startWorker()
+		go func() {
+			for i := range indices {
+				result, err := work(i)
+				results[i] <- jobResult{result: result, err: err}
+			}
+		}()
+	}
+	for i := range compressor.Inputs {
+		done := <-results[i]
+		<-slots
+		if done.err != nil {
+			return done.err
+		}
+		err := handle(i, done.result)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// An entry handed to a worker to extract, and where its error comes back
+type extractJob struct {
+	listed ArchiveEntry
+	path   string
+	done   chan error
+}
+
+// Extracts the wanted entries found through the central directory on Jobs
+// goroutines, each decoding straight into its file. Paths are checked and
+// directories created in archive order before files are handed out, and only
+// a few more files than there are workers are in progress at a time. The
+// first error in archive order is returned once everything started before it
+// has finished.
+func (decompressor Decompressor) extractParallel(wanted func(name string) bool, directories *[]ArchiveEntry) error {
+	entries, err := decompressor.ReadDirectory()
+	if err != nil {
+		return err
+	}
+	jobs := make(chan extractJob)
+	defer close(jobs)
+	for worker := 0; worker < decompressor.Jobs; worker++ {
+		go func() {
+			for job := range jobs {
+				job.done <- decompressor.extractEntry(job.listed, job.path)
+			}
+		}()
+	}
+	inFlight := make([]extractJob, 0)
+	var firstErr error
+	// Waits for the oldest file in progress
+	collect := func() {
+		err := <-inFlight[0].done
+		inFlight = inFlight[1:]
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	finish := func(err error) error {
+		for len(inFlight) > 0 {
+			collect()
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		return firstErr
+	}
+	for _, listed := range entries {
+		if firstErr != nil {
+			break
+		}
+		if !wanted(listed.Filename) {
+			continue
+		}
+		path, ok, err := decompressor.extractPath(listed)
+		if err != nil {
+			return finish(err)
+		}
+		if !ok {
+			continue
+		}
+		// A later entry for the same path has to win, as it would in order
+		for i := len(inFlight) - 1; i >= 0; i-- {
+			if inFlight[i].path == path {
+				for j := 0; j <= i; j++ {
+					collect()
+				}
+				break
+			}
+		}
+		if listed.Mode.IsDir() {
+			entry := listed
+			entry.Filename = path
+			err := createDirectory(entry)
+			if err != nil {
+				return finish(err)
+			}
+			*directories = append(*directories, entry)
+			continue
+		}
+		if len(inFlight) == 2*decompressor.Jobs {
+			collect()
+		}
+		job := extractJob{listed: listed, path: path, done: make(chan error, 1)}
+		jobs <- job
+		inFlight = append(inFlight, job)
+	}
+	return finish(nil)
+}
@@ -0,0 +1,117 @@
+package compression
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Name an input is stored under: cleaned, with forward slashes, and without
+// a leading / or .. components, which extraction would refuse. Also returns
+// what was removed from the front of the cleaned name.
+func storedName(name string) (string, string) {
+	volume := filepath.VolumeName(name)
+	cleaned := filepath.ToSlash(filepath.Clean(name[len(volume):]))
+	stored := strings.TrimLeft(cleaned, "/")
+	for stored == ".." || strings.HasPrefix(stored, "../") {
+		stored = strings.TrimLeft(stored[2:], "/")
+	}
+	prefix := volume + cleaned[:len(cleaned)-len(stored)]
+	if stored == "" {
+		stored = "."
+	}
+	return stored, prefix
+}
+
+// Archives can come from anywhere, so names are checked before anything is
+// written: they have to be relative and can't climb out with ".."
+func cleanEntryName(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("[ERROR] Entry has an empty name")
+	}
+	if strings.ContainsRune(name, 0) {
+		return "", fmt.Errorf("[ERROR] Entry name %q contains a NUL byte", name)
+	}
+	// Treat both separators the same so names are checked alike on every platform
+	slashed := strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(slashed, "/") || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("[ERROR] Refusing to extract absolute path %q", name)
+	}
+	for _, part := range strings.Split(slashed, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("[ERROR] Refusing to extract %q, it contains a \"..\" component", name)
+		}
+	}
+	return filepath.Clean(filepath.FromSlash(slashed)), nil
+}
+
+// Drops the first count components of a cleaned entry name, like tar's
+// --strip-components. Reports false if nothing is left.
+func stripComponents(name string, count int) (string, bool) {
+	if count <= 0 {
+		return name, true
+	}
+	parts := strings.Split(name, string(filepath.Separator))
+	if len(parts) <= count {
+		return "", false
+	}
+	return filepath.Join(parts[count:]...), true
+}
+
+func isWithin(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Returns the path an entry is extracted to under root. Symlinks that already
+// exist along the way must resolve inside root, and a symlink where the entry
+// itself goes is removed so it gets replaced rather than written through.
+func prepareExtractPath(root string, name string) (string, error) {
+	relPath, err := cleanEntryName(name)
+	if err != nil {
+		return "", err
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err == nil {
+		realRoot, err = filepath.Abs(realRoot)
+	}
+	if err != nil {
+		return "", fmt.Errorf("[ERROR] Couldn't resolve extraction directory %s: %v", root, err)
+	}
+	parts := strings.Split(relPath, string(filepath.Separator))
+	current := root
+	for i, part := range parts {
+		current = filepath.Join(current, part)
+		stat, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			// Nothing further down exists yet, so there are no more links to follow
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("[ERROR] Couldn't inspect %s: %v", current, err)
+		}
+		if stat.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if i == len(parts)-1 {
+			err := os.Remove(current)
+			if err != nil {
+				return "", errors.New("[ERROR] Couldn't replace symlink " + current)
+			}
+			break
+		}
+		target, err := filepath.EvalSymlinks(current)
+		if err == nil {
+			target, err = filepath.Abs(target)
+		}
+		if err != nil || !isWithin(realRoot, target) {
+			return "", fmt.Errorf("[ERROR] Refusing to extract %q through symlink %s, it leads outside %s", name, current, root)
+		}
+	}
+	return filepath.Join(root, relPath), nil
+}
@@ -0,0 +1,154 @@
+package compression
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hzip/src/frequency_table"
+	"hzip/src/key_table"
+
+	"github.com/dgryski/go-bitstream"
+)
+
+// Which entries get their own code table rather than the archive's
+type TableMode int
+
+const (
+	// Only entries where an own table saves more than it costs to store
+	TablesAuto TableMode = iota
+	// Every entry uses the table at the start of the archive
+	TablesShared
+	// Every entry with data gets its own table
+	TablesPerEntry
+)
+
+// Builds the archive's table and decides which entries get their own, then
+// works out how long each entry's compressed buffer will be
+func (compressor *Compressor) assignTables(freqTable frequency_table.FrequencyTable) error {
+	err := compressor.buildSharedTable(freqTable)
+	if err != nil {
+		return err
+	}
+	if compressor.TableMode != TablesShared {
+		shared := compressor.keyTable.CodeLengths()
+		ownTables := false
+		for i := range compressor.stats {
+			stats := &compressor.stats[i]
+			if stats.Size == 0 || stats.blocks != nil {
+				// Split entries get tables block by block instead
+				continue
+			}
+			table, lengths, err := compressor.entryTable(stats.histogram)
+			if err != nil {
+				return err
+			}
+			sharedBytes := (histogramBits(stats.histogram, shared) + 7) / 8
+			ownBytes := uint64(len(table)) + (histogramBits(stats.histogram, lengths)+7)/8
+			if compressor.TableMode == TablesPerEntry || ownBytes < sharedBytes {
+				stats.table = table
+				stats.lengths = &lengths
+				ownTables = true
+			}
+		}
+		if ownTables {
+			// The archive's table only has to suit the entries still using it
+			remaining := frequency_table.CreateFrequencyTable()
+			for _, stats := range compressor.stats {
+				if stats.table != nil {
+					continue
+				}
+				for symbol, count := range stats.histogram {
+					remaining.Add(byte(symbol), int(count))
+				}
+			}
+			err := compressor.buildSharedTable(remaining)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	shared := compressor.keyTable.CodeLengths()
+	for i := range compressor.stats {
+		stats := &compressor.stats[i]
+		if stats.blocks != nil {
+			err := compressor.planBlocks(stats, shared)
+			if err != nil {
+				return err
+			}
+		} else if stats.lengths != nil {
+			stats.setCodeLengths(*stats.lengths)
+		} else {
+			stats.setCodeLengths(shared)
+		}
+	}
+	return nil
+}
+
+func (stats inputStats) codeTable() CodeTable {
+	if stats.lz && stats.Size > 0 {
+		return LZBlocks
+	}
+	if stats.blocks != nil {
+		return BlockTables
+	}
+	if stats.table != nil {
+		return OwnTable
+	}
+	return ArchiveTable
+}
+
+func (compressor *Compressor) buildSharedTable(freqTable frequency_table.FrequencyTable) error {
+	compressor.keyTable = key_table.CreateKeyTable()
+	if compressor.MaxCodeLength == 0 {
+		return compressor.buildHuffmanTree(freqTable)
+	}
+	fmt.Fprintln(compressor.Messages, "[INFO] Assigning length-limited codes")
+	lengths, err := key_table.LimitedCodeLengths(freqTable.GetFrequencies(), compressor.MaxCodeLength)
+	if err == nil {
+		err = compressor.keyTable.SetCodeLengths(lengths)
+	}
+	if err != nil {
+		fmt.Fprintln(compressor.Messages, err)
+		return errors.New("[ERROR] Failed to assign code lengths")
+	}
+	return nil
+}
+
+// Works out code lengths for a single entry, along with how they are stored
+// at the start of its compressed buffer
+func (compressor *Compressor) entryTable(histogram *[256]uint64) ([]byte, key_table.CodeLengths, error) {
+	frequencies := make(map[byte]int)
+	for symbol, count := range histogram {
+		if count > 0 {
+			frequencies[byte(symbol)] = int(count)
+		}
+	}
+	maxLength := compressor.MaxCodeLength
+	if maxLength == 0 {
+		maxLength = key_table.MaxCodeLength
+	}
+	lengths, err := key_table.LimitedCodeLengths(frequencies, maxLength)
+	if err != nil {
+		fmt.Fprintln(compressor.Messages, err)
+		return nil, lengths, errors.New("[ERROR] Failed to assign code lengths for an entry")
+	}
+	var tableBuffer bytes.Buffer
+	tableWriter := bitstream.NewWriter(&tableBuffer)
+	err = lengths.Write(tableWriter)
+	if err == nil {
+		err = tableWriter.Flush(bitstream.Zero)
+	}
+	if err != nil {
+		fmt.Fprintln(compressor.Messages, err)
+		return nil, lengths, errors.New("[ERROR] Failed to write code table for an entry")
+	}
+	return tableBuffer.Bytes(), lengths, nil
+}
+
+func histogramBits(histogram *[256]uint64, lengths key_table.CodeLengths) uint64 {
+	total := uint64(0)
+	for symbol, count := range histogram {
+		total += count * uint64(lengths[symbol])
+	}
+	return total
+}
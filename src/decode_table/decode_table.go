@@ -0,0 +1,102 @@
+package decode_table
+
+import "hzip/src/key_table"
+
+// Number of bits resolved by the first lookup. Codes up to this length decode
+// with a single table access; longer ones follow links into sub-tables.
+const RootBits = 12
+
+// Number of bits resolved by each sub-table
+const SubTableBits = 6
+
+// Longest code the decoder can peek at once after refilling its bit buffer,
+// which is also the longest code the compressor assigns
+const MaxCodeLength = key_table.MaxCodeLength
+
+type tableEntry struct {
+	Symbol byte
+	Length uint8 // total code length, 0 if this entry links to a sub-table
+	Next   int32 // index of the linked sub-table, -1 if the bits aren't a code
+}
+
+type lookupTable struct {
+	Offset  uint // code bits already resolved before this table
+	Bits    uint // bits resolved by this table
+	Entries []tableEntry
+}
+
+type DecodeTable struct {
+	longest uint // length of the longest code
+	// Lookups that are sure to fit in the 56 bits a refill guarantees, 0 if
+	// codes are too long for even one
+	lookups int
+	tables  []lookupTable             // tables[0] is the root
+	root    [1 << RootBits]tableEntry // entries of tables[0]
+	// The root table again, packed for the fast path of Decode. Each entry
+	// holds the symbols of as many whole codes as fit in RootBits, at most
+	// two: the first symbol in bits 0-7, the second in bits 8-15, how many
+	// there are in bits 16-23 and their total length in bits 24-31. An entry
+	// of 0 means the code is longer than RootBits or invalid.
+	fast [1 << RootBits]uint32
+}
+
+type canonicalCode struct {
+	Symbol byte
+	Length uint
+	Code   uint64
+}
+
+func (table *DecodeTable) build(codes []canonicalCode, offset uint, bits uint) int {
+	index := len(table.tables)
+	var entries []tableEntry
+	if index == 0 {
+		entries = table.root[:]
+	} else {
+		entries = make([]tableEntry, 1<<bits)
+	}
+	table.tables = append(table.tables, lookupTable{
+		Offset:  offset,
+		Bits:    bits,
+		Entries: entries,
+	})
+	for i := range entries {
+		entries[i].Next = -1
+	}
+	// Codes are sorted, so codes sharing a slot of this table are adjacent
+	for start := 0; start < len(codes); {
+		code := codes[start]
+		// The bits of the code this table resolves, left aligned
+		slot := (code.Code << (64 - code.Length) << offset) >> (64 - bits)
+		if code.Length-offset <= bits {
+			fill := uint64(1) << (bits - (code.Length - offset))
+			for i := uint64(0); i < fill; i++ {
+				entries[slot+i] = tableEntry{
+					Symbol: code.Symbol,
+					Length: uint8(code.Length),
+				}
+			}
+			start++
+			continue
+		}
+		end := start + 1
+		longest := code.Length
+		for end < len(codes) {
+			next := codes[end]
+			if next.Length-offset <= bits || (next.Code<<(64-next.Length)<<offset)>>(64-bits) != slot {
+				break
+			}
+			if next.Length > longest {
+				longest = next.Length
+			}
+			end++
+		}
+		subBits := longest - offset - bits
+		if subBits > SubTableBits {
+			subBits = SubTableBits
+		}
+		next := table.build(codes[start:end], offset+bits, subBits)
+		entries[slot] = tableEntry{Next: int32(next)}
+		start = end
+	}
+	return index
+}
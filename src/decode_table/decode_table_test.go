@@ -0,0 +1,304 @@
+package decode_table
+
+import (
+	"bytes"
+	"hzip/src/huffman_tree"
+	"hzip/src/key_table"
+	"hzip/src/priority_queue"
+	"math/rand"
+	"testing"
+
+	"github.com/dgryski/go-bitstream"
+)
+
+func huffmanLengths(t testing.TB, data []byte) key_table.CodeLengths {
+	frequencies := make(map[byte]int)
+	for _, currentByte := range data {
+		frequencies[currentByte]++
+	}
+	pq := priority_queue.NewPriorityQueue()
+	for symbol, frequency := range frequencies {
+		pq.Push(huffman_tree.HtreeQueueItem{
+			Priority: frequency,
+			Tree: &huffman_tree.HuffmanTree{
+				Head:      huffman_tree.LeafNode{Freq: frequency, LeafData: symbol},
+				Frequency: frequency,
+			},
+		})
+	}
+	for pq.Len() > 1 {
+		newTree := huffman_tree.CombineTrees(pq.Pop().(huffman_tree.HtreeQueueItem).Tree, pq.Pop().(huffman_tree.HtreeQueueItem).Tree)
+		pq.Push(huffman_tree.HtreeQueueItem{Priority: newTree.Frequency, Tree: newTree})
+	}
+	table := key_table.CreateKeyTable()
+	err := table.ReadTree(pq.Pop().(huffman_tree.HtreeQueueItem).Tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table.CodeLengths()
+}
+
+func encode(t testing.TB, lengths key_table.CodeLengths, data []byte) ([]byte, uint64) {
+	table, err := key_table.CreateKeyTableFromLengths(lengths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	writer := bitstream.NewWriter(&buf)
+	numBits := uint64(0)
+	for _, currentByte := range data {
+		code := table.Table[currentByte]
+		err := writer.WriteBits(code.Code, code.Length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		numBits += uint64(code.Length)
+	}
+	err = writer.Flush(bitstream.Zero)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), numBits
+}
+
+// Skewed enough to give codes of very different lengths
+func sampleData(size int) []byte {
+	random := rand.New(rand.NewSource(1))
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(random.ExpFloat64() * 12)
+	}
+	return data
+}
+
+func TestDecode(t *testing.T) {
+	data := sampleData(100000)
+	lengths := huffmanLengths(t, data)
+	encoded, numBits := encode(t, lengths, data)
+	table, err := CreateDecodeTable(lengths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded bytes.Buffer
+	err = table.Decode(bytes.NewReader(encoded), numBits, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Bytes(), data) {
+		t.Error("decoded data doesn't match the input")
+	}
+}
+
+func TestDecodeLongCodes(t *testing.T) {
+	// Lengths 1, 2, ..., 29, 29 form a complete code that needs several
+	// levels of sub-tables
+	var lengths key_table.CodeLengths
+	for i := 0; i < 29; i++ {
+		lengths[i] = i + 1
+	}
+	lengths[29] = 29
+	data := make([]byte, 0)
+	for i := 0; i < 30; i++ {
+		data = append(data, byte(i), byte(29-i), 0)
+	}
+	encoded, numBits := encode(t, lengths, data)
+	table, err := CreateDecodeTable(lengths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded bytes.Buffer
+	err = table.Decode(bytes.NewReader(encoded), numBits, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Bytes(), data) {
+		t.Errorf("got %v, want %v", decoded.Bytes(), data)
+	}
+}
+
+func TestDecodeLongCodesAcrossChunks(t *testing.T) {
+	// Enough codes of every length, paired in the root table or behind
+	// sub-tables, to go through the fast path over several chunks
+	var lengths key_table.CodeLengths
+	for i := 0; i < 29; i++ {
+		lengths[i] = i + 1
+	}
+	lengths[29] = 29
+	random := rand.New(rand.NewSource(1))
+	data := make([]byte, 50000)
+	for i := range data {
+		data[i] = byte(random.Intn(30))
+	}
+	encoded, numBits := encode(t, lengths, data)
+	table, err := CreateDecodeTable(lengths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded bytes.Buffer
+	err = table.Decode(bytes.NewReader(encoded), numBits, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Bytes(), data) {
+		t.Error("decoded data doesn't match the input")
+	}
+}
+
+func TestDecodeRejectsInvalidCode(t *testing.T) {
+	// 11 isn't a code, and comes long after the fast path has started
+	keyTable := key_table.CreateKeyTable()
+	keyTable.Table['a'] = key_table.KeyTableData{Length: 1, Code: 0b0}
+	keyTable.Table['b'] = key_table.KeyTableData{Length: 2, Code: 0b10}
+	table, err := CreateDecodeTableFromCodes(keyTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := append(make([]byte, 100), 0b11000000, 0)
+	var decoded bytes.Buffer
+	err = table.Decode(bytes.NewReader(encoded), uint64(len(encoded))*8, &decoded)
+	if err == nil {
+		t.Error("bits that aren't a code should be rejected")
+	}
+}
+
+func TestDecodeLongestAssignedCodes(t *testing.T) {
+	// The compressor may assign codes up to MaxCodeLength, so the decoder has
+	// to take all of them
+	var lengths key_table.CodeLengths
+	for i := 0; i < MaxCodeLength; i++ {
+		lengths[i] = i + 1
+	}
+	lengths[MaxCodeLength] = MaxCodeLength
+	data := []byte{byte(MaxCodeLength), 0, byte(MaxCodeLength - 1), byte(MaxCodeLength)}
+	encoded, numBits := encode(t, lengths, data)
+	table, err := CreateDecodeTable(lengths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded bytes.Buffer
+	err = table.Decode(bytes.NewReader(encoded), numBits, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Bytes(), data) {
+		t.Errorf("got %v, want %v", decoded.Bytes(), data)
+	}
+	lengths[MaxCodeLength+1], lengths[MaxCodeLength] = MaxCodeLength+1, MaxCodeLength+1
+	_, err = key_table.CreateKeyTableFromLengths(lengths)
+	if err == nil {
+		t.Error("codes longer than the decoder supports should be refused")
+	}
+}
+
+func TestDecodeRejectsTruncatedCode(t *testing.T) {
+	var lengths key_table.CodeLengths
+	lengths['a'] = 1
+	lengths['b'] = 2
+	lengths['c'] = 2
+	// "a" followed by the first bit of "b" (10) or "c" (11)
+	table, err := CreateDecodeTable(lengths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded bytes.Buffer
+	err = table.Decode(bytes.NewReader([]byte{0b01000000}), 2, &decoded)
+	if err == nil {
+		t.Error("truncated code should be rejected")
+	}
+}
+
+func TestDecodeExplicitCodes(t *testing.T) {
+	// Not canonical: the longer codes come first
+	keyTable := key_table.CreateKeyTable()
+	keyTable.Table['a'] = key_table.KeyTableData{Length: 2, Code: 0b00}
+	keyTable.Table['b'] = key_table.KeyTableData{Length: 2, Code: 0b01}
+	keyTable.Table['c'] = key_table.KeyTableData{Length: 1, Code: 0b1}
+	table, err := CreateDecodeTableFromCodes(keyTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded bytes.Buffer
+	// c a b c, padded
+	err = table.Decode(bytes.NewReader([]byte{0b10001100}), 6, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.String() != "cabc" {
+		t.Errorf("got %q, want \"cabc\"", decoded.String())
+	}
+
+	keyTable.Table['d'] = key_table.KeyTableData{Length: 3, Code: 0b011}
+	_, err = CreateDecodeTableFromCodes(keyTable)
+	if err == nil {
+		t.Error("codes that aren't prefix free should be rejected")
+	}
+	delete(keyTable.Table, 'd')
+	keyTable.Table['e'] = key_table.KeyTableData{Length: 0}
+	_, err = CreateDecodeTableFromCodes(keyTable)
+	if err == nil {
+		t.Error("an empty code should be rejected")
+	}
+}
+
+const benchmarkSize = 64 * 1024
+
+func BenchmarkDecodeTable(b *testing.B) {
+	data := sampleData(benchmarkSize)
+	lengths := huffmanLengths(b, data)
+	encoded, numBits := encode(b, lengths, data)
+	table, err := CreateDecodeTable(lengths)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var decoded bytes.Buffer
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decoded.Reset()
+		err := table.Decode(bytes.NewReader(encoded), numBits, &decoded)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// The bit at a time tree walk this package replaced, for comparison
+func BenchmarkTreeLookup(b *testing.B) {
+	data := sampleData(benchmarkSize)
+	lengths := huffmanLengths(b, data)
+	encoded, numBits := encode(b, lengths, data)
+	keyTable, err := key_table.CreateKeyTableFromLengths(lengths)
+	if err != nil {
+		b.Fatal(err)
+	}
+	tree, err := keyTable.WriteTree()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader := bitstream.NewReader(bytes.NewReader(encoded))
+		currentBits := make([]bitstream.Bit, 0)
+		for j := uint64(0); j < numBits; j++ {
+			bit, err := reader.ReadBit()
+			if err != nil {
+				b.Fatal(err)
+			}
+			currentBits = append(currentBits, bit)
+			var currentChunk bytes.Buffer
+			currentChunkWriter := bitstream.NewWriter(&currentChunk)
+			for _, currentBit := range currentBits {
+				currentChunkWriter.WriteBit(currentBit)
+			}
+			currentChunkWriter.Flush(bitstream.Zero)
+			_, foundLeaf, err := tree.Lookup(currentChunk, len(currentBits))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if foundLeaf {
+				currentBits = currentBits[:0]
+			}
+		}
+	}
+}
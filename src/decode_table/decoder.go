@@ -0,0 +1,160 @@
+package decode_table
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Size of the chunks compressed data is read in and decoded data is written in
+const chunkSize = 32 * 1024
+
+// Reads a fixed number of bytes from a reader in chunks and hands them out
+// most significant bit first through a 64 bit buffer
+type bitSource struct {
+	reader    io.Reader
+	remaining uint64 // bytes not read from reader yet
+	chunk     []byte
+	pos       int
+	buffer    uint64 // left aligned
+	count     uint   // valid bits in buffer
+}
+
+// Tops the buffer up to at least MaxCodeLength bits while input remains.
+// Past the end of the input the buffer is padded with zeros.
+func (source *bitSource) refill() error {
+	for source.count <= 56 {
+		if source.pos+8 <= len(source.chunk) {
+			// Load a whole word and keep as many full bytes as fit. The bits of
+			// the next byte that also land in the buffer are the real ones, so
+			// ORing them in again on the next refill doesn't change anything.
+			word := binary.BigEndian.Uint64(source.chunk[source.pos:])
+			source.buffer |= word >> source.count
+			taken := (64 - source.count) >> 3
+			source.pos += int(taken)
+			source.count += taken << 3
+			return nil
+		}
+		if source.pos == len(source.chunk) {
+			if source.remaining == 0 {
+				return nil
+			}
+			size := uint64(cap(source.chunk))
+			if size > source.remaining {
+				size = source.remaining
+			}
+			source.chunk = source.chunk[:size]
+			_, err := io.ReadFull(source.reader, source.chunk)
+			if err != nil {
+				return err
+			}
+			source.remaining -= size
+			source.pos = 0
+			continue
+		}
+		source.buffer |= uint64(source.chunk[source.pos]) << (56 - source.count)
+		source.pos++
+		source.count += 8
+	}
+	return nil
+}
+
+// Decodes numBits bits of codes from reader into writer. Exactly the
+// (numBits + 7) / 8 bytes holding those bits are consumed from reader, and the
+// padding in the last byte must be zero.
+func (table *DecodeTable) Decode(reader io.Reader, numBits uint64, writer io.Writer) error {
+	source := bitSource{
+		reader:    reader,
+		remaining: (numBits + 7) / 8,
+		chunk:     make([]byte, 0, chunkSize),
+	}
+	var output [chunkSize]byte
+	outputLen := 0
+	root := &table.root
+	fast := &table.fast
+	// Most bytes one pass of the fast loop below can decode
+	lookups := table.lookups
+	burst := 2 * lookups
+	// Kept in locals rather than on source so the hot loop stays in registers
+	buffer, count := uint64(0), uint(0)
+	consumed := uint64(0)
+	for consumed < numBits {
+		if outputLen > len(output)-burst {
+			_, err := writer.Write(output[:outputLen])
+			if err != nil {
+				return errors.New("[ERROR] Failed to write decoded data")
+			}
+			outputLen = 0
+		}
+		if lookups > 0 && count < 64 && consumed+56 <= numBits && source.pos+8 <= len(source.chunk) {
+			// Top the buffer up to at least 56 bits without a branch per byte,
+			// then do as many lookups as are sure to fit in them. None of them
+			// can reach past numBits, so a second symbol is always wanted.
+			buffer |= binary.BigEndian.Uint64(source.chunk[source.pos:]) >> (count & 63)
+			source.pos += int((63 - count) >> 3)
+			count |= 56
+			start := count
+			for i := 0; i < lookups; i++ {
+				packed := fast[buffer>>(64-RootBits)]
+				if packed == 0 {
+					entry := root[buffer>>(64-RootBits)]
+					for entry.Length == 0 {
+						if entry.Next < 0 {
+							return errors.New("[ERROR] Invalid code in compressed data")
+						}
+						lookup := &table.tables[entry.Next]
+						entry = lookup.Entries[(buffer<<lookup.Offset)>>(64-lookup.Bits)]
+					}
+					packed = uint32(entry.Symbol) | 1<<16 | uint32(entry.Length)<<24
+				}
+				// Writing the second symbol even when there isn't one saves a
+				// branch, and masking the shift spares a check for 64 or more
+				output[outputLen] = byte(packed)
+				output[outputLen+1] = byte(packed >> 8)
+				outputLen += int(packed >> 16 & 0xff)
+				length := uint(packed >> 24)
+				buffer <<= length & 63
+				count -= length
+			}
+			consumed += uint64(start - count)
+			continue
+		}
+		// Close to the end of the data or of a chunk, one code at a time
+		if count < table.longest {
+			source.buffer, source.count = buffer, count
+			err := source.refill()
+			if err != nil {
+				fmt.Println(err)
+				return errors.New("[ERROR] Couldn't read compressed data")
+			}
+			buffer, count = source.buffer, source.count
+		}
+		entry := root[buffer>>(64-RootBits)]
+		for entry.Length == 0 {
+			if entry.Next < 0 {
+				return errors.New("[ERROR] Invalid code in compressed data")
+			}
+			lookup := &table.tables[entry.Next]
+			entry = lookup.Entries[(buffer<<lookup.Offset)>>(64-lookup.Bits)]
+		}
+		length := uint(entry.Length)
+		consumed += uint64(length)
+		buffer <<= length
+		count -= length
+		output[outputLen] = entry.Symbol
+		outputLen++
+	}
+	_, err := writer.Write(output[:outputLen])
+	if err != nil {
+		return errors.New("[ERROR] Failed to write decoded data")
+	}
+	if consumed != numBits {
+		return errors.New("[ERROR] Last code runs past the end of the compressed data")
+	}
+	// Whatever is left in the last byte has to be padding
+	if buffer != 0 {
+		return errors.New("[ERROR] Expected padding bits to be zero")
+	}
+	return nil
+}
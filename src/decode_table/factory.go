@@ -0,0 +1,110 @@
+package decode_table
+
+import (
+	"errors"
+	"fmt"
+	"hzip/src/key_table"
+	"sort"
+)
+
+func CreateDecodeTable(lengths key_table.CodeLengths) (*DecodeTable, error) {
+	keyTable, err := key_table.CreateKeyTableFromLengths(lengths)
+	if err != nil {
+		fmt.Println(err)
+		return nil, errors.New("[ERROR] Invalid code lengths")
+	}
+	codes, err := sortedCodes(keyTable)
+	if err != nil {
+		return nil, err
+	}
+	return buildTable(codes), nil
+}
+
+// For codes that weren't assigned canonically, such as those read by
+// key_table.ReadCodes, which have to be checked for being a prefix code
+func CreateDecodeTableFromCodes(keyTable key_table.KeyTable) (*DecodeTable, error) {
+	codes, err := sortedCodes(keyTable)
+	if err != nil {
+		return nil, err
+	}
+	for i, code := range codes {
+		if code.Length == 0 {
+			return nil, fmt.Errorf("[ERROR] Symbol %d has an empty code", code.Symbol)
+		}
+		// A code that is a prefix of another sorts right before it
+		if i > 0 {
+			previous := codes[i-1]
+			if previous.Length <= code.Length && code.Code>>(code.Length-previous.Length) == previous.Code {
+				return nil, fmt.Errorf("[ERROR] Code of symbol %d is a prefix of the code of symbol %d", previous.Symbol, code.Symbol)
+			}
+		}
+	}
+	return buildTable(codes), nil
+}
+
+// Codes of a table ordered by their left aligned value, so shared prefixes
+// are adjacent
+func sortedCodes(keyTable key_table.KeyTable) ([]canonicalCode, error) {
+	codes := make([]canonicalCode, 0, len(keyTable.Table))
+	for symbol, data := range keyTable.Table {
+		if data.Length > MaxCodeLength {
+			return nil, fmt.Errorf("[ERROR] Code length %d is longer than the decoder supports", data.Length)
+		}
+		codes = append(codes, canonicalCode{
+			Symbol: symbol,
+			Length: uint(data.Length),
+			Code:   data.Code,
+		})
+	}
+	if len(codes) == 0 {
+		return nil, errors.New("[ERROR] Can't decode without any codes")
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		left := codes[i].Code << (64 - codes[i].Length)
+		right := codes[j].Code << (64 - codes[j].Length)
+		if left != right {
+			return left < right
+		}
+		return codes[i].Length < codes[j].Length
+	})
+	return codes, nil
+}
+
+func buildTable(codes []canonicalCode) *DecodeTable {
+	table := &DecodeTable{}
+	for _, code := range codes {
+		if code.Length > table.longest {
+			table.longest = code.Length
+		}
+	}
+	table.build(codes, 0, RootBits)
+	table.packRoot()
+	// A root entry covers at most RootBits, or a single code of any length
+	step := table.longest
+	if step < RootBits {
+		step = RootBits
+	}
+	table.lookups = int(56 / step)
+	return table
+}
+
+// Fills in the packed root table, pairing up codes short enough for two to
+// be decoded with one lookup
+func (table *DecodeTable) packRoot() {
+	for index, entry := range table.root {
+		if entry.Length == 0 {
+			continue
+		}
+		packed := uint32(entry.Symbol) | 1<<16 | uint32(entry.Length)<<24
+		if entry.Length < RootBits {
+			// The bits after the first code, with zeros for those past
+			// RootBits, which a second code short enough to count never
+			// depends on
+			next := table.root[(index<<entry.Length)&(1<<RootBits-1)]
+			if next.Length != 0 && entry.Length+next.Length <= RootBits {
+				packed = uint32(entry.Symbol) | uint32(next.Symbol)<<8 | 2<<16 | uint32(entry.Length+next.Length)<<24
+			}
+		}
+		table.fast[index] = packed
+	}
+}
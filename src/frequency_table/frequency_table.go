@@ -1,5 +1,7 @@
 package frequency_table
 
+import "sort"
+
 type FrequencyTable struct {
 	frequencies map[byte]int
 }
@@ -13,6 +15,85 @@ func (freq_table *FrequencyTable) Increment(key byte) {
 	}
 }
 
+func (freq_table *FrequencyTable) Add(key byte, count int) {
+	if count == 0 {
+		return
+	}
+	freq_table.frequencies[key] += count
+}
+
 func (freq_table *FrequencyTable) GetFrequencies() map[byte]int {
 	return freq_table.frequencies
 }
+
+// Symbols that occur at least once, in ascending order
+func (freq_table *FrequencyTable) Symbols() []byte {
+	symbols := make([]byte, 0, len(freq_table.frequencies))
+	for symbol := 0; symbol < 256; symbol++ {
+		if freq_table.frequencies[byte(symbol)] > 0 {
+			symbols = append(symbols, byte(symbol))
+		}
+	}
+	return symbols
+}
+
+// Adds the counts of other, such as a table filled in by another goroutine
+func (freq_table *FrequencyTable) Merge(other FrequencyTable) {
+	for key, count := range other.frequencies {
+		freq_table.Add(key, count)
+	}
+}
+
+// Scales the counts so they add up to exactly total while every symbol that
+// occurs keeps a count of at least 1, as table-based coders need. What
+// rounding down leaves over goes to the symbols that lost the most to it.
+// Total must be at least the number of symbols.
+func (freq_table *FrequencyTable) Normalize(total int) map[byte]int {
+	symbols := freq_table.Symbols()
+	normalized := make(map[byte]int, len(symbols))
+	if len(symbols) == 0 {
+		return normalized
+	}
+	sum := uint64(0)
+	for _, symbol := range symbols {
+		sum += uint64(freq_table.frequencies[symbol])
+	}
+	assigned := 0
+	remainders := make([]uint64, 0, len(symbols))
+	for _, symbol := range symbols {
+		scaled := uint64(freq_table.frequencies[symbol]) * uint64(total)
+		count := int(scaled / sum)
+		remainder := scaled % sum
+		if count == 0 {
+			// Rounded up already
+			count, remainder = 1, 0
+		}
+		normalized[symbol] = count
+		remainders = append(remainders, remainder)
+		assigned += count
+	}
+	order := make([]int, len(symbols))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return remainders[order[i]] > remainders[order[j]]
+	})
+	for i := 0; assigned < total; i = (i + 1) % len(order) {
+		normalized[symbols[order[i]]]++
+		assigned++
+	}
+	// Symbols rounded up to 1 can leave too much assigned, which comes off
+	// the largest counts
+	for assigned > total {
+		largest := symbols[0]
+		for _, symbol := range symbols {
+			if normalized[symbol] > normalized[largest] {
+				largest = symbol
+			}
+		}
+		normalized[largest]--
+		assigned--
+	}
+	return normalized
+}
@@ -4,9 +4,16 @@ import "hzip/src/priority_queue"
 
 type HtreeQueueItem struct {
 	Priority int
-	Tree     *HuffmanTree
+	// Breaks ties between equal priorities, so the tree doesn't depend on the
+	// order items were pushed in. Must be unique within a queue.
+	Order int
+	Tree  *HuffmanTree
 }
 
 func (hqi HtreeQueueItem) Less(item priority_queue.QueueItem) bool {
-	return hqi.Priority < item.(HtreeQueueItem).Priority
+	other := item.(HtreeQueueItem)
+	if hqi.Priority != other.Priority {
+		return hqi.Priority < other.Priority
+	}
+	return hqi.Order < other.Order
 }
@@ -0,0 +1,72 @@
+package hzip
+
+import (
+	"hzip/src/compression"
+	"hzip/src/input"
+	"hzip/src/output"
+	"io"
+	"io/fs"
+	"io/ioutil"
+)
+
+// Opens an archive as a read-only filesystem. Only the central directory is
+// read up front. Entries whose names aren't valid fs.FS paths are left out.
+func OpenFS(filename string) (*FS, error) {
+	decompressor := compression.CreateDecompressor(filename)
+	decompressor.Messages = ioutil.Discard
+	err := decompressor.ReadMeta()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := decompressor.ReadDirectory()
+	if err != nil {
+		decompressor.Close()
+		return nil, err
+	}
+	fsys := &FS{
+		decompressor: decompressor,
+		nodes: map[string]*node{
+			".": {entry: compression.ArchiveEntry{Filename: ".", Mode: fs.ModeDir | 0o755}},
+		},
+	}
+	for _, entry := range entries {
+		if !fs.ValidPath(entry.Filename) {
+			continue
+		}
+		err := fsys.add(entry)
+		if err != nil {
+			decompressor.Close()
+			return nil, err
+		}
+	}
+	sortChildren(fsys.nodes)
+	return fsys, nil
+}
+
+func NewWriter(writer io.Writer) *Writer {
+	return &Writer{
+		writer: writer,
+		inputs: make([]input.MemoryInput, 0),
+	}
+}
+
+// Like NewWriter, but entries are coded with adaptive Huffman codes, which
+// need no table up front, so each one is written to writer as its data comes
+// in instead of being held in memory until Close
+func NewAdaptiveWriter(writer io.Writer) *Writer {
+	compressor := compression.CreateCompressor()
+	compressor.SetOutput(&output.StreamOutput{Writer: writer})
+	compressor.Messages = ioutil.Discard
+	compressor.Adaptive = true
+	return &Writer{
+		writer:     writer,
+		compressor: &compressor,
+	}
+}
+
+// Nothing is read until the first call to Next
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		reader: reader,
+	}
+}
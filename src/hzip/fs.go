@@ -0,0 +1,240 @@
+package hzip
+
+import (
+	"bytes"
+	"errors"
+	"hzip/src/compression"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+)
+
+// Read-only view of an archive as an fs.FS. Files are decoded when they are
+// opened, seeking to them through the central directory.
+type FS struct {
+	decompressor compression.Decompressor
+	nodes        map[string]*node // keyed by path, "." is the root
+}
+
+type node struct {
+	entry    compression.ArchiveEntry
+	children []string // names within the directory, sorted
+}
+
+var (
+	_ fs.FS         = (*FS)(nil)
+	_ fs.ReadDirFS  = (*FS)(nil)
+	_ fs.StatFS     = (*FS)(nil)
+	_ fs.ReadFileFS = (*FS)(nil)
+)
+
+func (fsys *FS) Open(name string) (fs.File, error) {
+	current, err := fsys.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if current.entry.Mode.IsDir() {
+		return &dirFile{fsys: fsys, path: name, node: current}, nil
+	}
+	data, err := fsys.decompressor.ReadEntry(current.entry)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &file{info: fileInfo{current.entry}, reader: bytes.NewReader(data)}, nil
+}
+
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	current, err := fsys.lookup("read", name)
+	if err != nil {
+		return nil, err
+	}
+	if current.entry.Mode.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	data, err := fsys.decompressor.ReadEntry(current.entry)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	current, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !current.entry.Mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return fsys.dirEntries(name, current.children), nil
+}
+
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	current, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{current.entry}, nil
+}
+
+// Closes the underlying archive
+func (fsys *FS) Close() error {
+	return fsys.decompressor.Close()
+}
+
+func (fsys *FS) lookup(op string, name string) (*node, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	current, ok := fsys.nodes[name]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return current, nil
+}
+
+func (fsys *FS) dirEntries(dir string, children []string) []fs.DirEntry {
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, child := range children {
+		entries = append(entries, fileInfo{fsys.nodes[path.Join(dir, child)].entry})
+	}
+	return entries
+}
+
+// Adds an archive entry, along with any parent directories the archive
+// doesn't store itself
+func (fsys *FS) add(entry compression.ArchiveEntry) error {
+	name := entry.Filename
+	if existing, ok := fsys.nodes[name]; ok {
+		if existing.entry.Mode.IsDir() != entry.Mode.IsDir() {
+			return errors.New("[ERROR] " + name + " is both a file and a directory")
+		}
+		// Like tar, a later entry with the same name wins
+		existing.entry = entry
+		return nil
+	}
+	fsys.nodes[name] = &node{entry: entry}
+	parentName := path.Dir(name)
+	parent, ok := fsys.nodes[parentName]
+	if !ok {
+		err := fsys.add(compression.ArchiveEntry{
+			Filename: parentName,
+			Mode:     fs.ModeDir | 0o755,
+		})
+		if err != nil {
+			return err
+		}
+		parent = fsys.nodes[parentName]
+	}
+	if !parent.entry.Mode.IsDir() {
+		return errors.New("[ERROR] " + parentName + " is both a file and a directory")
+	}
+	parent.children = append(parent.children, path.Base(name))
+	return nil
+}
+
+// Implements both fs.FileInfo and fs.DirEntry
+type fileInfo struct {
+	entry compression.ArchiveEntry
+}
+
+func (info fileInfo) Name() string {
+	return path.Base(info.entry.Filename)
+}
+
+func (info fileInfo) Size() int64 {
+	return int64(info.entry.Size)
+}
+
+func (info fileInfo) Mode() fs.FileMode {
+	return info.entry.Mode
+}
+
+func (info fileInfo) ModTime() time.Time {
+	return info.entry.ModTime
+}
+
+func (info fileInfo) IsDir() bool {
+	return info.entry.Mode.IsDir()
+}
+
+// The compression.ArchiveEntry the file came from
+func (info fileInfo) Sys() interface{} {
+	return info.entry
+}
+
+func (info fileInfo) Type() fs.FileMode {
+	return info.entry.Mode.Type()
+}
+
+func (info fileInfo) Info() (fs.FileInfo, error) {
+	return info, nil
+}
+
+// An opened regular file, already decoded
+type file struct {
+	info   fileInfo
+	reader *bytes.Reader
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *file) Read(buffer []byte) (int, error) {
+	return f.reader.Read(buffer)
+}
+
+func (f *file) ReadAt(buffer []byte, offset int64) (int, error) {
+	return f.reader.ReadAt(buffer, offset)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	return f.reader.Seek(offset, whence)
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+// An opened directory, remembering how far ReadDir has got
+type dirFile struct {
+	fsys   *FS
+	path   string
+	node   *node
+	offset int
+}
+
+func (dir *dirFile) Stat() (fs.FileInfo, error) {
+	return fileInfo{dir.node.entry}, nil
+}
+
+func (dir *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: dir.path, Err: errors.New("is a directory")}
+}
+
+func (dir *dirFile) Close() error {
+	return nil
+}
+
+func (dir *dirFile) ReadDir(count int) ([]fs.DirEntry, error) {
+	remaining := dir.node.children[dir.offset:]
+	if count > 0 {
+		if len(remaining) == 0 {
+			return nil, io.EOF
+		}
+		if count < len(remaining) {
+			remaining = remaining[:count]
+		}
+	}
+	dir.offset += len(remaining)
+	return dir.fsys.dirEntries(dir.path, remaining), nil
+}
+
+func sortChildren(nodes map[string]*node) {
+	for _, current := range nodes {
+		sort.Strings(current.children)
+	}
+}
@@ -0,0 +1,120 @@
+package hzip
+
+import (
+	"hzip/src/compression"
+	"hzip/src/input"
+	"hzip/src/output"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+var testFiles = map[string]string{
+	"site/index.html":         "<html>hello</html>",
+	"site/css/style.css":      "body { color: black; }",
+	"site/templates/a.tmpl":   "{{.Name}} {{.Name}} {{.Name}}",
+	"site/templates/b.tmpl":   "",
+	"site/templates/sub/c.md": "# heading",
+}
+
+// Builds an archive of testFiles in a temporary directory and opens it
+func openTestFS(t *testing.T, inputs ...string) *FS {
+	dir := t.TempDir()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	for name, content := range testFiles {
+		err := os.MkdirAll(filepath.Dir(name), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(name, []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	compressor := compression.CreateCompressor()
+	compressor.SetOutput(&output.FileOutput{
+		Filename: "test.hz",
+		Mode:     0666,
+	})
+	for _, inputName := range inputs {
+		objs, err := input.ExpandInput(inputName, ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, inputObj := range objs {
+			compressor.AddInput(inputObj)
+		}
+	}
+	err = compressor.GenerateScheme()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compressor.CompressToOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := OpenFS(filepath.Join(dir, "test.hz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		fsys.Close()
+	})
+	return fsys
+}
+
+func TestFS(t *testing.T) {
+	fsys := openTestFS(t, "site")
+	expected := make([]string, 0, len(testFiles))
+	for name := range testFiles {
+		expected = append(expected, name)
+	}
+	err := fstest.TestFS(fsys, expected...)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	fsys := openTestFS(t, "site")
+	for name, content := range testFiles {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("%s: got %q, want %q", name, data, content)
+		}
+	}
+	_, err := fsys.Open("site/missing.txt")
+	if !os.IsNotExist(err) {
+		t.Errorf("missing file should give a not-exist error, got %v", err)
+	}
+}
+
+func TestImpliedDirectories(t *testing.T) {
+	// Only the file itself is stored, its parents have to be made up
+	fsys := openTestFS(t, "site/templates/sub/c.md")
+	err := fstest.TestFS(fsys, "site/templates/sub/c.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := fsys.ReadDir("site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "templates" || !entries[0].IsDir() {
+		t.Errorf("got %v, want just the templates directory", entries)
+	}
+}
@@ -0,0 +1,43 @@
+package hzip
+
+import (
+	"hzip/src/compression"
+	"io/fs"
+	"time"
+)
+
+// Describes one entry of an archive, like tar.Header
+type Header struct {
+	Name       string      // slash separated path within the archive
+	Mode       fs.FileMode // fs.ModeDir marks a directory
+	Uid        int         // -1 if unknown
+	Gid        int         // -1 if unknown
+	ModTime    time.Time
+	AccessTime time.Time
+	Size       int64 // bytes of data, always 0 for directories and 0 from a Reader if the size follows the data
+}
+
+func headerFromEntry(entry compression.ArchiveEntry) *Header {
+	return &Header{
+		Name:       entry.Filename,
+		Mode:       entry.Mode,
+		Uid:        entry.OwnerID,
+		Gid:        entry.GroupID,
+		ModTime:    entry.ModTime,
+		AccessTime: entry.AccessTime,
+		Size:       int64(entry.Size),
+	}
+}
+
+// The fs.FileInfo of the entry, as used by the archive's fs.FS view
+func (header *Header) FileInfo() fs.FileInfo {
+	return fileInfo{compression.ArchiveEntry{
+		Filename:   header.Name,
+		Mode:       header.Mode,
+		OwnerID:    header.Uid,
+		GroupID:    header.Gid,
+		ModTime:    header.ModTime,
+		AccessTime: header.AccessTime,
+		Size:       uint64(header.Size),
+	}}
+}
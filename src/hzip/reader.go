@@ -0,0 +1,91 @@
+package hzip
+
+import (
+	"hzip/src/compression"
+	"io"
+	"io/ioutil"
+)
+
+// Reads an archive entry by entry from a stream, like tar.Reader. Data is
+// only decoded if it is read, and then as it's read, so an entry is never
+// held in memory whole; entries that are skipped are passed over.
+type Reader struct {
+	reader       io.Reader
+	decompressor compression.Decompressor
+	started      bool
+	current      *Header
+	data         *io.PipeReader // decoded data of the current entry, once reading started
+	decoded      chan error     // the result of decoding into data, when it's done
+	err          error          // sticky, once the archive turned out to be bad
+}
+
+// Moves on to the next entry. Returns io.EOF at the end of the archive, once
+// its checksums and central directory have been verified.
+func (reader *Reader) Next() (*Header, error) {
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	if !reader.started {
+		reader.started = true
+		reader.decompressor = compression.CreateDecompressor("")
+		// Problems come back as errors, there's no one to show progress to
+		reader.decompressor.Messages = ioutil.Discard
+		err := reader.decompressor.ReadMetaFrom(reader.reader)
+		if err != nil {
+			reader.err = err
+			return nil, err
+		}
+	}
+	err := reader.finishData()
+	if err != nil {
+		reader.err = err
+		return nil, err
+	}
+	entry, err := reader.decompressor.NextHeader()
+	if err != nil {
+		reader.err = err
+		reader.current = nil
+		return nil, err
+	}
+	reader.current = headerFromEntry(entry)
+	return reader.current, nil
+}
+
+// Reads data of the current entry
+func (reader *Reader) Read(buffer []byte) (int, error) {
+	if reader.err != nil {
+		return 0, reader.err
+	}
+	if reader.current == nil {
+		return 0, io.EOF
+	}
+	if reader.data == nil {
+		data, decodeTo := io.Pipe()
+		reader.data = data
+		reader.decoded = make(chan error, 1)
+		go func() {
+			err := reader.decompressor.ReadDataTo(decodeTo)
+			// A nil error ends data with io.EOF
+			decodeTo.CloseWithError(err)
+			reader.decoded <- err
+		}()
+	}
+	n, err := reader.data.Read(buffer)
+	if err != nil && err != io.EOF {
+		reader.err = err
+	}
+	return n, err
+}
+
+// Decodes what's left of the current entry's data if reading it had started,
+// since the stream can only move on to the next record from the end of this
+// one
+func (reader *Reader) finishData() error {
+	if reader.data == nil {
+		return nil
+	}
+	io.Copy(ioutil.Discard, reader.data)
+	err := <-reader.decoded
+	reader.data = nil
+	return err
+}
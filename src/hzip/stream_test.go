@@ -0,0 +1,237 @@
+package hzip
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var streamEntries = []struct {
+	header  Header
+	content string
+}{
+	{Header{Name: "docs", Mode: fs.ModeDir | 0o755, Uid: -1, Gid: -1}, ""},
+	{Header{Name: "docs/readme.txt", Mode: 0o644, Uid: 1000, Gid: 1000}, "read me, read me, read me"},
+	{Header{Name: "docs/skipped.txt", Mode: 0o600, Uid: -1, Gid: -1}, strings.Repeat("not read ", 100)},
+	{Header{Name: "docs/empty.txt", Mode: 0o644, Uid: -1, Gid: -1}, ""},
+	{Header{Name: "config.json", Mode: 0o640, Uid: 0, Gid: 0}, `{"key": "value"}`},
+}
+
+func writeStreamArchive(t *testing.T, newWriter func(io.Writer) *Writer) []byte {
+	var archive bytes.Buffer
+	writer := newWriter(&archive)
+	modTime := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, streamEntry := range streamEntries {
+		header := streamEntry.header
+		header.ModTime = modTime
+		header.Size = int64(len(streamEntry.content))
+		err := writer.WriteHeader(&header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.WriteString(writer, streamEntry.content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	writers := []struct {
+		name      string
+		newWriter func(io.Writer) *Writer
+		sizes     bool
+	}{
+		{"buffered", NewWriter, true},
+		// Adaptive entries only give their sizes after their data
+		{"adaptive", NewAdaptiveWriter, false},
+	}
+	for _, test := range writers {
+		t.Run(test.name, func(t *testing.T) {
+			archive := writeStreamArchive(t, test.newWriter)
+			reader := NewReader(bytes.NewReader(archive))
+			for _, streamEntry := range streamEntries {
+				header, err := reader.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := streamEntry.header
+				if header.Name != want.Name || header.Mode != want.Mode || header.Uid != want.Uid || header.Gid != want.Gid {
+					t.Errorf("got header %+v, want %+v", *header, want)
+				}
+				if test.sizes && header.Size != int64(len(streamEntry.content)) {
+					t.Errorf("%s: got size %d, want %d", header.Name, header.Size, len(streamEntry.content))
+				}
+				if strings.Contains(header.Name, "skipped") {
+					continue
+				}
+				data, err := ioutil.ReadAll(reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != streamEntry.content {
+					t.Errorf("%s: got %q, want %q", header.Name, data, streamEntry.content)
+				}
+			}
+			_, err := reader.Next()
+			if err != io.EOF {
+				t.Errorf("expected io.EOF after the last entry, got %v", err)
+			}
+		})
+	}
+}
+
+func TestAdaptiveWriterStreams(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "streamed.hz")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := NewAdaptiveWriter(file)
+	content := bytes.Repeat([]byte("written as it comes, not at Close\n"), 10000)
+	err = writer.WriteHeader(&Header{Name: "big.txt", Mode: 0o644, Uid: -1, Gid: -1, Size: int64(len(content))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = writer.Write(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() == 0 {
+		t.Error("entry data should reach the writer before Close")
+	}
+	err = writer.WriteHeader(&Header{Name: "small.txt", Mode: 0o644, Uid: -1, Gid: -1, Size: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.WriteString(writer, "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The central directory has the sizes the records leave out
+	fsys, err := OpenFS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fsys.Close()
+	want := map[string]string{"big.txt": string(content), "small.txt": "small"}
+	for name, content := range want {
+		info, err := fs.Stat(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(len(content)) {
+			t.Errorf("%s: got size %d, want %d", name, info.Size(), len(content))
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("%s: content doesn't match what was written", name)
+		}
+	}
+}
+
+func TestStreamDetectsCorruption(t *testing.T) {
+	archive := writeStreamArchive(t, NewWriter)
+	// The trailer checksum covers every byte, even of skipped entries
+	archive[len(archive)/2] ^= 0x01
+	reader := NewReader(bytes.NewReader(archive))
+	var err error
+	for err == nil {
+		_, err = reader.Next()
+	}
+	if err == io.EOF {
+		t.Error("corrupted archive should not read cleanly")
+	}
+}
+
+func TestWriteTooLong(t *testing.T) {
+	writer := NewWriter(ioutil.Discard)
+	err := writer.WriteHeader(&Header{Name: "a.txt", Mode: 0o644, Size: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := writer.Write([]byte("abcd"))
+	if err != ErrWriteTooLong || n != 3 {
+		t.Errorf("got %d, %v, want 3, ErrWriteTooLong", n, err)
+	}
+	err = writer.WriteHeader(&Header{Name: "b.txt", Mode: 0o644, Size: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = writer.Write([]byte("ab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Close()
+	if err == nil {
+		t.Error("closing with a short entry should fail")
+	}
+}
+
+func TestWriteHeaderLargeSize(t *testing.T) {
+	// Nothing is reserved for data that hasn't been written
+	writer := NewWriter(ioutil.Discard)
+	err := writer.WriteHeader(&Header{Name: "big", Mode: 0o644, Size: 1 << 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.WriteString(writer, "far short")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Close()
+	if err == nil {
+		t.Error("closing with a short entry should fail")
+	}
+}
+
+func TestStreamPartialRead(t *testing.T) {
+	archive := writeStreamArchive(t, NewWriter)
+	reader := NewReader(bytes.NewReader(archive))
+	for _, streamEntry := range streamEntries {
+		header, err := reader.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Name != streamEntry.header.Name {
+			t.Fatalf("got %s, want %s", header.Name, streamEntry.header.Name)
+		}
+		// Only the start of each entry, the rest is decoded on moving on
+		buffer := make([]byte, 4)
+		n, err := io.ReadFull(reader, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(streamEntry.content, string(buffer[:n])) {
+			t.Errorf("%s: got %q, want the start of %q", header.Name, buffer[:n], streamEntry.content)
+		}
+	}
+	_, err := reader.Next()
+	if err != io.EOF {
+		t.Errorf("expected io.EOF after the last entry, got %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package hzip
+
+import (
+	"errors"
+	"fmt"
+	"hzip/src/compression"
+	"hzip/src/input"
+	"hzip/src/output"
+	"io"
+	"io/ioutil"
+)
+
+// Most memory reserved for an entry up front, however large its header says
+// it is; data beyond that grows the buffer as it's written
+const maxPreallocation = 16 * 1024 * 1024
+
+var (
+	ErrWriteTooLong    = errors.New("[ERROR] Write beyond the size given in the header")
+	ErrWriteAfterClose = errors.New("[ERROR] Write after the archive was closed")
+)
+
+// Writes an archive entry by entry, like tar.Writer. From NewWriter, the
+// archive's Huffman table has to come before any entry, so the data is held
+// in memory and the archive is only written to the underlying writer by
+// Close. From NewAdaptiveWriter, each entry is coded and written as its data
+// comes in.
+type Writer struct {
+	writer  io.Writer
+	inputs  []input.MemoryInput
+	current *Header
+	data    []byte
+	written int64 // bytes of the current entry so far
+	closed  bool
+	// Only set from NewAdaptiveWriter
+	compressor *compression.Compressor
+	entry      *compression.EntryWriter
+	started    bool
+}
+
+func (writer *Writer) WriteHeader(header *Header) error {
+	if writer.closed {
+		return ErrWriteAfterClose
+	}
+	err := writer.finishEntry()
+	if err != nil {
+		return err
+	}
+	if header.Name == "" {
+		return errors.New("[ERROR] Entry must have a name")
+	}
+	if header.Size < 0 || (header.Mode.IsDir() && header.Size != 0) {
+		return fmt.Errorf("[ERROR] Invalid size %d for %s", header.Size, header.Name)
+	}
+	current := *header
+	if writer.compressor != nil {
+		err := writer.start()
+		if err != nil {
+			return err
+		}
+		writer.entry, err = writer.compressor.CreateEntry(header.Name, fileMeta(header))
+		if err != nil {
+			return err
+		}
+	} else {
+		// The size hasn't been backed by any data yet, so only trust it so far
+		preallocate := header.Size
+		if preallocate > maxPreallocation {
+			preallocate = maxPreallocation
+		}
+		writer.data = make([]byte, 0, preallocate)
+	}
+	writer.current = &current
+	writer.written = 0
+	return nil
+}
+
+// Writes data for the entry of the last WriteHeader call
+func (writer *Writer) Write(data []byte) (int, error) {
+	if writer.closed {
+		return 0, ErrWriteAfterClose
+	}
+	if writer.current == nil {
+		return 0, errors.New("[ERROR] Write before WriteHeader")
+	}
+	room := writer.current.Size - writer.written
+	if int64(len(data)) > room {
+		n, err := writer.write(data[:room])
+		if err != nil {
+			return n, err
+		}
+		return n, ErrWriteTooLong
+	}
+	return writer.write(data)
+}
+
+func (writer *Writer) write(data []byte) (int, error) {
+	if writer.entry != nil {
+		n, err := writer.entry.Write(data)
+		writer.written += int64(n)
+		return n, err
+	}
+	writer.data = append(writer.data, data...)
+	writer.written += int64(len(data))
+	return len(data), nil
+}
+
+// Writes the whole archive to the underlying writer, which is left open
+func (writer *Writer) Close() error {
+	if writer.closed {
+		return nil
+	}
+	err := writer.finishEntry()
+	if err != nil {
+		return err
+	}
+	writer.closed = true
+	if writer.compressor != nil {
+		err := writer.start()
+		if err != nil {
+			return err
+		}
+		return writer.compressor.FinishArchive()
+	}
+	compressor := compression.CreateCompressor()
+	compressor.SetOutput(&output.StreamOutput{Writer: writer.writer})
+	compressor.Messages = ioutil.Discard
+	for _, inputObj := range writer.inputs {
+		compressor.AddInput(inputObj)
+	}
+	writer.inputs = nil
+	err = compressor.GenerateScheme()
+	if err != nil {
+		return err
+	}
+	return compressor.CompressToOutput()
+}
+
+func (writer *Writer) finishEntry() error {
+	if writer.current == nil {
+		return nil
+	}
+	header := writer.current
+	if writer.written != header.Size {
+		return fmt.Errorf("[ERROR] %s is %d bytes short of the size in its header", header.Name, header.Size-writer.written)
+	}
+	if writer.entry != nil {
+		err := writer.entry.Close()
+		if err != nil {
+			return err
+		}
+		writer.entry = nil
+	} else {
+		writer.inputs = append(writer.inputs, input.MemoryInput{
+			Name: header.Name,
+			Data: writer.data,
+			Meta: fileMeta(header),
+		})
+	}
+	writer.current = nil
+	writer.data = nil
+	return nil
+}
+
+// Writes the start of an adaptive archive, once
+func (writer *Writer) start() error {
+	if writer.started {
+		return nil
+	}
+	writer.started = true
+	return writer.compressor.StartArchive()
+}
+
+func fileMeta(header *Header) input.FileMeta {
+	return input.FileMeta{
+		Mode:       header.Mode,
+		Owner_ID:   header.Uid,
+		Group_ID:   header.Gid,
+		ModTime:    header.ModTime,
+		AccessTime: header.AccessTime,
+	}
+}
@@ -1,5 +1,11 @@
 package input
 
+import "io"
+
 type Input interface {
-	GetData() ([]byte, error)
+	// Streams the data, which is never read into memory all at once
+	Open() (io.ReadCloser, error)
+	// Path the input is stored under in the archive
+	GetName() string
+	GetMeta() Meta
 }
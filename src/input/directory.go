@@ -0,0 +1,26 @@
+package input
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+// Directories are stored as entries without data so their metadata can be
+// restored, and so empty directories survive a round trip
+type DirectoryInput struct {
+	Dirname string
+	Meta    Meta
+}
+
+func (dir_input DirectoryInput) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(nil)), nil
+}
+
+func (dir_input DirectoryInput) GetName() string {
+	return dir_input.Dirname
+}
+
+func (dir_input DirectoryInput) GetMeta() Meta {
+	return dir_input.Meta
+}
@@ -1,8 +1,8 @@
 package input
 
 import (
-	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 )
@@ -12,44 +12,69 @@ type FileInput struct {
 	Meta     Meta
 }
 
-func (file_input FileInput) GetData() ([]byte, error) {
-	data, err := os.ReadFile(file_input.Filename)
+func (file_input FileInput) Open() (io.ReadCloser, error) {
+	file, err := os.Open(file_input.Filename)
 	if err != nil {
-		fmt.Println("[ERROR]", err)
-		return nil, errors.New("[ERROR] Failed to read file")
+		return nil, fmt.Errorf("[ERROR] Failed to open file: %v", err)
 	}
-	return data, nil
+	return file, nil
 }
 
-func ExpandInput(filename string) ([]Input, error) {
+func (file_input FileInput) GetName() string {
+	return file_input.Filename
+}
+
+func (file_input FileInput) GetMeta() Meta {
+	return file_input.Meta
+}
+
+// Collects filename and everything under it, warning on messages about
+// anything left out. Inputs get their modification time as their access
+// time too, since reading them to compress them changes the real one, which
+// would keep archives of unchanged files from coming out the same.
+func ExpandInput(filename string, messages io.Writer) ([]Input, error) {
 	inputs := make([]Input, 0)
 	stat_obj, err := os.Lstat(filename)
 	if err != nil {
-		fmt.Println("[ERROR] ", err)
-		return nil, errors.New("[ERROR] Failed to open location")
+		return nil, fmt.Errorf("[ERROR] Failed to open location: %v", err)
 	}
 	if (stat_obj.Mode() & os.ModeSymlink) == os.ModeSymlink {
-		fmt.Println("[WARNING] Excluding symlink: " + filename)
+		fmt.Fprintln(messages, "[WARNING] Excluding symlink: "+filename)
 	} else if stat_obj.IsDir() {
+		owner_id, group_id := statOwnership(stat_obj)
+		inputs = append(inputs, DirectoryInput{
+			Dirname: filename,
+			Meta: DirectoryMeta{
+				Mode:       stat_obj.Mode(),
+				Owner_ID:   owner_id,
+				Group_ID:   group_id,
+				ModTime:    stat_obj.ModTime(),
+				AccessTime: stat_obj.ModTime(),
+				Name:       stat_obj.Name(),
+			},
+		})
 		subdirs, err := ioutil.ReadDir(filename)
 		if err != nil {
-			fmt.Println("[ERROR] Couldn't list directory " + filename)
-			return nil, errors.New("[ERROR] Failed to read directory")
+			return nil, fmt.Errorf("[ERROR] Couldn't list directory %s: %v", filename, err)
 		}
 		for _, subdir := range subdirs {
-			sub_inputs, err := ExpandInput(filename + "/" + subdir.Name())
+			sub_inputs, err := ExpandInput(filename+"/"+subdir.Name(), messages)
 			if err != nil {
-				fmt.Println("[ERROR] Failed to expand subdirectories of " + subdir.Name())
-				return nil, errors.New("[ERROR] Subdirectory error")
+				return nil, err
 			}
 			inputs = append(inputs, sub_inputs...)
 		}
 	} else {
 		// TODO This may be a good place to verify that files are readable or error out
+		owner_id, group_id := statOwnership(stat_obj)
 		inputs = append(inputs, FileInput{
 			Filename: filename,
 			Meta: FileMeta{
-				Mode: stat_obj.Mode(),
+				Mode:       stat_obj.Mode(),
+				Owner_ID:   owner_id,
+				Group_ID:   group_id,
+				ModTime:    stat_obj.ModTime(),
+				AccessTime: stat_obj.ModTime(),
 			},
 		})
 	}
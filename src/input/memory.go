@@ -0,0 +1,26 @@
+package input
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+// Input already held in memory, for archives built without files on disk
+type MemoryInput struct {
+	Name string
+	Data []byte
+	Meta Meta
+}
+
+func (mem_input MemoryInput) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(mem_input.Data)), nil
+}
+
+func (mem_input MemoryInput) GetName() string {
+	return mem_input.Name
+}
+
+func (mem_input MemoryInput) GetMeta() Meta {
+	return mem_input.Meta
+}
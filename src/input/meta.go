@@ -1,28 +1,71 @@
 package input
 
-import "io/fs"
+import (
+	"io/fs"
+	"time"
+)
 
 type Meta interface {
 	GetMode() fs.FileMode
+	GetOwnerID() int // -1 if unknown
+	GetGroupID() int // -1 if unknown
+	GetModTime() time.Time
+	GetAccessTime() time.Time
 }
 
 type FileMeta struct {
-	Mode     fs.FileMode
-	Owner_ID int
-	Group_ID int
+	Mode       fs.FileMode
+	Owner_ID   int
+	Group_ID   int
+	ModTime    time.Time
+	AccessTime time.Time
 }
 
 func (meta FileMeta) GetMode() fs.FileMode {
 	return meta.Mode
 }
 
+func (meta FileMeta) GetOwnerID() int {
+	return meta.Owner_ID
+}
+
+func (meta FileMeta) GetGroupID() int {
+	return meta.Group_ID
+}
+
+func (meta FileMeta) GetModTime() time.Time {
+	return meta.ModTime
+}
+
+func (meta FileMeta) GetAccessTime() time.Time {
+	return meta.AccessTime
+}
+
 type DirectoryMeta struct {
-	Mode     fs.FileMode
-	Owner_ID int
-	Group_ID int
-	Name     string
+	Mode       fs.FileMode
+	Owner_ID   int
+	Group_ID   int
+	ModTime    time.Time
+	AccessTime time.Time
+	Name       string
 }
 
 func (meta DirectoryMeta) GetMode() fs.FileMode {
 	return meta.Mode
 }
+
+func (meta DirectoryMeta) GetOwnerID() int {
+	return meta.Owner_ID
+}
+
+func (meta DirectoryMeta) GetGroupID() int {
+	return meta.Group_ID
+}
+
+func (meta DirectoryMeta) GetModTime() time.Time {
+	return meta.ModTime
+}
+
+func (meta DirectoryMeta) GetAccessTime() time.Time {
+	return meta.AccessTime
+}
@@ -0,0 +1,14 @@
+package input
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+func statOwnership(stat_obj fs.FileInfo) (int, int) {
+	sys, ok := stat_obj.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, -1
+	}
+	return int(sys.Uid), int(sys.Gid)
+}
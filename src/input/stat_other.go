@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package input
+
+import (
+	"io/fs"
+)
+
+// Ownership isn't available here
+func statOwnership(stat_obj fs.FileInfo) (int, int) {
+	return -1, -1
+}
@@ -0,0 +1,32 @@
+package input
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// Input read from a stream such as stdin, which can only be read once. It
+// only suits one-pass compression, which doesn't count bytes first.
+type StreamInput struct {
+	Name   string
+	Reader io.Reader
+	Meta   Meta
+	opened bool
+}
+
+func (stream_input *StreamInput) Open() (io.ReadCloser, error) {
+	if stream_input.opened {
+		return nil, errors.New("[ERROR] " + stream_input.Name + " can only be read once")
+	}
+	stream_input.opened = true
+	return ioutil.NopCloser(stream_input.Reader), nil
+}
+
+func (stream_input *StreamInput) GetName() string {
+	return stream_input.Name
+}
+
+func (stream_input *StreamInput) GetMeta() Meta {
+	return stream_input.Meta
+}
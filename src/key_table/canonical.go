@@ -0,0 +1,174 @@
+package key_table
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"github.com/dgryski/go-bitstream"
+)
+
+// Code length in bits of every byte value, 0 for bytes that never occur
+type CodeLengths [256]int
+
+// Longest code a table can have. Codes are held in a uint64 while they are
+// assigned, and the table decoder tops its 64 bit buffer up a byte at a time,
+// so 57 bits is as much of a code as it is sure to see at once.
+const MaxCodeLength = 57
+
+func (table KeyTable) CodeLengths() CodeLengths {
+	var lengths CodeLengths
+	for key, value := range table.Table {
+		lengths[key] = value.Length
+	}
+	return lengths
+}
+
+// Replaces the table with canonical Huffman codes for the given lengths.
+// Symbols are ordered by code length and then by value; the first gets the
+// all zero code and each following code is the previous one plus one,
+// shifted left whenever the length grows. The lengths alone are therefore
+// enough to rebuild the exact same table.
+func (table *KeyTable) SetCodeLengths(lengths CodeLengths) error {
+	symbols := make([]byte, 0, len(lengths))
+	kraftSum := 0.0
+	for symbol, length := range lengths {
+		if length < 0 || length > MaxCodeLength {
+			return fmt.Errorf("[ERROR] Invalid code length %d for symbol %d", length, symbol)
+		}
+		if length > 0 {
+			symbols = append(symbols, byte(symbol))
+			kraftSum += 1 / float64(uint64(1)<<uint(length))
+		}
+	}
+	if kraftSum > 1 {
+		return errors.New("[ERROR] Code lengths don't describe a prefix code")
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		if lengths[symbols[i]] != lengths[symbols[j]] {
+			return lengths[symbols[i]] < lengths[symbols[j]]
+		}
+		return symbols[i] < symbols[j]
+	})
+	table.Table = make(map[byte]KeyTableData)
+	code := uint64(0)
+	previousLength := 0
+	for i, symbol := range symbols {
+		length := lengths[symbol]
+		if i > 0 {
+			code++
+		}
+		code <<= uint(length - previousLength)
+		previousLength = length
+		var buf bytes.Buffer
+		writer := bitstream.NewWriter(&buf)
+		err := writer.WriteBits(code, length)
+		if err != nil {
+			return errors.New("[ERROR] Failed to write code to buffer")
+		}
+		err = writer.Flush(bitstream.Zero)
+		if err != nil {
+			return errors.New("[ERROR] Failed to flush code buffer")
+		}
+		table.Table[symbol] = KeyTableData{
+			Length: length,
+			Data:   buf,
+			Code:   code,
+		}
+	}
+	return nil
+}
+
+func (lengths CodeLengths) Write(writer *bitstream.BitWriter) error {
+	/*
+		Code lengths are stored run-length encoded:
+		----------------------------------------------
+		|--- bit width W of a single length (4 bits) ---|
+		until all 256 symbols are covered {
+			|--- 0 (1 bit) ---| |--- code length (W bits) ---|
+			or
+			|--- 1 (1 bit) ---| |--- number of unused symbols - 1 (8 bits) ---|
+		}
+		----------------------------------------------
+	*/
+	maxLength := 0
+	for _, length := range lengths {
+		if length > maxLength {
+			maxLength = length
+		}
+	}
+	width := bits.Len(uint(maxLength))
+	if width == 0 {
+		width = 1
+	}
+	err := writer.WriteBits(uint64(width), 4)
+	if err != nil {
+		return errors.New("[ERROR] Failed to write code length width")
+	}
+	for symbol := 0; symbol < len(lengths); {
+		if lengths[symbol] != 0 {
+			err = writer.WriteBit(bitstream.Zero)
+			if err == nil {
+				err = writer.WriteBits(uint64(lengths[symbol]), width)
+			}
+			if err != nil {
+				return errors.New("[ERROR] Failed to write code length")
+			}
+			symbol++
+			continue
+		}
+		run := 1
+		for symbol+run < len(lengths) && lengths[symbol+run] == 0 {
+			run++
+		}
+		err = writer.WriteBit(bitstream.One)
+		if err == nil {
+			err = writer.WriteBits(uint64(run-1), 8)
+		}
+		if err != nil {
+			return errors.New("[ERROR] Failed to write unused symbol run")
+		}
+		symbol += run
+	}
+	return nil
+}
+
+// Also returns the number of bits consumed so the caller can skip the padding
+// up to the next byte boundary
+func ReadCodeLengths(reader *bitstream.BitReader) (CodeLengths, int, error) {
+	var lengths CodeLengths
+	width, err := reader.ReadBits(4)
+	if err != nil {
+		return lengths, 0, errors.New("[ERROR] Couldn't read code length width")
+	}
+	bitsRead := 4
+	for symbol := 0; symbol < len(lengths); {
+		isRun, err := reader.ReadBit()
+		bitsRead++
+		if err != nil {
+			return lengths, bitsRead, errors.New("[ERROR] Couldn't read code length")
+		}
+		if isRun == bitstream.Zero {
+			length, err := reader.ReadBits(int(width))
+			bitsRead += int(width)
+			if err != nil {
+				return lengths, bitsRead, errors.New("[ERROR] Couldn't read code length")
+			}
+			lengths[symbol] = int(length)
+			symbol++
+			continue
+		}
+		run, err := reader.ReadBits(8)
+		bitsRead += 8
+		if err != nil {
+			return lengths, bitsRead, errors.New("[ERROR] Couldn't read unused symbol run")
+		}
+		symbol += int(run) + 1
+		if symbol > len(lengths) {
+			return lengths, bitsRead, errors.New("[ERROR] Unused symbol run overflows the code length table")
+		}
+	}
+	return lengths, bitsRead, nil
+}
@@ -0,0 +1,64 @@
+package key_table
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dgryski/go-bitstream"
+)
+
+/*
+	Archives before format version 3 store every code bit by bit:
+	----------------------------------------------
+	|--- number of key table entries (8 bytes) ---|
+	for each key table entry {
+		|--- key (1 byte) ---|
+		|--- length (8 bytes) ---|
+		|--- code ($length bits) ---|
+	}
+	----------------------------------------------
+*/
+
+// Reads a key table stored as explicit codes. Also returns the number of bits
+// consumed so the caller can skip the padding up to the next byte boundary.
+func ReadCodes(reader *bitstream.BitReader) (KeyTable, int, error) {
+	table := CreateKeyTable()
+	numEntries, err := reader.ReadBits(64)
+	if err != nil {
+		return table, 0, errors.New("[ERROR] Couldn't read key table size")
+	}
+	bitsRead := 64
+	if numEntries > 256 {
+		return table, bitsRead, fmt.Errorf("[ERROR] Key table claims %d entries, there are only 256 bytes", numEntries)
+	}
+	for i := uint64(0); i < numEntries; i++ {
+		key, err := reader.ReadByte()
+		if err != nil {
+			return table, bitsRead, errors.New("[ERROR] Couldn't read key")
+		}
+		length, err := reader.ReadBits(64)
+		if err != nil {
+			return table, bitsRead, errors.New("[ERROR] Couldn't read code length")
+		}
+		bitsRead += 72
+		if length > MaxCodeLength {
+			return table, bitsRead, fmt.Errorf("[ERROR] Code of %d bits for symbol %d is longer than the decoder supports", length, key)
+		}
+		if _, ok := table.Table[key]; ok {
+			return table, bitsRead, fmt.Errorf("[ERROR] Symbol %d appears twice in the key table", key)
+		}
+		code := uint64(0)
+		if length > 0 {
+			code, err = reader.ReadBits(int(length))
+			if err != nil {
+				return table, bitsRead, errors.New("[ERROR] Couldn't read code")
+			}
+		}
+		bitsRead += int(length)
+		table.Table[key] = KeyTableData{
+			Length: int(length),
+			Code:   code,
+		}
+	}
+	return table, bitsRead, nil
+}
@@ -5,3 +5,9 @@ func CreateKeyTable() KeyTable {
 		Table: make(map[byte]KeyTableData),
 	}
 }
+
+func CreateKeyTableFromLengths(lengths CodeLengths) (KeyTable, error) {
+	table := CreateKeyTable()
+	err := table.SetCodeLengths(lengths)
+	return table, err
+}
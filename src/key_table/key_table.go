@@ -11,6 +11,7 @@ import (
 type KeyTableData struct {
 	Length int // bits
 	Data   bytes.Buffer
+	Code   uint64 // Data as an integer, only set for canonical codes and by ReadCodes
 }
 
 type KeyTable struct {
@@ -32,62 +33,57 @@ func (table KeyTable) Get(key byte) (*KeyTableData, error) {
 	return &item, nil
 }
 
+// Only the shape of the tree is used: codes are reassigned canonically from
+// the depth of each leaf
 func (table *KeyTable) ReadTree(tree *huffman_tree.HuffmanTree) error {
-	var buf bytes.Buffer
-	table.AddSubtreeWithPrefix(buf, 0, &tree.Head)
-	return nil
+	return table.SetCodeLengths(TreeCodeLengths(tree))
 }
 
-func (table *KeyTable) WriteTree() (*huffman_tree.HuffmanTree, error) {
-	tree_head := huffman_tree.TreeNode{
-		LeftChild:  nil,
-		RightChild: nil,
+// Depth of every leaf of a tree, which may be more than MaxCodeLength
+func TreeCodeLengths(tree *huffman_tree.HuffmanTree) CodeLengths {
+	var lengths CodeLengths
+	if tree.Head.IsLeaf() {
+		// A single symbol still needs a 1 bit code
+		lengths[tree.Head.Data()] = 1
+	} else {
+		collectCodeLengths(&tree.Head, 0, &lengths)
 	}
+	return lengths
+}
+
+func collectCodeLengths(tree_node *huffman_tree.HTreeNode, depth int, lengths *CodeLengths) {
+	if (*tree_node).IsLeaf() {
+		lengths[(*tree_node).Data()] = depth
+		return
+	}
+	if (*tree_node).Left() != nil {
+		collectCodeLengths((*tree_node).Left(), depth+1, lengths)
+	}
+	if (*tree_node).Right() != nil {
+		collectCodeLengths((*tree_node).Right(), depth+1, lengths)
+	}
+}
+
+func (table *KeyTable) WriteTree() (*huffman_tree.HuffmanTree, error) {
+	codes := make([]keyCode, 0, len(table.Table))
 	for key, value := range table.Table {
-		var current_node *huffman_tree.TreeNode
-		current_node = &tree_head
-		reader := bitstream.NewReader(&value.Data)
-		for i := 0; i < value.Length-1; i++ {
+		code := keyCode{
+			Key:  key,
+			Bits: make([]bitstream.Bit, value.Length),
+		}
+		reader := bitstream.NewReader(bytes.NewReader(value.Data.Bytes()))
+		for i := 0; i < value.Length; i++ {
 			bit, err := reader.ReadBit()
 			if err != nil {
 				return nil, errors.New("[ERROR] Failed to read bit from key table value")
 			}
-			var blank_tree_node huffman_tree.HTreeNode = huffman_tree.TreeNode{
-				LeftChild:  nil,
-				RightChild: nil,
-			}
-			var next_node huffman_tree.TreeNode
-			if bit == bitstream.Zero { // Left
-				if current_node.LeftChild == nil {
-					current_node.LeftChild = &blank_tree_node
-				}
-				next_node = (*current_node.LeftChild).(huffman_tree.TreeNode)
-			} else if bit == bitstream.One { // Right
-				if current_node.RightChild == nil {
-					current_node.RightChild = &blank_tree_node
-				}
-				next_node = (*current_node.RightChild).(huffman_tree.TreeNode)
-			} else {
-				return nil, errors.New("[ERROR] Got invalid bit from key table value")
-			}
-			current_node = &next_node
-		}
-		// current_node is now where we will append a leaf node
-		bit, err := reader.ReadBit()
-		if err != nil {
-			return nil, errors.New("[ERROR] Failed to read bit from key table value")
-		}
-		var new_leaf huffman_tree.HTreeNode = huffman_tree.LeafNode{
-			Freq:     0, // We don't care about frequency at this point
-			LeafData: key,
-		}
-		if bit == bitstream.Zero { // Left
-			current_node.LeftChild = &new_leaf
-		} else if bit == bitstream.One { // Right
-			current_node.LeftChild = &new_leaf
-		} else {
-			return nil, errors.New("[ERROR] Got invalid bit from key table value")
+			code.Bits[i] = bit
 		}
+		codes = append(codes, code)
+	}
+	tree_head, err := buildSubtree(codes, 0)
+	if err != nil {
+		return nil, err
 	}
 	tree := huffman_tree.HuffmanTree{
 		Head:      tree_head,
@@ -96,39 +92,52 @@ func (table *KeyTable) WriteTree() (*huffman_tree.HuffmanTree, error) {
 	return &tree, nil
 }
 
-func (table *KeyTable) AddSubtreeWithPrefix(prefix bytes.Buffer, prefix_len int, tree_node *huffman_tree.HTreeNode) {
-	if (*tree_node).IsLeaf() {
-		table.Add((*tree_node).Data(), prefix, prefix_len)
-	} else {
-		if (*tree_node).Left() != nil {
-			// Left is a 0
-			var buf bytes.Buffer
-			writer := bitstream.NewWriter(&buf)
-			CopyNumBitsToBitstreamWriter(prefix, writer, prefix_len)
-			writer.WriteBit(bitstream.Zero)
-			writer.Flush(bitstream.Zero)
-			table.AddSubtreeWithPrefix(buf, prefix_len+1, (*tree_node).Left())
+type keyCode struct {
+	Key  byte
+	Bits []bitstream.Bit
+}
+
+// Tree nodes are stored by value, so the tree has to be built bottom up:
+// split the codes on the bit at depth and recurse into each half
+func buildSubtree(codes []keyCode, depth int) (huffman_tree.HTreeNode, error) {
+	if len(codes) == 0 {
+		return nil, errors.New("[ERROR] Key table leaves a gap in the tree")
+	}
+	if len(codes[0].Bits) == depth {
+		if len(codes) > 1 {
+			return nil, errors.New("[ERROR] Key table codes aren't prefix free")
 		}
-		if (*tree_node).Right() != nil {
-			// Right is a 1
-			var buf bytes.Buffer
-			writer := bitstream.NewWriter(&buf)
-			CopyNumBitsToBitstreamWriter(prefix, writer, prefix_len)
-			writer.WriteBit(bitstream.One)
-			writer.Flush(bitstream.Zero)
-			table.AddSubtreeWithPrefix(buf, prefix_len+1, (*tree_node).Right())
+		return huffman_tree.LeafNode{
+			Freq:     0, // We don't care about frequency at this point
+			LeafData: codes[0].Key,
+		}, nil
+	}
+	left := make([]keyCode, 0)
+	right := make([]keyCode, 0)
+	for _, code := range codes {
+		if len(code.Bits) == depth {
+			return nil, errors.New("[ERROR] Key table codes aren't prefix free")
+		}
+		if code.Bits[depth] == bitstream.Zero {
+			left = append(left, code)
+		} else {
+			right = append(right, code)
 		}
 	}
-}
-
-func CopyNumBitsToBitstreamWriter(in bytes.Buffer, out *bitstream.BitWriter, num_bits int) error {
-	in_stream := bitstream.NewReader(bytes.NewReader(in.Bytes()))
-	for i := 0; i < num_bits; i++ {
-		bit, err := in_stream.ReadBit()
+	node := huffman_tree.TreeNode{}
+	if len(left) > 0 {
+		leftNode, err := buildSubtree(left, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		node.LeftChild = &leftNode
+	}
+	if len(right) > 0 {
+		rightNode, err := buildSubtree(right, depth+1)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		out.WriteBit(bit)
+		node.RightChild = &rightNode
 	}
-	return nil
+	return node, nil
 }
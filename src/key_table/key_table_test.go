@@ -0,0 +1,91 @@
+package key_table
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dgryski/go-bitstream"
+)
+
+func readCode(t *testing.T, data KeyTableData) uint64 {
+	reader := bitstream.NewReader(bytes.NewReader(data.Data.Bytes()))
+	code, err := reader.ReadBits(data.Length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestCanonicalCodes(t *testing.T) {
+	var lengths CodeLengths
+	lengths['a'] = 1
+	lengths['b'] = 3
+	lengths['c'] = 2
+	lengths['d'] = 3
+	table, err := CreateKeyTableFromLengths(lengths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[byte]uint64{
+		'a': 0b0,
+		'c': 0b10,
+		'b': 0b110,
+		'd': 0b111,
+	}
+	for key, code := range expected {
+		data, err := table.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data.Length != lengths[key] {
+			t.Errorf("%c: got length %d, want %d", key, data.Length, lengths[key])
+		}
+		if got := readCode(t, *data); got != code {
+			t.Errorf("%c: got code %b, want %b", key, got, code)
+		}
+	}
+}
+
+func TestRejectsOversubscribedLengths(t *testing.T) {
+	var lengths CodeLengths
+	lengths['a'] = 1
+	lengths['b'] = 1
+	lengths['c'] = 1
+	_, err := CreateKeyTableFromLengths(lengths)
+	if err == nil {
+		t.Error("three 1 bit codes can't be prefix free")
+	}
+}
+
+func TestCodeLengthsRoundTrip(t *testing.T) {
+	var lengths CodeLengths
+	lengths[0] = 2
+	lengths['e'] = 2
+	lengths['t'] = 3
+	lengths['x'] = 4
+	lengths[255] = 4
+	var buf bytes.Buffer
+	writer := bitstream.NewWriter(&buf)
+	err := lengths.Write(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Flush(bitstream.Zero)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > 16 {
+		t.Errorf("sparse code lengths took %d bytes", buf.Len())
+	}
+	written := buf.Len()
+	read, bitsRead, err := ReadCodeLengths(bitstream.NewReader(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (bitsRead+7)/8 != written {
+		t.Errorf("read %d bits from %d bytes", bitsRead, written)
+	}
+	if read != lengths {
+		t.Errorf("got %v, want %v", read, lengths)
+	}
+}
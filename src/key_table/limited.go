@@ -0,0 +1,94 @@
+package key_table
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Longest code the compressor assigns unless told otherwise, as in DEFLATE
+const DefaultMaxCodeLength = 15
+
+// Either a symbol or a package of two cheaper items from the level below
+type packageItem struct {
+	weight uint64
+	symbol int // -1 for packages
+	left   *packageItem
+	right  *packageItem
+}
+
+// Works out the optimal code lengths for the given symbol frequencies with no
+// code longer than maxLength, using the package-merge algorithm. Without the
+// limit binding it gives the same total size as a Huffman tree.
+func LimitedCodeLengths(frequencies map[byte]int, maxLength int) (CodeLengths, error) {
+	var lengths CodeLengths
+	leaves := make([]*packageItem, 0, len(frequencies))
+	for symbol := 0; symbol < 256; symbol++ {
+		if frequencies[byte(symbol)] > 0 {
+			leaves = append(leaves, &packageItem{weight: uint64(frequencies[byte(symbol)]), symbol: symbol})
+		}
+	}
+	if len(leaves) == 0 {
+		return lengths, nil
+	}
+	if len(leaves) == 1 {
+		// A lone symbol still needs a code at least one bit long
+		lengths[leaves[0].symbol] = 1
+		return lengths, nil
+	}
+	if maxLength < 1 || maxLength > MaxCodeLength || (maxLength < 8 && len(leaves) > 1<<uint(maxLength)) {
+		return lengths, fmt.Errorf("[ERROR] %d symbols can't all get codes of at most %d bits", len(leaves), maxLength)
+	}
+	// Ties go to the lower symbol so the result doesn't depend on map order
+	sort.SliceStable(leaves, func(i, j int) bool {
+		return leaves[i].weight < leaves[j].weight
+	})
+	/*
+		Each symbol is a coin worth 2^-depth for every depth from 1 to
+		maxLength. Starting at the deepest level, the cheapest coins are paired
+		into packages, which are merged with the coins of the level above,
+		and so on. Taking the 2n-2 cheapest items of the last level, a symbol's
+		code length is how many of its coins they contain.
+	*/
+	current := leaves
+	for level := 1; level < maxLength; level++ {
+		packages := make([]*packageItem, 0, len(current)/2)
+		for i := 0; i+1 < len(current); i += 2 {
+			packages = append(packages, &packageItem{
+				weight: current[i].weight + current[i+1].weight,
+				symbol: -1,
+				left:   current[i],
+				right:  current[i+1],
+			})
+		}
+		current = mergeItems(leaves, packages)
+	}
+	for _, item := range current[:2*len(leaves)-2] {
+		countCoins(item, &lengths)
+	}
+	return lengths, nil
+}
+
+// Merges two lists sorted by weight, leaves first on ties
+func mergeItems(leaves []*packageItem, packages []*packageItem) []*packageItem {
+	merged := make([]*packageItem, 0, len(leaves)+len(packages))
+	i, j := 0, 0
+	for i < len(leaves) || j < len(packages) {
+		if j >= len(packages) || (i < len(leaves) && leaves[i].weight <= packages[j].weight) {
+			merged = append(merged, leaves[i])
+			i++
+		} else {
+			merged = append(merged, packages[j])
+			j++
+		}
+	}
+	return merged
+}
+
+func countCoins(item *packageItem, lengths *CodeLengths) {
+	if item.symbol >= 0 {
+		lengths[item.symbol]++
+		return
+	}
+	countCoins(item.left, lengths)
+	countCoins(item.right, lengths)
+}
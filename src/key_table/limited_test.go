@@ -0,0 +1,124 @@
+package key_table
+
+import (
+	"hzip/src/huffman_tree"
+	"hzip/src/priority_queue"
+	"math/rand"
+	"testing"
+)
+
+func huffmanCodeLengths(t *testing.T, frequencies map[byte]int) CodeLengths {
+	pq := priority_queue.NewPriorityQueue()
+	for symbol := 0; symbol < 256; symbol++ {
+		frequency := frequencies[byte(symbol)]
+		if frequency == 0 {
+			continue
+		}
+		pq.Push(huffman_tree.HtreeQueueItem{
+			Priority: frequency,
+			Order:    symbol,
+			Tree: &huffman_tree.HuffmanTree{
+				Head:      huffman_tree.LeafNode{Freq: frequency, LeafData: byte(symbol)},
+				Frequency: frequency,
+			},
+		})
+	}
+	for order := 256; pq.Len() > 1; order++ {
+		newTree := huffman_tree.CombineTrees(pq.Pop().(huffman_tree.HtreeQueueItem).Tree, pq.Pop().(huffman_tree.HtreeQueueItem).Tree)
+		pq.Push(huffman_tree.HtreeQueueItem{Priority: newTree.Frequency, Order: order, Tree: newTree})
+	}
+	table := CreateKeyTable()
+	err := table.ReadTree(pq.Pop().(huffman_tree.HtreeQueueItem).Tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table.CodeLengths()
+}
+
+func encodedBits(frequencies map[byte]int, lengths CodeLengths) int {
+	total := 0
+	for symbol, frequency := range frequencies {
+		total += frequency * lengths[symbol]
+	}
+	return total
+}
+
+func longestCode(lengths CodeLengths) int {
+	longest := 0
+	for _, length := range lengths {
+		if length > longest {
+			longest = length
+		}
+	}
+	return longest
+}
+
+// Fibonacci frequencies give the deepest possible Huffman tree
+func fibonacciFrequencies(count int) map[byte]int {
+	frequencies := make(map[byte]int)
+	a, b := 1, 1
+	for i := 0; i < count; i++ {
+		frequencies[byte(i)] = a
+		a, b = b, a+b
+	}
+	return frequencies
+}
+
+func TestLimitedMatchesHuffman(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for round := 0; round < 50; round++ {
+		frequencies := make(map[byte]int)
+		for i := 0; i < 2+random.Intn(200); i++ {
+			frequencies[byte(random.Intn(256))] += 1 + int(random.ExpFloat64()*100)
+		}
+		huffman := huffmanCodeLengths(t, frequencies)
+		limited, err := LimitedCodeLengths(frequencies, MaxCodeLength)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encodedBits(frequencies, limited) != encodedBits(frequencies, huffman) {
+			t.Fatalf("round %d: package-merge gave %d bits, Huffman %d", round, encodedBits(frequencies, limited), encodedBits(frequencies, huffman))
+		}
+	}
+}
+
+func TestLimitedCapsLength(t *testing.T) {
+	frequencies := fibonacciFrequencies(40)
+	huffman := huffmanCodeLengths(t, frequencies)
+	if longestCode(huffman) <= 15 {
+		t.Fatalf("test needs a deep tree, got %d bits", longestCode(huffman))
+	}
+	for _, maxLength := range []int{16, 15, 12, 8, 6} {
+		lengths, err := LimitedCodeLengths(frequencies, maxLength)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if longestCode(lengths) > maxLength {
+			t.Errorf("limit %d: got a %d bit code", maxLength, longestCode(lengths))
+		}
+		// The lengths still have to make a valid, complete code
+		_, err = CreateKeyTableFromLengths(lengths)
+		if err != nil {
+			t.Errorf("limit %d: %v", maxLength, err)
+		}
+		t.Logf("limit %2d: %d bits, %.3f%% over unlimited", maxLength, encodedBits(frequencies, lengths),
+			100*float64(encodedBits(frequencies, lengths)-encodedBits(frequencies, huffman))/float64(encodedBits(frequencies, huffman)))
+	}
+}
+
+func TestLimitedRejectsTooManySymbols(t *testing.T) {
+	_, err := LimitedCodeLengths(fibonacciFrequencies(5), 2)
+	if err == nil {
+		t.Error("5 symbols don't fit in 2 bit codes")
+	}
+}
+
+func TestLimitedSingleSymbol(t *testing.T) {
+	lengths, err := LimitedCodeLengths(map[byte]int{'a': 10}, DefaultMaxCodeLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lengths['a'] != 1 {
+		t.Errorf("got length %d, want 1", lengths['a'])
+	}
+}
@@ -0,0 +1,39 @@
+package lz77
+
+import "math/bits"
+
+/*
+	Literal run lengths, match lengths and distances are coded as a symbol
+	followed by extra bits, so that a Huffman code only needs a small alphabet:
+	----------------------------------------------
+	values 0 to 3 are symbols 0 to 3 with no extra bits
+	from 4 up, each power of two 2^n is split between two symbols:
+		symbol 2n for 2^n up to 2^n + 2^(n-1) - 1
+		symbol 2n+1 for 2^n + 2^(n-1) up to 2^(n+1) - 1
+		with the offset into that range as n-1 extra bits
+	----------------------------------------------
+	Any 32 bit value gets a symbol below 64.
+*/
+
+// Splits a value into its symbol and the extra bits after it
+func EncodeValue(value uint32) (byte, uint32, uint) {
+	if value < 4 {
+		return byte(value), 0, 0
+	}
+	n := uint(bits.Len32(value) - 1)
+	symbol := byte(2*n) | byte(value>>(n-1)&1)
+	return symbol, value & (1<<(n-1) - 1), n - 1
+}
+
+// Gives the smallest value of a symbol and the number of extra bits that
+// follow it, or false for symbols EncodeValue never gives
+func DecodeValue(symbol byte) (uint32, uint, bool) {
+	if symbol < 4 {
+		return uint32(symbol), 0, true
+	}
+	if symbol >= 64 {
+		return 0, 0, false
+	}
+	n := uint(symbol / 2)
+	return uint32(2|symbol&1) << (n - 1), n - 1, true
+}
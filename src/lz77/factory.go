@@ -0,0 +1,26 @@
+package lz77
+
+import "io"
+
+// Window is the furthest back a match can reach, from 1 to MaxWindow
+func CreateMatcher(window int) *Matcher {
+	chainSize := 1
+	for chainSize < window {
+		chainSize <<= 1
+	}
+	return &Matcher{
+		window: window,
+		head:   make([]uint32, 1<<hashBits),
+		prev:   make([]uint32, chainSize),
+		mask:   uint32(chainSize - 1),
+	}
+}
+
+// Window is the furthest back a match can reach, as given to the matcher
+func CreateWindow(window int, writer io.Writer) *Window {
+	return &Window{
+		size:   window,
+		data:   make([]byte, 0, 2*window),
+		writer: writer,
+	}
+}
@@ -0,0 +1,180 @@
+package lz77
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// Shortest match worth coding, and the number of bytes hashed to find one
+const MinMatch = 4
+
+// Longest match found, so that lengths stay well inside 32 bits
+const MaxMatch = 1<<16 - 1
+
+// Largest window, so that a matcher's hash chains fit in memory
+const MaxWindow = 16 * 1024 * 1024
+
+const (
+	hashBits = 16
+	// Candidates tried before settling for the best match so far
+	maxChain = 128
+	// Matches at least this long are taken without looking any further
+	niceLength = 128
+	// Matches at least this long aren't worth checking the next byte for a
+	// longer one
+	maxLazy = 32
+	// When checking the next byte after a match at least this long, only a
+	// quarter of the candidates are tried
+	goodLength = 8
+)
+
+// A run of literal bytes followed by a copy of earlier data. The literals at
+// the end of a block come with a Length of 0.
+type Match struct {
+	Literals int
+	Length   int
+	Distance int // back from the byte after the literals, 1 for the previous byte
+}
+
+// Finds matches with hash chains, block by block. Matches can reach back into
+// earlier blocks as long as they are within the window.
+type Matcher struct {
+	window  int
+	history []byte // the last window bytes of earlier blocks, then the current block
+	start   uint32 // position of history[0] since the first block, wrapping around
+	head    []uint32
+	prev    []uint32 // by position modulo len(prev)
+	mask    uint32
+}
+
+// Finds the matches in the next block. Every byte of the block is covered by
+// the literals and matches returned, in order.
+func (matcher *Matcher) FindMatches(block []byte) []Match {
+	if len(matcher.history) > matcher.window {
+		// Anything older is out of reach of this block
+		drop := len(matcher.history) - matcher.window
+		matcher.history = append(matcher.history[:0], matcher.history[drop:]...)
+		matcher.start += uint32(drop)
+	}
+	pos := len(matcher.history)
+	matcher.history = append(matcher.history, block...)
+	matches := make([]Match, 0)
+	literals := 0
+	length, distance := 0, 0
+	found := false // whether length and distance are already those of pos
+	for pos < len(matcher.history) {
+		if !found {
+			length, distance = matcher.longest(pos, maxChain)
+		}
+		found = false
+		if length < MinMatch {
+			matcher.insert(pos)
+			literals++
+			pos++
+			continue
+		}
+		matcher.insert(pos)
+		if length < maxLazy {
+			// Lazy matching: a longer match one byte on is worth a literal
+			chain := maxChain
+			if length >= goodLength {
+				chain /= 4
+			}
+			nextLength, nextDistance := matcher.longest(pos+1, chain)
+			if nextLength > length {
+				literals++
+				pos++
+				length, distance, found = nextLength, nextDistance, true
+				continue
+			}
+		}
+		for i := pos + 1; i < pos+length; i++ {
+			matcher.insert(i)
+		}
+		matches = append(matches, Match{Literals: literals, Length: length, Distance: distance})
+		literals = 0
+		pos += length
+	}
+	if literals > 0 {
+		matches = append(matches, Match{Literals: literals})
+	}
+	return matches
+}
+
+// Starts over on unrelated data, keeping the memory already allocated so a
+// matcher can be used for one input after another
+func (matcher *Matcher) Reset() {
+	matcher.history = matcher.history[:0]
+	matcher.start = 0
+	for i := range matcher.head {
+		matcher.head[i] = 0
+	}
+}
+
+func (matcher *Matcher) hash(pos int) uint32 {
+	return (binary.LittleEndian.Uint32(matcher.history[pos:]) * 2654435761) >> (32 - hashBits)
+}
+
+// Adds pos to the front of its hash chain
+func (matcher *Matcher) insert(pos int) {
+	if pos+MinMatch > len(matcher.history) {
+		return
+	}
+	h := matcher.hash(pos)
+	position := matcher.start + uint32(pos)
+	// Positions are stored plus one so that 0 can mean none
+	matcher.prev[position&matcher.mask] = matcher.head[h]
+	matcher.head[h] = position + 1
+}
+
+// Longest match for the data at pos among the first maxChain candidates on
+// its hash chain
+func (matcher *Matcher) longest(pos int, maxChain int) (int, int) {
+	data := matcher.history
+	if pos+MinMatch > len(data) {
+		return 0, 0
+	}
+	limit := len(data) - pos
+	if limit > MaxMatch {
+		limit = MaxMatch
+	}
+	position := matcher.start + uint32(pos)
+	best, bestDistance := 0, 0
+	candidate := matcher.head[matcher.hash(pos)]
+	for chain := 0; candidate != 0 && chain < maxChain; chain++ {
+		distance := int(position + 1 - candidate)
+		if distance <= 0 || distance > matcher.window || distance > pos {
+			break
+		}
+		earlier := pos - distance
+		// Only a match that gets past the best so far is worth comparing in full
+		if data[earlier+best] == data[pos+best] {
+			length := matchLength(data[earlier:], data[pos:pos+limit])
+			if length > best {
+				best, bestDistance = length, distance
+				if length >= limit || length >= niceLength {
+					break
+				}
+			}
+		}
+		candidate = matcher.prev[(matcher.start+uint32(earlier))&matcher.mask]
+	}
+	return best, bestDistance
+}
+
+// Number of leading bytes of b that a starts with as well, comparing eight
+// bytes at a time while it can
+func matchLength(a []byte, b []byte) int {
+	length := 0
+	for length+8 <= len(b) {
+		difference := binary.LittleEndian.Uint64(a[length:]) ^ binary.LittleEndian.Uint64(b[length:])
+		if difference != 0 {
+			return length + bits.TrailingZeros64(difference)/8
+		}
+		length += 8
+	}
+	for length < len(b) && a[length] == b[length] {
+		length++
+	}
+	return length
+}
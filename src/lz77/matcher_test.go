@@ -0,0 +1,122 @@
+package lz77
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// Runs data through a matcher block by block and rebuilds it from the matches
+func roundTrip(t *testing.T, data []byte, window int, blockSize int) []Match {
+	matcher := CreateMatcher(window)
+	var rebuilt bytes.Buffer
+	output := CreateWindow(window, &rebuilt)
+	all := make([]Match, 0)
+	for start := 0; start < len(data); start += blockSize {
+		end := start + blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		block := data[start:end]
+		pos := 0
+		for _, match := range matcher.FindMatches(block) {
+			if match.Length != 0 && (match.Length < MinMatch || match.Length > MaxMatch || match.Distance > window) {
+				t.Fatalf("invalid match %+v", match)
+			}
+			err := output.WriteLiterals(block[pos : pos+match.Literals])
+			if err != nil {
+				t.Fatal(err)
+			}
+			pos += match.Literals
+			err = output.Copy(match.Distance, match.Length)
+			if match.Length != 0 && err != nil {
+				t.Fatal(err)
+			}
+			pos += match.Length
+			all = append(all, match)
+		}
+		if pos != len(block) {
+			t.Fatalf("matches cover %d bytes of a %d byte block", pos, len(block))
+		}
+	}
+	err := output.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rebuilt.Bytes(), data) {
+		t.Fatal("data didn't round trip")
+	}
+	return all
+}
+
+func TestRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	words := []string{"alpha", "beta", "gamma", "delta", "epsilon", " ", "\n"}
+	var text strings.Builder
+	for text.Len() < 200000 {
+		text.WriteString(words[random.Intn(len(words))])
+	}
+	noise := make([]byte, 50000)
+	random.Read(noise)
+	cases := map[string][]byte{
+		"text":    []byte(text.String()),
+		"noise":   noise,
+		"repeats": bytes.Repeat([]byte{'a'}, 100000),
+		"short":   []byte("abc"),
+	}
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			for _, window := range []int{1024, 32 * 1024, 1 << 20} {
+				roundTrip(t, data, window, 16*1024)
+			}
+		})
+	}
+}
+
+func TestMatchesAcrossBlocks(t *testing.T) {
+	block := make([]byte, 4096)
+	rand.New(rand.NewSource(2)).Read(block)
+	data := append(append([]byte{}, block...), block...)
+	matches := roundTrip(t, data, 8192, len(block))
+	last := matches[len(matches)-1]
+	if last.Literals != 0 || last.Distance != len(block) {
+		t.Errorf("second block should be copied from the first, ended with %+v", last)
+	}
+}
+
+func TestWindowLimitsDistance(t *testing.T) {
+	block := make([]byte, 4096)
+	rand.New(rand.NewSource(3)).Read(block)
+	data := append(append([]byte{}, block...), block...)
+	for _, match := range roundTrip(t, data, 1024, len(block)) {
+		if match.Length != 0 {
+			t.Fatalf("found match %+v beyond the window", match)
+		}
+	}
+}
+
+func TestWindowRejectsFarMatch(t *testing.T) {
+	output := CreateWindow(16, &bytes.Buffer{})
+	err := output.WriteLiterals([]byte("abcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.Copy(5, 4) == nil {
+		t.Error("a match before the start of the data should fail")
+	}
+}
+
+func TestValueCodes(t *testing.T) {
+	values := []uint32{0, 1, 3, 4, 5, 6, 7, 8, 255, 256, 1000, 65535, 1<<24 + 7, 1<<32 - 1}
+	for _, value := range values {
+		symbol, extra, extraBits := EncodeValue(value)
+		base, wantBits, ok := DecodeValue(symbol)
+		if !ok || wantBits != extraBits || base+extra != value || extra >= 1<<extraBits && extraBits > 0 {
+			t.Errorf("%d: got symbol %d with %d extra bits %d, decoding to %d", value, symbol, extraBits, extra, base+extra)
+		}
+		if symbol >= 64 {
+			t.Errorf("%d: symbol %d is out of range", value, symbol)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package lz77
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Rebuilds data from literals and matches, keeping the last window bytes
+// written around to copy matches from
+type Window struct {
+	size    int
+	data    []byte
+	flushed int // bytes of data already handed to writer
+	writer  io.Writer
+}
+
+func (window *Window) WriteLiterals(literals []byte) error {
+	window.data = append(window.data, literals...)
+	return window.slide()
+}
+
+// Appends length bytes starting distance bytes back, which may overlap the
+// bytes being appended
+func (window *Window) Copy(distance int, length int) error {
+	if distance < 1 || distance > window.size || distance > len(window.data) {
+		return fmt.Errorf("[ERROR] Match distance %d reaches outside the window", distance)
+	}
+	start := len(window.data) - distance
+	for length > 0 {
+		// An overlapping match repeats the last distance bytes
+		n := length
+		if n > distance {
+			n = distance
+		}
+		window.data = append(window.data, window.data[start:start+n]...)
+		start += n
+		length -= n
+	}
+	return window.slide()
+}
+
+// Writes out everything not written yet
+func (window *Window) Flush() error {
+	_, err := window.writer.Write(window.data[window.flushed:])
+	if err != nil {
+		return errors.New("[ERROR] Failed to write decoded data")
+	}
+	window.flushed = len(window.data)
+	return nil
+}
+
+// Once the data is twice the window, writes it out and keeps only what
+// later matches can reach
+func (window *Window) slide() error {
+	if len(window.data) < 2*window.size {
+		return nil
+	}
+	err := window.Flush()
+	if err != nil {
+		return err
+	}
+	keep := window.data[len(window.data)-window.size:]
+	window.data = append(window.data[:0], keep...)
+	window.flushed = len(window.data)
+	return nil
+}
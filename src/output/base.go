@@ -3,5 +3,8 @@ package output
 type Output interface {
 	Write([]byte) error
 	Open() error
+	// Finishes the output once everything has been written successfully
 	Close() error
+	// Throws away whatever has been written since Open, after a failure
+	Abort() error
 }
@@ -1,70 +1,113 @@
 package output
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 )
 
+// Size of the buffer in front of the file, so small writes don't each become a syscall
+const bufferSize = 1 << 20
+
+// Writes the archive to a temporary file next to Filename and only renames it
+// into place on Close, so a failed compression leaves any previous archive
+// untouched
 type FileOutput struct {
 	Filename string
 	Mode     int
+	file     *os.File
+	buffer   *bufio.Writer
 }
 
 func (file_output *FileOutput) Write(data []byte) error {
-	file, err := os.OpenFile(file_output.Filename, os.O_APPEND|os.O_WRONLY, 0666)
-	if err != nil {
-		return errors.New("[ERROR] Couldn't open file")
+	if file_output.buffer == nil {
+		return errors.New("[ERROR] Output " + file_output.Filename + " isn't open")
 	}
-	defer file.Close()
-	_, err = file.Write(data)
+	_, err := file_output.buffer.Write(data)
 	if err != nil {
+		fmt.Println(err)
 		return errors.New("[ERROR] Failed to write to file " + file_output.Filename)
 	}
-	err = file.Sync()
-	if err != nil {
-		return errors.New("[ERROR] Failed to synce file " + file_output.Filename)
-	}
 	return nil
 }
 
 func (file_output *FileOutput) Open() error {
-	err := file_output.DeleteFileIfExists()
+	file, err := createTempFile(file_output.Filename, os.FileMode(file_output.Mode))
 	if err != nil {
 		fmt.Println(err)
-		return errors.New("[ERROR] Failed to remove existing file")
-	}
-	err = file_output.CreateFile()
-	if err != nil {
-		fmt.Println(err)
-		return errors.New("[ERROR] Failed to create file " + file_output.Filename)
+		return errors.New("[ERROR] Failed to create file for " + file_output.Filename)
 	}
+	fmt.Println("[INFO] Creating " + file_output.Filename)
+	file_output.file = file
+	file_output.buffer = bufio.NewWriterSize(file, bufferSize)
 	return nil
 }
 
 func (file_output *FileOutput) Close() error {
+	if file_output.file == nil {
+		return errors.New("[ERROR] Output " + file_output.Filename + " isn't open")
+	}
+	err := file_output.buffer.Flush()
+	if err != nil {
+		fmt.Println(err)
+		file_output.Abort()
+		return errors.New("[ERROR] Failed to write to file " + file_output.Filename)
+	}
+	// The only sync, so the archive is on disk before it replaces the old one
+	err = file_output.file.Sync()
+	if err != nil {
+		fmt.Println(err)
+		file_output.Abort()
+		return errors.New("[ERROR] Failed to sync file " + file_output.Filename)
+	}
+	tempName := file_output.file.Name()
+	err = file_output.file.Close()
+	file_output.file, file_output.buffer = nil, nil
+	if err != nil {
+		fmt.Println(err)
+		os.Remove(tempName)
+		return errors.New("[ERROR] Failed to close file " + file_output.Filename)
+	}
+	err = os.Rename(tempName, file_output.Filename)
+	if err != nil {
+		fmt.Println(err)
+		os.Remove(tempName)
+		return errors.New("[ERROR] Failed to move archive into place at " + file_output.Filename)
+	}
 	return nil
 }
 
-func (file_output *FileOutput) DeleteFileIfExists() error {
-	_, err := os.Stat(file_output.Filename)
-	if os.IsNotExist(err) {
+func (file_output *FileOutput) Abort() error {
+	if file_output.file == nil {
 		return nil
 	}
-	fmt.Println("[INFO] Removing " + file_output.Filename)
-	err = os.Remove(file_output.Filename)
+	tempName := file_output.file.Name()
+	file_output.file.Close()
+	file_output.file, file_output.buffer = nil, nil
+	err := os.Remove(tempName)
 	if err != nil {
-		return errors.New("[ERROR] Couldn't delete file " + file_output.Filename)
+		return errors.New("[ERROR] Couldn't remove temporary file " + tempName)
 	}
 	return nil
 }
 
-func (file_output *FileOutput) CreateFile() error {
-	fmt.Println("[INFO] Creating " + file_output.Filename)
-	file, err := os.Create(file_output.Filename)
-	if err != nil {
-		return errors.New("[ERROR] Couldn't create file")
+// Creates a hidden file in the same directory as filename, so that renaming
+// it over filename is atomic. Unlike os.CreateTemp the mode is respected,
+// minus the umask.
+func createTempFile(filename string, mode os.FileMode) (*os.File, error) {
+	dir, base := filepath.Split(filename)
+	random := rand.New(rand.NewSource(time.Now().UnixNano() + int64(os.Getpid())))
+	for attempt := 0; ; attempt++ {
+		name := filepath.Join(dir, "."+base+".tmp"+strconv.Itoa(random.Intn(1000000000)))
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if os.IsExist(err) && attempt < 100 {
+			continue
+		}
+		return file, err
 	}
-	file.Close()
-	return nil
 }
@@ -0,0 +1,77 @@
+package output
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeOutput(t *testing.T, output *FileOutput, data string) {
+	err := output.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = output.Write([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkArchive(t *testing.T, dir string, filename string, want string) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+}
+
+func TestFileOutputReplacesOnClose(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.hz")
+	output := &FileOutput{Filename: filename, Mode: 0666}
+	writeOutput(t, output, "old archive")
+	err := output.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeOutput(t, output, "new archive")
+	// Nothing changes until Close
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "old archive" {
+		t.Errorf("archive changed before Close: %q", data)
+	}
+	err = output.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkArchive(t, dir, filename, "new archive")
+}
+
+func TestFileOutputAbortKeepsOldArchive(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.hz")
+	err := os.WriteFile(filename, []byte("old archive"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := &FileOutput{Filename: filename, Mode: 0666}
+	writeOutput(t, output, "partial")
+	err = output.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkArchive(t, dir, filename, "old archive")
+}
@@ -0,0 +1,33 @@
+package output
+
+import (
+	"fmt"
+	"io"
+)
+
+// Writes the archive to any io.Writer, such as a network connection
+type StreamOutput struct {
+	Writer io.Writer
+}
+
+func (stream_output *StreamOutput) Write(data []byte) error {
+	_, err := stream_output.Writer.Write(data)
+	if err != nil {
+		return fmt.Errorf("[ERROR] Failed to write to stream: %v", err)
+	}
+	return nil
+}
+
+func (stream_output *StreamOutput) Open() error {
+	return nil
+}
+
+// Leaves the writer open, it belongs to the caller
+func (stream_output *StreamOutput) Close() error {
+	return nil
+}
+
+// Anything already written can't be taken back from a stream
+func (stream_output *StreamOutput) Abort() error {
+	return nil
+}
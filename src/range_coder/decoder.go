@@ -0,0 +1,79 @@
+package range_coder
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Decodes what an Encoder wrote, reading exactly the bytes it was given
+type Decoder struct {
+	reader    io.Reader
+	remaining uint64 // bytes not read from reader yet
+	chunk     []byte
+	pos       int
+	code      uint32
+	rng       uint32
+	started   bool
+}
+
+// Decodes the next symbol and updates the model the same way the encoder did
+func (dec *Decoder) Decode(model *Model) (byte, error) {
+	if !dec.started {
+		dec.started = true
+		for i := 0; i < 4; i++ {
+			err := dec.shiftIn()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	step := dec.rng / model.Total()
+	value := dec.code / step
+	if value >= model.Total() {
+		return 0, errors.New("[ERROR] Invalid range coded data")
+	}
+	symbol, cumulative, frequency := model.Find(value)
+	dec.code -= step * cumulative
+	dec.rng = step * frequency
+	model.Update(symbol)
+	for dec.rng < topValue {
+		dec.rng <<= 8
+		err := dec.shiftIn()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return symbol, nil
+}
+
+// Checks that the data ended where the encoder finished
+func (dec *Decoder) Finish() error {
+	if dec.remaining > 0 || dec.pos < len(dec.chunk) {
+		return errors.New("[ERROR] Range coded data continues past its last symbol")
+	}
+	return nil
+}
+
+func (dec *Decoder) shiftIn() error {
+	if dec.pos == len(dec.chunk) {
+		if dec.remaining == 0 {
+			return errors.New("[ERROR] Range coded data ends too early")
+		}
+		size := uint64(cap(dec.chunk))
+		if size > dec.remaining {
+			size = dec.remaining
+		}
+		dec.chunk = dec.chunk[:size]
+		_, err := io.ReadFull(dec.reader, dec.chunk)
+		if err != nil {
+			fmt.Println(err)
+			return errors.New("[ERROR] Couldn't read compressed data")
+		}
+		dec.remaining -= size
+		dec.pos = 0
+	}
+	dec.code = dec.code<<8 | uint32(dec.chunk[dec.pos])
+	dec.pos++
+	return nil
+}
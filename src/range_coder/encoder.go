@@ -0,0 +1,96 @@
+package range_coder
+
+// Size of the chunks coded data is written in
+const chunkSize = 64 * 1024
+
+// Bytes are shifted out of the top of low once the range drops below this
+const topValue = 1 << 24
+
+// Range coder in the style of LZMA's, which keeps a byte back until it knows
+// whether a carry will ripple into it. The first byte it would write is
+// always zero, so it is left out. Nothing at all is written if no symbol
+// was coded.
+type Encoder struct {
+	low       uint64 // 33 bits, the top one a carry
+	rng       uint32
+	cache     byte
+	cacheSize int // bytes held back: cache, then cacheSize-1 bytes of 0xFF
+	started   bool
+	coded     bool
+	chunk     []byte
+	written   uint64
+	write     func([]byte) error
+}
+
+// Codes the range of a symbol out of total, then updates the model
+func (enc *Encoder) Encode(model *Model, symbol byte) error {
+	enc.coded = true
+	cumulative, frequency := model.Range(symbol)
+	step := enc.rng / model.Total()
+	enc.low += uint64(step) * uint64(cumulative)
+	enc.rng = step * frequency
+	model.Update(symbol)
+	for enc.rng < topValue {
+		enc.rng <<= 8
+		err := enc.shiftLow()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes out enough of low to pin down the final range, along with anything
+// still buffered, and returns the number of bytes written overall
+func (enc *Encoder) Finish() (uint64, error) {
+	if !enc.coded {
+		return 0, nil
+	}
+	for i := 0; i < 5; i++ {
+		err := enc.shiftLow()
+		if err != nil {
+			return enc.written, err
+		}
+	}
+	if len(enc.chunk) > 0 {
+		err := enc.write(enc.chunk)
+		enc.chunk = enc.chunk[:0]
+		if err != nil {
+			return enc.written, err
+		}
+	}
+	return enc.written, nil
+}
+
+func (enc *Encoder) shiftLow() error {
+	if uint32(enc.low) < 0xFF000000 || enc.low>>32 != 0 {
+		carry := byte(enc.low >> 32)
+		held := enc.cache
+		for ; enc.cacheSize > 0; enc.cacheSize-- {
+			err := enc.writeByte(held + carry)
+			if err != nil {
+				return err
+			}
+			held = 0xFF
+		}
+		enc.cache = byte(enc.low >> 24)
+	}
+	enc.cacheSize++
+	enc.low = (enc.low & 0x00FFFFFF) << 8
+	return nil
+}
+
+func (enc *Encoder) writeByte(value byte) error {
+	if !enc.started {
+		enc.started = true
+		return nil
+	}
+	enc.chunk = append(enc.chunk, value)
+	enc.written++
+	if len(enc.chunk) == chunkSize {
+		err := enc.write(enc.chunk)
+		enc.chunk = enc.chunk[:0]
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package range_coder
+
+import "io"
+
+// A model where every byte is equally likely
+func CreateModel() *Model {
+	model := &Model{}
+	for symbol := 0; symbol < 256; symbol++ {
+		model.add(byte(symbol), 1)
+	}
+	return model
+}
+
+// Coded data is handed to write a chunk at a time
+func CreateEncoder(write func([]byte) error) *Encoder {
+	return &Encoder{
+		rng:       0xFFFFFFFF,
+		cacheSize: 1,
+		chunk:     make([]byte, 0, chunkSize),
+		write:     write,
+	}
+}
+
+// Reads exactly numBytes bytes of coded data from reader, no further
+func CreateDecoder(reader io.Reader, numBytes uint64) *Decoder {
+	return &Decoder{
+		reader:    reader,
+		remaining: numBytes,
+		chunk:     make([]byte, 0, chunkSize/2),
+		rng:       0xFFFFFFFF,
+	}
+}
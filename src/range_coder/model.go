@@ -0,0 +1,72 @@
+package range_coder
+
+// Frequencies stay below this, so a range of at least 2^24 still has 2^8
+// steps for every unit of frequency
+const maxTotal = 1 << 16
+
+// Added to a symbol's frequency every time it is coded
+const increment = 32
+
+// Order-0 model of byte frequencies that adapts as symbols are coded. Every
+// byte starts with a frequency of 1 so it can always be coded. Cumulative
+// frequencies are kept in a Fenwick tree so finding and updating them takes
+// a handful of steps rather than a pass over all 256.
+type Model struct {
+	frequencies [256]uint32
+	tree        [257]uint32 // Fenwick tree over frequencies, 1-based
+	total       uint32
+}
+
+// Cumulative frequency of the symbols before symbol, and its own frequency
+func (model *Model) Range(symbol byte) (uint32, uint32) {
+	cumulative := uint32(0)
+	for i := int(symbol); i > 0; i -= i & -i {
+		cumulative += model.tree[i]
+	}
+	return cumulative, model.frequencies[symbol]
+}
+
+// Symbol whose range holds value, which must be below Total, along with that
+// range
+func (model *Model) Find(value uint32) (byte, uint32, uint32) {
+	position, cumulative := 0, uint32(0)
+	for step := 256; step > 0; step >>= 1 {
+		next := position + step
+		if next <= 256 && cumulative+model.tree[next] <= value {
+			position = next
+			cumulative += model.tree[next]
+		}
+	}
+	return byte(position), cumulative, model.frequencies[position]
+}
+
+func (model *Model) Total() uint32 {
+	return model.total
+}
+
+// Counts another occurrence of symbol, halving every frequency once the
+// total gets too large so recent data weighs more
+func (model *Model) Update(symbol byte) {
+	model.add(symbol, increment)
+	if model.total >= maxTotal {
+		model.rescale()
+	}
+}
+
+func (model *Model) add(symbol byte, amount uint32) {
+	model.frequencies[symbol] += amount
+	model.total += amount
+	for i := int(symbol) + 1; i <= 256; i += i & -i {
+		model.tree[i] += amount
+	}
+}
+
+func (model *Model) rescale() {
+	model.tree = [257]uint32{}
+	model.total = 0
+	frequencies := model.frequencies
+	for symbol, frequency := range frequencies {
+		model.frequencies[symbol] = 0
+		model.add(byte(symbol), (frequency+1)/2)
+	}
+}
@@ -0,0 +1,111 @@
+package range_coder
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func encode(t *testing.T, data []byte) []byte {
+	var coded bytes.Buffer
+	enc := CreateEncoder(func(chunk []byte) error {
+		coded.Write(chunk)
+		return nil
+	})
+	model := CreateModel()
+	for _, symbol := range data {
+		err := enc.Encode(model, symbol)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	written, err := enc.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != uint64(coded.Len()) {
+		t.Fatalf("encoder reported %d bytes but wrote %d", written, coded.Len())
+	}
+	return coded.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	noise := make([]byte, 100000)
+	random.Read(noise)
+	carries := make([]byte, 100000)
+	for i := range carries {
+		// Long runs of the most likely symbol keep low just under a carry
+		if random.Intn(1000) == 0 {
+			carries[i] = 0xFF
+		}
+	}
+	cases := map[string][]byte{
+		"empty":   {},
+		"single":  {42},
+		"repeats": bytes.Repeat([]byte{0xFF}, 200000),
+		"text":    []byte(strings.Repeat("range coding gets close to the entropy\n", 3000)),
+		"noise":   noise,
+		"carries": carries,
+	}
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			coded := encode(t, data)
+			// Anything after the coded data must be left unread
+			source := bytes.NewReader(append(append([]byte{}, coded...), 0xAA))
+			dec := CreateDecoder(source, uint64(len(coded)))
+			model := CreateModel()
+			for i, want := range data {
+				symbol, err := dec.Decode(model)
+				if err != nil {
+					t.Fatalf("byte %d: %v", i, err)
+				}
+				if symbol != want {
+					t.Fatalf("byte %d: got %d, want %d", i, symbol, want)
+				}
+			}
+			err := dec.Finish()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if source.Len() != 1 {
+				t.Errorf("decoder left %d bytes instead of 1", source.Len())
+			}
+		})
+	}
+}
+
+func TestBeatsWholeBits(t *testing.T) {
+	// 99% zeros is worth about 0.08 bits a byte, where Huffman needs a whole bit
+	random := rand.New(rand.NewSource(2))
+	data := make([]byte, 100000)
+	for i := range data {
+		if random.Intn(100) == 0 {
+			data[i] = byte(1 + random.Intn(3))
+		}
+	}
+	coded := encode(t, data)
+	if len(coded)*8 > len(data)/4 {
+		t.Errorf("coded %d bytes into %d", len(data), len(coded))
+	}
+}
+
+func TestModelFind(t *testing.T) {
+	model := CreateModel()
+	for i := 0; i < 5000; i++ {
+		model.Update(byte(i * 7 % 13))
+	}
+	for symbol := 0; symbol < 256; symbol++ {
+		cumulative, frequency := model.Range(byte(symbol))
+		for _, value := range []uint32{cumulative, cumulative + frequency - 1} {
+			found, foundCumulative, foundFrequency := model.Find(value)
+			if int(found) != symbol || foundCumulative != cumulative || foundFrequency != frequency {
+				t.Fatalf("value %d: found %d, want %d", value, found, symbol)
+			}
+		}
+	}
+	if model.Total() >= maxTotal {
+		t.Errorf("total %d should have been rescaled", model.Total())
+	}
+}
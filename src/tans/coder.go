@@ -0,0 +1,218 @@
+package tans
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Data is coded in blocks of this many bytes, the last one shorter. A block
+// is coded backwards so that it can be decoded forwards, which means holding
+// on to its codes until the whole block has been seen.
+const BlockSize = 64 * 1024
+
+// Size of the chunks coded data is read in
+const chunkSize = 32 * 1024
+
+/*
+	Every block is coded as:
+	----------------------------------------------
+	|--- state the decoder starts from ($table log bits) ---|
+	for each byte {
+		|--- bits moving the decoder to its next state (0 to $table log bits) ---|
+	}
+	----------------------------------------------
+	Blocks follow each other without padding. After its last byte a block's
+	decoder is back in state 0, which is where the encoder started.
+*/
+
+type Encoder struct {
+	table   *Table
+	block   []byte
+	values  []uint16
+	lengths []uint8
+	written uint64
+	write   func(code uint64, length uint) error
+}
+
+func (enc *Encoder) Write(data []byte) error {
+	for len(data) > 0 {
+		n := cap(enc.block) - len(enc.block)
+		if n > len(data) {
+			n = len(data)
+		}
+		enc.block = append(enc.block, data[:n]...)
+		data = data[n:]
+		if len(enc.block) == BlockSize {
+			err := enc.encodeBlock()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Switches to another table, only between calls to Finish
+func (enc *Encoder) UseTable(table *Table) {
+	enc.table = table
+}
+
+// Codes whatever is left of the last block and returns the number of bits
+// written overall
+func (enc *Encoder) Finish() (uint64, error) {
+	if len(enc.block) > 0 {
+		err := enc.encodeBlock()
+		if err != nil {
+			return enc.written, err
+		}
+	}
+	return enc.written, nil
+}
+
+func (enc *Encoder) encodeBlock() error {
+	table := enc.table
+	size := uint32(1) << table.log
+	if enc.values == nil {
+		enc.values = make([]uint16, BlockSize)
+		enc.lengths = make([]uint8, BlockSize)
+	}
+	state := size
+	for i := len(enc.block) - 1; i >= 0; i-- {
+		symbol := enc.block[i]
+		if table.counts[symbol] == 0 {
+			return fmt.Errorf("[ERROR] Byte %d has no count in the table", symbol)
+		}
+		transform := table.transforms[symbol]
+		numBits := (state + transform.deltaBits) >> 16
+		enc.values[i] = uint16(state & (1<<numBits - 1))
+		enc.lengths[i] = uint8(numBits)
+		state = uint32(table.stateTable[int32(state>>numBits)+transform.deltaFindState])
+	}
+	code, length := uint64(state-size), table.log
+	for i := range enc.block {
+		if length > 48 {
+			err := enc.emit(code, length)
+			if err != nil {
+				return err
+			}
+			code, length = 0, 0
+		}
+		code = code<<enc.lengths[i] | uint64(enc.values[i])
+		length += uint(enc.lengths[i])
+	}
+	enc.block = enc.block[:0]
+	return enc.emit(code, length)
+}
+
+func (enc *Encoder) emit(code uint64, length uint) error {
+	enc.written += uint64(length)
+	return enc.write(code, length)
+}
+
+type Decoder struct {
+	table   *Table
+	source  bitSource
+	numBits uint64
+}
+
+// Decodes size bytes into writer. All of the coded data has to be used up
+// by then, and the padding after it must be zero.
+func (dec *Decoder) Decode(size uint64, writer io.Writer) error {
+	table := dec.table
+	if size > 0 && table.Empty() {
+		return errors.New("[ERROR] Can't decode without any symbols in the table")
+	}
+	output := make([]byte, BlockSize)
+	for size > 0 {
+		n := uint64(BlockSize)
+		if n > size {
+			n = size
+		}
+		state, err := dec.source.read(table.log)
+		if err != nil {
+			return err
+		}
+		for i := range output[:n] {
+			entry := table.decode[state]
+			output[i] = entry.symbol
+			next, err := dec.source.read(uint(entry.bits))
+			if err != nil {
+				return err
+			}
+			state = uint32(entry.base) + next
+		}
+		if state != 0 {
+			return errors.New("[ERROR] Block doesn't end in the state its coding started from")
+		}
+		_, err = writer.Write(output[:n])
+		if err != nil {
+			return errors.New("[ERROR] Failed to write decoded data")
+		}
+		size -= n
+	}
+	if dec.source.consumed != dec.numBits {
+		return errors.New("[ERROR] Coded data doesn't end with the last block")
+	}
+	// Whatever is left in the last byte has to be padding
+	if dec.source.buffer != 0 {
+		return errors.New("[ERROR] Expected padding bits to be zero")
+	}
+	return nil
+}
+
+// Reads a fixed number of bytes from a reader in chunks and hands out their
+// bits most significant first through a 64 bit buffer
+type bitSource struct {
+	reader    io.Reader
+	remaining uint64 // bytes not read from reader yet
+	chunk     []byte
+	pos       int
+	buffer    uint64 // left aligned
+	count     uint   // valid bits in buffer
+	consumed  uint64
+}
+
+func (source *bitSource) read(bits uint) (uint32, error) {
+	if source.count < bits {
+		err := source.refill()
+		if err != nil {
+			return 0, err
+		}
+		if source.count < bits {
+			return 0, errors.New("[ERROR] Coded data ends in the middle of a block")
+		}
+	}
+	// Shifting by 64 gives 0, for symbols that take no bits
+	value := uint32(source.buffer >> (64 - bits))
+	source.buffer <<= bits
+	source.count -= bits
+	source.consumed += uint64(bits)
+	return value, nil
+}
+
+func (source *bitSource) refill() error {
+	for source.count <= 56 {
+		if source.pos == len(source.chunk) {
+			if source.remaining == 0 {
+				return nil
+			}
+			size := uint64(cap(source.chunk))
+			if size > source.remaining {
+				size = source.remaining
+			}
+			source.chunk = source.chunk[:size]
+			_, err := io.ReadFull(source.reader, source.chunk)
+			if err != nil {
+				fmt.Println(err)
+				return errors.New("[ERROR] Couldn't read coded data")
+			}
+			source.remaining -= size
+			source.pos = 0
+		}
+		source.buffer |= uint64(source.chunk[source.pos]) << (56 - source.count)
+		source.pos++
+		source.count += 8
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package tans
+
+import (
+	"fmt"
+	"io"
+)
+
+// Counts must add up to 2^tableLog, or all be 0 for a table that can't code
+// anything
+func CreateTable(counts [256]uint32, tableLog uint) (*Table, error) {
+	if tableLog < MinTableLog || tableLog > MaxTableLog {
+		return nil, fmt.Errorf("[ERROR] Table log %d is outside %d to %d", tableLog, MinTableLog, MaxTableLog)
+	}
+	table := &Table{log: tableLog, counts: counts}
+	err := table.build()
+	if err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// Codes are handed to write most significant bit first
+func CreateEncoder(table *Table, write func(code uint64, length uint) error) *Encoder {
+	return &Encoder{
+		table: table,
+		block: make([]byte, 0, BlockSize),
+		write: write,
+	}
+}
+
+// Reads exactly the (numBits + 7) / 8 bytes holding numBits bits from reader
+func CreateDecoder(table *Table, reader io.Reader, numBits uint64) *Decoder {
+	return &Decoder{
+		table: table,
+		source: bitSource{
+			reader:    reader,
+			remaining: (numBits + 7) / 8,
+			chunk:     make([]byte, 0, chunkSize),
+		},
+		numBits: numBits,
+	}
+}
@@ -0,0 +1,209 @@
+package tans
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/dgryski/go-bitstream"
+)
+
+/*
+	A table is stored as the normalized count of every byte value:
+	----------------------------------------------
+	|--- table log (4 bits) ---|
+	|--- for each byte value, 1 if its count isn't 0 (256 bits) ---|
+	|--- for each byte value with a count, the count minus 1 ($table log bits) ---|
+	----------------------------------------------
+	The counts add up to 2^(table log), the number of states.
+*/
+
+// Fewest states a table can have, enough for every byte value to have one
+const MinTableLog = 8
+
+// Most states a table can have, so that states and the bits read to move
+// between them fit in 16 bits
+const MaxTableLog = 15
+
+// Number of states used unless asked otherwise
+const DefaultTableLog = 11
+
+type decodeEntry struct {
+	base   uint16 // next state before the bits read are added
+	bits   uint8
+	symbol byte
+}
+
+type symbolTransform struct {
+	// Added to a state and shifted down 16 to give the number of bits to
+	// write, without a branch
+	deltaBits uint32
+	// Added to the state with those bits shifted out, to index stateTable
+	deltaFindState int32
+}
+
+// Encoding and decoding tables built from normalized counts, as in
+// Zstandard's FSE. Each symbol owns as many of the states as its count,
+// spread across the table, so a symbol with probability p costs close to
+// -log2(p) bits.
+type Table struct {
+	log        uint
+	counts     [256]uint32
+	decode     []decodeEntry
+	stateTable []uint16 // encoder states, L plus the decoder state, by symbol
+	transforms [256]symbolTransform
+}
+
+func (table *Table) Log() uint {
+	return table.log
+}
+
+func (table *Table) Counts() [256]uint32 {
+	return table.counts
+}
+
+// Whether the table has no symbols at all, as when only empty data was counted
+func (table *Table) Empty() bool {
+	return len(table.decode) == 0
+}
+
+// Bits the table takes up when written
+func (table *Table) Bits() uint64 {
+	bits := uint64(4 + 256)
+	for _, count := range table.counts {
+		if count > 0 {
+			bits += uint64(table.log)
+		}
+	}
+	return bits
+}
+
+// Close estimate of the bits coding the bytes counted in histogram takes, each
+// byte costing the log of its share of the states. False if a byte that
+// occurs has no states.
+func (table *Table) Cost(histogram *[256]uint64) (uint64, bool) {
+	bits := 0.0
+	for symbol, count := range histogram {
+		if count == 0 {
+			continue
+		}
+		if table.counts[symbol] == 0 {
+			return 0, false
+		}
+		bits += float64(count) * (float64(table.log) - math.Log2(float64(table.counts[symbol])))
+	}
+	return uint64(math.Ceil(bits)), true
+}
+
+func (table *Table) build() error {
+	size := uint32(1) << table.log
+	total := uint32(0)
+	for _, count := range table.counts {
+		total += count
+	}
+	if total == 0 {
+		return nil
+	}
+	if total != size {
+		return fmt.Errorf("[ERROR] Counts add up to %d, not %d", total, size)
+	}
+	// Spread each symbol's states across the table, visiting every state
+	// once since the step is odd
+	symbols := make([]byte, size)
+	mask := size - 1
+	step := size>>1 + size>>3 + 3
+	position := uint32(0)
+	var cumulative [256]uint32
+	next := uint32(0)
+	for symbol, count := range table.counts {
+		cumulative[symbol] = next
+		next += count
+		for i := uint32(0); i < count; i++ {
+			symbols[position] = byte(symbol)
+			position = (position + step) & mask
+		}
+		if count > 0 {
+			maxBits := uint32(table.log) - uint32(bits.Len32(count)-1)
+			table.transforms[symbol] = symbolTransform{
+				deltaBits:      maxBits<<16 - count<<maxBits,
+				deltaFindState: int32(cumulative[symbol]) - int32(count),
+			}
+		}
+	}
+	table.decode = make([]decodeEntry, size)
+	table.stateTable = make([]uint16, size)
+	seen := table.counts
+	for state := uint32(0); state < size; state++ {
+		symbol := symbols[state]
+		// Occurrences of a symbol count up from its count to twice that
+		x := seen[symbol]
+		seen[symbol]++
+		numBits := table.log - uint(bits.Len32(x)-1)
+		table.decode[state] = decodeEntry{
+			base:   uint16(x<<numBits - size),
+			bits:   uint8(numBits),
+			symbol: symbol,
+		}
+		table.stateTable[cumulative[symbol]+x-table.counts[symbol]] = uint16(size + state)
+	}
+	return nil
+}
+
+func (table *Table) Write(writer *bitstream.BitWriter) error {
+	err := writer.WriteBits(uint64(table.log), 4)
+	if err != nil {
+		return errors.New("[ERROR] Failed to write table log")
+	}
+	for _, count := range table.counts {
+		err := writer.WriteBit(count > 0)
+		if err != nil {
+			return errors.New("[ERROR] Failed to write symbols present")
+		}
+	}
+	for _, count := range table.counts {
+		if count == 0 {
+			continue
+		}
+		err := writer.WriteBits(uint64(count-1), int(table.log))
+		if err != nil {
+			return errors.New("[ERROR] Failed to write normalized count")
+		}
+	}
+	return nil
+}
+
+// Reads a table written by Write, along with the number of bits it took up
+func ReadTable(reader *bitstream.BitReader) (*Table, int, error) {
+	log, err := reader.ReadBits(4)
+	if err != nil {
+		return nil, 0, errors.New("[ERROR] Couldn't read table log")
+	}
+	bitsRead := 4
+	var present [256]bool
+	for symbol := range present {
+		bit, err := reader.ReadBit()
+		if err != nil {
+			return nil, 0, errors.New("[ERROR] Couldn't read symbols present")
+		}
+		present[symbol] = bool(bit)
+		bitsRead++
+	}
+	var counts [256]uint32
+	for symbol := range counts {
+		if !present[symbol] {
+			continue
+		}
+		count, err := reader.ReadBits(int(log))
+		if err != nil {
+			return nil, 0, errors.New("[ERROR] Couldn't read normalized count")
+		}
+		counts[symbol] = uint32(count) + 1
+		bitsRead += int(log)
+	}
+	table, err := CreateTable(counts, uint(log))
+	if err != nil {
+		return nil, 0, err
+	}
+	return table, bitsRead, nil
+}
@@ -0,0 +1,189 @@
+package tans
+
+import (
+	"bytes"
+	"hzip/src/frequency_table"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/dgryski/go-bitstream"
+)
+
+// Builds a table from the byte counts of data
+func tableFor(t *testing.T, data []byte, tableLog uint) *Table {
+	freqTable := frequency_table.CreateFrequencyTable()
+	for _, currentByte := range data {
+		freqTable.Increment(currentByte)
+	}
+	var counts [256]uint32
+	for symbol, count := range freqTable.Normalize(1 << tableLog) {
+		counts[symbol] = uint32(count)
+	}
+	table, err := CreateTable(counts, tableLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+// Encodes data, packing the codes into bytes
+func encode(t *testing.T, table *Table, data []byte) ([]byte, uint64) {
+	var packed bytes.Buffer
+	writer := bitstream.NewWriter(&packed)
+	enc := CreateEncoder(table, func(code uint64, length uint) error {
+		return writer.WriteBits(code, int(length))
+	})
+	// Uneven writes, blocks shouldn't depend on them
+	for len(data) > 0 {
+		n := 1 + len(data)%7777
+		if n > len(data) {
+			n = len(data)
+		}
+		err := enc.Write(data[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	written, err := enc.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Flush(bitstream.Zero)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packed.Bytes(), written
+}
+
+func TestRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	noise := make([]byte, 3*BlockSize+123)
+	random.Read(noise)
+	skewed := make([]byte, 200000)
+	for i := range skewed {
+		if random.Intn(50) == 0 {
+			skewed[i] = byte(random.Intn(256))
+		}
+	}
+	cases := map[string][]byte{
+		"single":  []byte("a"),
+		"repeats": bytes.Repeat([]byte{'x'}, 100000),
+		"text":    []byte(strings.Repeat("tables of states stand in for codes\n", 5000)),
+		"noise":   noise,
+		"skewed":  skewed,
+	}
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			for _, tableLog := range []uint{MinTableLog, DefaultTableLog, MaxTableLog} {
+				table := tableFor(t, data, tableLog)
+				packed, numBits := encode(t, table, data)
+				if uint64(len(packed)) != (numBits+7)/8 {
+					t.Fatalf("packed %d bytes for %d bits", len(packed), numBits)
+				}
+				source := bytes.NewReader(append(packed, 0xff))
+				var decoded bytes.Buffer
+				err := CreateDecoder(table, source, numBits).Decode(uint64(len(data)), &decoded)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(decoded.Bytes(), data) {
+					t.Fatalf("table log %d: data didn't round trip", tableLog)
+				}
+				if source.Len() != 1 {
+					t.Errorf("decoder left %d bytes instead of 1", source.Len())
+				}
+			}
+		})
+	}
+}
+
+func TestNearEntropy(t *testing.T) {
+	// 'a' 90% of the time is 0.47 bits a byte, where Huffman needs 1
+	random := rand.New(rand.NewSource(2))
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = 'a'
+		if random.Intn(10) == 0 {
+			data[i] = 'b'
+		}
+	}
+	_, numBits := encode(t, tableFor(t, data, DefaultTableLog), data)
+	if numBits > uint64(len(data))/2 {
+		t.Errorf("took %d bits for %d bytes", numBits, len(data))
+	}
+}
+
+func TestTableRoundTrip(t *testing.T) {
+	table := tableFor(t, []byte(strings.Repeat("abracadabra", 100)+"\x00\xff"), 9)
+	var buffer bytes.Buffer
+	writer := bitstream.NewWriter(&buffer)
+	err := table.Write(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Flush(bitstream.Zero)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, bitsRead, err := ReadTable(bitstream.NewReader(&buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Counts() != table.Counts() || read.Log() != 9 || bitsRead != 4+256+7*9 {
+		t.Errorf("read back log %d with %d bits", read.Log(), bitsRead)
+	}
+	if table.Bits() != uint64(bitsRead) {
+		t.Errorf("table says it takes %d bits, writing it took %d", table.Bits(), bitsRead)
+	}
+}
+
+func TestCost(t *testing.T) {
+	random := rand.New(rand.NewSource(3))
+	data := make([]byte, 200000)
+	for i := range data {
+		data[i] = byte(random.ExpFloat64() * 10)
+	}
+	var histogram [256]uint64
+	for _, currentByte := range data {
+		histogram[currentByte]++
+	}
+	table := tableFor(t, data, DefaultTableLog)
+	estimate, ok := table.Cost(&histogram)
+	if !ok {
+		t.Fatal("every byte of the data has states")
+	}
+	_, numBits := encode(t, table, data)
+	if estimate > numBits+numBits/100 || numBits > estimate+estimate/100 {
+		t.Errorf("estimated %d bits, coding took %d", estimate, numBits)
+	}
+	if _, ok := tableFor(t, []byte("abc"), MinTableLog).Cost(&histogram); ok {
+		t.Error("bytes without states can't be coded")
+	}
+}
+
+func TestRejectsBadInput(t *testing.T) {
+	var counts [256]uint32
+	counts['a'] = 100
+	_, err := CreateTable(counts, MinTableLog)
+	if err == nil {
+		t.Error("counts not adding up to the number of states should fail")
+	}
+	data := []byte(strings.Repeat("hello tans ", 1000))
+	table := tableFor(t, data, DefaultTableLog)
+	enc := CreateEncoder(table, func(uint64, uint) error { return nil })
+	err = enc.Write([]byte("z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enc.Finish(); err == nil {
+		t.Error("a byte without a count should fail")
+	}
+	packed, numBits := encode(t, table, data)
+	packed[len(packed)/2] ^= 0x40
+	err = CreateDecoder(table, bytes.NewReader(packed), numBits).Decode(uint64(len(data)), &bytes.Buffer{})
+	if err == nil {
+		t.Error("damaged data should fail")
+	}
+}